@@ -0,0 +1,197 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"git.semlanik.org/semlanik/gostfix/common"
+	uuid "github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	AppPasswordLength   = 16
+	AppPasswordMaxCount = 32
+)
+
+// AddAppPassword creates application-specific password for the mail
+// services listed in scopes, all services are allowed if scopes is empty.
+// Returns generated password, only its hash is stored.
+func (a *Authenticator) AddAppPassword(user, name string, scopes []string) (*common.AppPassword, string, error) {
+	name = strings.Trim(name, " \t")
+	if name == "" || len(name) > 128 {
+		return nil, "", errors.New("Invalid application password name")
+	}
+
+	for _, scope := range scopes {
+		if !common.IsValidAppPasswordScope(scope) {
+			return nil, "", errors.New("Invalid application password scope")
+		}
+	}
+
+	count, err := a.appPasswordsCollection.CountDocuments(context.Background(), bson.M{"user": user})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if count >= AppPasswordMaxCount {
+		return nil, "", errors.New("Too many application passwords")
+	}
+
+	password, err := generateAppPassword()
+	if err != nil {
+		return nil, "", err
+	}
+
+	appPassword := &common.AppPassword{
+		Id:      uuid.New().String(),
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now().Unix(),
+	}
+
+	_, err = a.appPasswordsCollection.InsertOne(context.Background(), bson.M{
+		"user":     user,
+		"id":       appPassword.Id,
+		"name":     appPassword.Name,
+		"scopes":   appPassword.Scopes,
+		"hash":     hashAppPassword(password),
+		"created":  appPassword.Created,
+		"lastUsed": int64(0),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return appPassword, password, nil
+}
+
+// GetAppPasswords returns application passwords of the user
+func (a *Authenticator) GetAppPasswords(user string) ([]*common.AppPassword, error) {
+	cur, err := a.appPasswordsCollection.Find(context.Background(), bson.M{"user": user}, options.Find().SetSort(bson.M{"created": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	appPasswords := []*common.AppPassword{}
+	for cur.Next(context.Background()) {
+		appPassword := &common.AppPassword{}
+		if err := cur.Decode(appPassword); err != nil {
+			continue
+		}
+
+		if appPassword.Scopes == nil {
+			appPassword.Scopes = []string{}
+		}
+		appPasswords = append(appPasswords, appPassword)
+	}
+	return appPasswords, nil
+}
+
+// RemoveAppPassword revokes application password of the user
+func (a *Authenticator) RemoveAppPassword(user, id string) error {
+	result, err := a.appPasswordsCollection.DeleteOne(context.Background(), bson.M{"user": user, "id": id})
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return errors.New("Application password not found")
+	}
+	return nil
+}
+
+// checkAppPassword verifies that password is one of application passwords
+// of the user and it's allowed for service
+func (a *Authenticator) checkAppPassword(user, password, service string) error {
+	result := struct {
+		Id     string
+		Scopes []string
+	}{}
+
+	filter := bson.M{"user": user, "hash": hashAppPassword(password)}
+	err := a.appPasswordsCollection.FindOne(context.Background(), filter).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return errors.New("Invalid user or password")
+	}
+
+	if err != nil {
+		return ErrTemporaryFailure
+	}
+
+	if len(result.Scopes) > 0 {
+		allowed := false
+		for _, scope := range result.Scopes {
+			if scope == service {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return errors.New("Application password is not allowed for the service")
+		}
+	}
+
+	a.appPasswordsCollection.UpdateOne(context.Background(), bson.M{"user": user, "id": result.Id}, bson.M{"$set": bson.M{"lastUsed": time.Now().Unix()}})
+	return nil
+}
+
+func (a *Authenticator) createAppPasswordIndexes() {
+	a.appPasswordsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{"user", 1}, {"hash", 1}},
+	})
+}
+
+// generateAppPassword generates random password of lowercase letters that
+// is easy to type on mobile devices. Password is long enough to be hashed
+// without salt.
+func generateAppPassword() (string, error) {
+	random := make([]byte, AppPasswordLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	for i := range random {
+		random[i] = 'a' + random[i]%26
+	}
+	return string(random), nil
+}
+
+// hashAppPassword ignores spaces and case, so password may be typed in
+// groups as it's displayed
+func hashAppPassword(password string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.Replace(password, " ", "", -1))))
+	return hex.EncodeToString(sum[:])
+}
@@ -27,10 +27,19 @@ package auth
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"strings"
 	"time"
 
+	"git.semlanik.org/semlanik/gostfix/common"
 	"git.semlanik.org/semlanik/gostfix/config"
 	utils "git.semlanik.org/semlanik/gostfix/utils"
 	uuid "github.com/google/uuid"
@@ -41,13 +50,36 @@ import (
 )
 
 type Authenticator struct {
-	db               *mongo.Database
-	usersCollection  *mongo.Collection
-	tokensCollection *mongo.Collection
+	db                     *mongo.Database
+	usersCollection        *mongo.Collection
+	tokensCollection       *mongo.Collection
+	failuresCollection     *mongo.Collection
+	authEventsCollection   *mongo.Collection
+	appPasswordsCollection *mongo.Collection
+	tokenKey               []byte
 }
 
 type Privileges int
 
+const (
+	MaxUserAgentLength    = 256
+	TokenKeyLength        = 32
+	InternalTokenLifetime = time.Hour
+	TokenPurgeInterval    = 10 * time.Minute
+)
+
+const (
+	ServiceWeb  = "web"
+	ServiceSmtp = common.AppPasswordScopeSmtp
+	ServiceImap = common.AppPasswordScopeImap
+	ServicePop3 = common.AppPasswordScopePop3
+	ServiceDav  = common.AppPasswordScopeDav
+)
+
+// ErrTemporaryFailure is returned if user could not be verified because of
+// storage failure, so client may retry later
+var ErrTemporaryFailure = errors.New("Temporary authentication failure")
+
 const (
 	AdminPrivilege = 1 << iota
 	SendMailPrivilege
@@ -78,176 +110,362 @@ func NewAuthenticator() (*Authenticator, error) {
 		return nil, err
 	}
 
+	tokenKey, err := loadTokenKey(config.ConfigInstance().WebTokenKey)
+	if err != nil {
+		return nil, err
+	}
+
 	db := client.Database("gostfix")
 	a := &Authenticator{
-		db:               db,
-		usersCollection:  db.Collection("users"),
-		tokensCollection: db.Collection("tokens"),
+		db:                     db,
+		usersCollection:        db.Collection("users"),
+		tokensCollection:       db.Collection("tokens"),
+		failuresCollection:     db.Collection("authFailures"),
+		authEventsCollection:   db.Collection("authEvents"),
+		appPasswordsCollection: db.Collection("appPasswords"),
+		tokenKey:               tokenKey,
 	}
+	a.createThrottleIndexes()
+	a.createAppPasswordIndexes()
 	return a, nil
 }
 
-func (a *Authenticator) CheckUser(user, password string) error {
+// CheckUser verifies credentials of the user for mail service. Both account
+// password and application passwords allowed for service are accepted. Users
+// with two-factor authentication enabled can use application passwords only.
+func (a *Authenticator) CheckUser(user, password, service string) error {
+	err := a.checkAppPassword(user, password, service)
+	if err != ErrTemporaryFailure && err != nil {
+		err = a.checkPassword(user, password)
+		if err == nil && a.IsTotpEnabled(user) {
+			log.Printf("Account password of %s is refused for mail services, two-factor authentication is enabled\n", user)
+			return errors.New("Invalid user or password")
+		}
+	}
+	return err
+}
+
+func (a *Authenticator) checkPassword(user, password string) error {
 	log.Printf("Check user: %s", user)
 	result := struct {
-		User     string
-		Password string
+		User        string
+		Password    string
+		Credentials *common.Credentials
 	}{}
 	err := a.usersCollection.FindOne(context.Background(), bson.M{"user": user}).Decode(&result)
-	if err != nil {
+	if err == mongo.ErrNoDocuments {
 		return errors.New("Invalid user or password")
 	}
 
+	if err != nil {
+		log.Printf("Unable to read user %s: %s\n", user, err)
+		return ErrTemporaryFailure
+	}
+
 	if bcrypt.CompareHashAndPassword([]byte(result.Password), []byte(password)) != nil {
 		return errors.New("Invalid user or password")
 	}
+
+	//Users created before challenge-response mechanisms were supported get
+	//credentials on the first successful login
+	if result.Credentials == nil {
+		if credentials, err := common.NewCredentials(password); err == nil {
+			a.usersCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$set": bson.M{"credentials": credentials}})
+		}
+	}
 	return nil
 }
 
-func (a *Authenticator) addToken(user, token string) error {
+// GetCredentials returns keys that are used by challenge-response SASL
+// mechanisms to verify the user
+func (a *Authenticator) GetCredentials(user string) (*common.Credentials, error) {
+	result := struct {
+		Credentials *common.Credentials
+	}{}
+	err := a.usersCollection.FindOne(context.Background(), bson.M{"user": user}).Decode(&result)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, ErrTemporaryFailure
+	}
+
+	if err != nil || result.Credentials == nil || a.IsTotpEnabled(user) {
+		return nil, errors.New("Credentials are not available")
+	}
+	return result.Credentials, nil
+}
+
+// ScramSalt returns salt that SASL SCRAM exchange reports for users without
+// SCRAM credentials. Salt is derived from the user name, so it doesn't change
+// between attempts and unknown users are not distinguishable from existing.
+func (a *Authenticator) ScramSalt(user string) []byte {
+	mac := hmac.New(sha256.New, a.tokenKey)
+	mac.Write([]byte("scram-salt"))
+	mac.Write([]byte{0})
+	mac.Write([]byte(user))
+	return mac.Sum(nil)[:common.ScramSaltLength]
+}
+
+func (a *Authenticator) addToken(user, token string, session *common.Session) error {
 	log.Printf("Add token: %s\n", user)
-	a.tokensCollection.UpdateOne(context.Background(),
+	now := time.Now()
+	expire := tokenExpire(now, now)
+	if session.Origin != common.SessionOriginWeb {
+		expire = now.Add(InternalTokenLifetime).Unix()
+	}
+
+	_, err := a.tokensCollection.UpdateOne(context.Background(),
 		bson.M{"user": user},
 		bson.M{
 			"$addToSet": bson.M{
 				"token": bson.M{
-					"token":  token,
-					"expire": time.Now().Add(time.Hour * 24).Unix(),
+					"hash":      a.hashToken(user, token),
+					"expire":    expire,
+					"id":        uuid.New().String(),
+					"created":   now.Unix(),
+					"lastSeen":  now.Unix(),
+					"address":   session.Address,
+					"userAgent": session.UserAgent,
+					"origin":    session.Origin,
 				},
 			},
 		},
 		options.Update().SetUpsert(true))
-	a.cleanupTokens(user)
-	return nil
+	return err
 }
 
-func (a *Authenticator) cleanupTokens(user string) {
-	log.Printf("Cleanup tokens: %s\n", user)
+// hashToken calculates keyed hash of the token, only hashes are stored so
+// database contents are not enough to restore sessions. Hash is bound to
+// the user, token of one user is not valid for another.
+func (a *Authenticator) hashToken(user, token string) string {
+	mac := hmac.New(sha256.New, a.tokenKey)
+	mac.Write([]byte(user))
+	mac.Write([]byte{0})
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
-	cur, err := a.tokensCollection.Aggregate(context.Background(),
-		bson.A{
-			bson.M{"$match": bson.M{"user": user}},
-			bson.M{"$unwind": "$token"},
-		})
+// tokenExpire returns time when web session token that was created at
+// created expires if it's used at now. Session expires after
+// WebSessionExpireTime of inactivity, but not later than WebSessionMaxAge
+// after login. Returns 0 if session never expires.
+func tokenExpire(created, now time.Time) int64 {
+	var expire time.Time
+	if config.ConfigInstance().WebSessionExpireTime > 0 {
+		expire = now.Add(config.ConfigInstance().WebSessionExpireTime)
+	}
 
-	if err != nil {
-		log.Fatalln(err)
+	if maxAge := config.ConfigInstance().WebSessionMaxAge; maxAge > 0 {
+		if expire.IsZero() || created.Add(maxAge).Before(expire) {
+			expire = created.Add(maxAge)
+		}
 	}
 
-	type tokenMetadata struct {
-		Expire int64
-		Token  string
+	if expire.IsZero() {
+		return 0
 	}
+	return expire.Unix()
+}
 
-	tokensToKeep := bson.A{}
-	defer cur.Close(context.Background())
-	for cur.Next(context.Background()) {
-		result := struct {
-			Token *tokenMetadata
-		}{
-			Token: &tokenMetadata{},
-		}
+// PurgeExpiredTokens removes expired tokens of all users and tokens that
+// were stored before token hashing was introduced
+func (a *Authenticator) PurgeExpiredTokens() error {
+	_, err := a.tokensCollection.UpdateMany(context.Background(), bson.M{}, bson.M{
+		"$pull": bson.M{
+			"token": bson.M{
+				"$or": bson.A{
+					bson.M{"expire": bson.M{"$gt": 0, "$lt": time.Now().Unix()}},
+					bson.M{"hash": bson.M{"$exists": false}},
+				},
+			},
+		},
+	})
+	return err
+}
 
-		err = cur.Decode(&result)
-		if err == nil && result.Token.Expire >= time.Now().Unix() {
-			tokensToKeep = append(tokensToKeep, result.Token)
-		} else {
-			log.Printf("Expired token found for %s : %d", user, result.Token.Expire)
+// Run purges expired tokens periodically
+func (a *Authenticator) Run() {
+	for {
+		if err := a.PurgeExpiredTokens(); err != nil {
+			log.Printf("Unable to purge expired tokens: %s\n", err)
 		}
+		time.Sleep(TokenPurgeInterval)
 	}
-
-	_, err = a.tokensCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$set": bson.M{"token": tokensToKeep}})
-	return
 }
 
-func (a *Authenticator) Login(user, password string) (string, bool) {
+// Login verifies user credentials and creates web session token. address is
+// the client address that is used to throttle brute-force attempts.
+func (a *Authenticator) Login(user, password, address, userAgent string) (string, bool) {
 	if !utils.RegExpUtilsInstance().EmailChecker.MatchString(user) {
 		return "", false
 	}
 
-	if a.CheckUser(user, password) != nil {
+	if a.CheckUserFrom(user, password, address, ServiceWeb) != nil || a.IsTotpEnabled(user) {
 		return "", false
 	}
 
+	return a.IssueWebToken(user, address, userAgent), true
+}
+
+// IssueToken creates session token for internal services that send mail on
+// behalf of the user, e.g. auto-replies. Token should be removed using Logout
+// once it's not needed anymore.
+func (a *Authenticator) IssueToken(user string) string {
 	token := uuid.New().String()
-	a.addToken(user, token)
-	return token, true
+	a.addToken(user, token, &common.Session{Origin: common.SessionOriginToken})
+	return token
 }
 
-func (a *Authenticator) Logout(user, token string) error {
-	a.cleanupTokens(user)
+// IssueWebToken creates web session token for the user that is already
+// verified
+func (a *Authenticator) IssueWebToken(user, address, userAgent string) string {
+	if len(userAgent) > MaxUserAgentLength {
+		userAgent = userAgent[:MaxUserAgentLength]
+	}
+
+	token := uuid.New().String()
+	a.addToken(user, token, &common.Session{
+		Address:   address,
+		UserAgent: userAgent,
+		Origin:    common.SessionOriginWeb,
+	})
+	return token
+}
 
-	_, err := a.tokensCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$pull": bson.M{"token": bson.M{"token": token}}})
+func (a *Authenticator) Logout(user, token string) error {
+	_, err := a.tokensCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$pull": bson.M{"token": bson.M{"hash": a.hashToken(user, token)}}})
 	if err != nil {
 		log.Printf("Unable to remove token %s", err)
+		return err
 	}
 
-	return err
+	publishSessionRevoked(user, "")
+	return nil
 }
 
-func (a *Authenticator) checkToken(user, token string) error {
+// checkToken verifies that token is valid, web session is extended on
+// activity if extend is true
+func (a *Authenticator) checkToken(user, token string, extend bool) error {
 	if token == "" {
 		return errors.New("Invalid token")
 	}
 
+	hash := a.hashToken(user, token)
 	cur, err := a.tokensCollection.Aggregate(context.Background(),
 		bson.A{
 			bson.M{"$match": bson.M{"user": user}},
 			bson.M{"$unwind": "$token"},
-			bson.M{"$match": bson.M{"token.token": token}},
+			bson.M{"$match": bson.M{"token.hash": hash}},
 		})
 
 	if err != nil {
-		log.Fatalln(err)
+		log.Printf("Unable to read tokens of %s: %s\n", user, err)
 		return err
 	}
 
+	result := struct {
+		Token struct {
+			Expire  int64
+			Created int64
+			Origin  string
+		}
+	}{}
+
 	ok := false
+	now := time.Now()
 	defer cur.Close(context.Background())
 	if cur.Next(context.Background()) {
-		result := struct {
-			Token struct {
-				Expire int64
-			}
-		}{}
-		
 		err = cur.Decode(&result)
-		
-		ok = err == nil && (config.ConfigInstance().WebSessionExpireTime <= 0 || result.Token.Expire >= time.Now().Unix())
+		ok = err == nil && (result.Token.Expire == 0 || result.Token.Expire >= now.Unix())
+	}
+
+	if ok && !extend {
+		return nil
 	}
 
 	if ok {
-		if config.ConfigInstance().WebSessionExpireTime > 0 {
-			opts := options.Update().SetArrayFilters(options.ArrayFilters{
-				Registry: bson.DefaultRegistry,
-				Filters: bson.A{
-					bson.M{"element.token": token},
-				}})
-			a.tokensCollection.UpdateOne(context.Background(),
-				bson.M{
-					"user": user,
-				},
-				bson.M{
-					"$set": bson.M{
-						"token.$[element].expire": time.Now().Add(config.ConfigInstance().WebSessionExpireTime).Unix(),
-					},
-				},
-				opts)
+		update := bson.M{
+			"token.$[element].lastSeen": now.Unix(),
 		}
+
+		//Only web sessions are extended on activity
+		if result.Token.Origin == common.SessionOriginWeb {
+			update["token.$[element].expire"] = tokenExpire(time.Unix(result.Token.Created, 0), now)
+		}
+
+		opts := options.Update().SetArrayFilters(options.ArrayFilters{
+			Registry: bson.DefaultRegistry,
+			Filters: bson.A{
+				bson.M{"element.hash": hash},
+			}})
+		a.tokensCollection.UpdateOne(context.Background(),
+			bson.M{
+				"user": user,
+			},
+			bson.M{
+				"$set": update,
+			},
+			opts)
 		return nil
 	}
 
 	return errors.New("Token expired")
 }
 
+// loadTokenKey reads token hashing key from the file at path, new key is
+// generated if the file doesn't exist
+func loadTokenKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		key, err = hex.DecodeString(strings.TrimSpace(string(key)))
+		if err != nil || len(key) != TokenKeyLength {
+			return nil, errors.New("Invalid token key file " + path)
+		}
+		return key, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Printf("Token key not found, generating new key in %s\n", path)
+	key = make([]byte, TokenKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	//Key is written to temporary file and linked to the path, so other
+	//authenticator never reads partially written key
+	tmpPath := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	err = ioutil.WriteFile(tmpPath, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpPath)
+
+	err = os.Link(tmpPath, path)
+	if os.IsExist(err) {
+		return loadTokenKey(path)
+	}
+	return key, err
+}
+
 func (a *Authenticator) Verify(user, token string) bool {
 	if !utils.RegExpUtilsInstance().EmailChecker.MatchString(user) {
 		return false
 	}
 
-	return a.checkToken(user, token) == nil
+	return a.checkToken(user, token, true) == nil
 }
 
-func (a *Authenticator) CheckPrivileges(user string, privilege Privileges) {
+// IsTokenValid checks if token was not revoked or expired without counting
+// it as user activity
+func (a *Authenticator) IsTokenValid(user, token string) bool {
+	return a.checkToken(user, token, false) == nil
+}
 
+func (a *Authenticator) CheckPrivileges(user string, privilege Privileges) bool {
+	result := struct {
+		Privileges Privileges
+	}{}
+	err := a.usersCollection.FindOne(context.Background(), bson.M{"user": user}).Decode(&result)
+	return err == nil && result.Privileges&privilege == privilege
 }
@@ -0,0 +1,132 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"git.semlanik.org/semlanik/gostfix/common"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// GetSessions returns active sessions of the user, session of currentToken
+// is marked as current
+func (a *Authenticator) GetSessions(user, currentToken string) ([]*common.Session, error) {
+	currentHash := a.hashToken(user, currentToken)
+	cur, err := a.tokensCollection.Aggregate(context.Background(),
+		bson.A{
+			bson.M{"$match": bson.M{"user": user}},
+			bson.M{"$unwind": "$token"},
+			bson.M{"$match": bson.M{"$or": bson.A{
+				bson.M{"token.expire": 0},
+				bson.M{"token.expire": bson.M{"$gte": time.Now().Unix()}},
+			}}},
+			bson.M{"$sort": bson.M{"token.lastSeen": -1}},
+		})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	sessions := []*common.Session{}
+	for cur.Next(context.Background()) {
+		result := struct {
+			Token struct {
+				Hash      string
+				Id        string
+				Created   int64
+				LastSeen  int64
+				Address   string
+				UserAgent string
+				Origin    string
+			}
+		}{}
+
+		if err := cur.Decode(&result); err != nil {
+			continue
+		}
+
+		sessions = append(sessions, &common.Session{
+			Id:        result.Token.Id,
+			Created:   result.Token.Created,
+			LastSeen:  result.Token.LastSeen,
+			Address:   result.Token.Address,
+			UserAgent: result.Token.UserAgent,
+			Origin:    result.Token.Origin,
+			Current:   result.Token.Hash == currentHash,
+		})
+	}
+	return sessions, nil
+}
+
+// RevokeSession removes session of the user by id
+func (a *Authenticator) RevokeSession(user, id string) error {
+	if id == "" {
+		return errors.New("Invalid session")
+	}
+
+	result, err := a.tokensCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$pull": bson.M{"token": bson.M{"id": id}}})
+	if err != nil {
+		return err
+	}
+
+	if result.ModifiedCount == 0 {
+		return errors.New("Session not found")
+	}
+
+	publishSessionRevoked(user, id)
+	return nil
+}
+
+// RevokeOtherSessions removes all sessions of the user except the session of
+// currentToken
+func (a *Authenticator) RevokeOtherSessions(user, currentToken string) error {
+	_, err := a.tokensCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$pull": bson.M{"token": bson.M{"hash": bson.M{"$ne": a.hashToken(user, currentToken)}}}})
+	if err == nil {
+		publishSessionRevoked(user, "")
+	}
+	return err
+}
+
+// RevokeAllSessions removes all sessions of the user
+func (a *Authenticator) RevokeAllSessions(user string) error {
+	_, err := a.tokensCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$set": bson.M{"token": bson.A{}}})
+	if err == nil {
+		publishSessionRevoked(user, "")
+	}
+	return err
+}
+
+// publishSessionRevoked notifies that sessions of the user are revoked, so
+// live connections of these sessions are closed
+func publishSessionRevoked(user, id string) {
+	common.EventBusInstance().Publish(&common.Event{
+		Type:      common.EventSessionRevoked,
+		User:      user,
+		SessionId: id,
+	})
+}
@@ -0,0 +1,267 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"git.semlanik.org/semlanik/gostfix/common"
+	"git.semlanik.org/semlanik/gostfix/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrThrottled is returned if login attempt is refused because of too many
+// failed attempts from the client address or for the user
+var ErrThrottled = errors.New("Too many failed login attempts, try again later")
+
+const authEventsExpire = 30 * 24 * time.Hour
+
+type failureRecord struct {
+	Failures    int64
+	Last        time.Time
+	LockedUntil time.Time
+}
+
+// CheckUserFrom verifies user credentials like CheckUser, but refuses login
+// attempts after too many failures. Account password is always accepted for
+// web service, second factor is verified separately.
+func (a *Authenticator) CheckUserFrom(user, password, address, service string) error {
+	if err := a.CheckThrottle(user, address, service); err != nil {
+		return err
+	}
+
+	var err error
+	if service == ServiceWeb {
+		err = a.checkPassword(user, password)
+	} else {
+		err = a.CheckUser(user, password, service)
+	}
+	if err == ErrTemporaryFailure {
+		return err
+	}
+
+	if err != nil {
+		a.RegisterFailure(user, address, service)
+		return err
+	}
+
+	//Failures are kept until second factor is verified, otherwise the
+	//known password would allow to guess TOTP codes without limits
+	if service != ServiceWeb || !a.IsTotpEnabled(user) {
+		a.RegisterSuccess(user, address)
+	}
+	return nil
+}
+
+// CheckThrottle returns ErrThrottled if login attempt of the user from the
+// address should be delayed. Only address is checked if user is empty.
+func (a *Authenticator) CheckThrottle(user, address, service string) error {
+	throttle := config.ConfigInstance().Throttle
+	if throttle.IsAllowed(address) {
+		return nil
+	}
+
+	now := time.Now()
+	for _, key := range throttleKeys(user, address) {
+		record := &failureRecord{}
+		err := a.failuresCollection.FindOne(context.Background(), key).Decode(record)
+		if err != nil {
+			continue
+		}
+
+		throttled := now.Before(record.LockedUntil)
+		if !throttled && record.Failures > throttle.FreeAttempts {
+			delay := throttle.MaxDelay
+			if shift := record.Failures - throttle.FreeAttempts - 1; shift < 32 {
+				delay = throttle.BaseDelay << uint(shift)
+			}
+
+			if delay > throttle.MaxDelay {
+				delay = throttle.MaxDelay
+			}
+			throttled = now.Before(record.Last.Add(delay))
+		}
+
+		if throttled {
+			a.addAuthEvent(user, address, service, common.AuthEventThrottled)
+			return ErrThrottled
+		}
+	}
+	return nil
+}
+
+// CheckTotpFrom verifies second factor code of the user with the same
+// brute-force protection as passwords
+func (a *Authenticator) CheckTotpFrom(user, code, address string) error {
+	if err := a.CheckThrottle(user, address, ServiceWeb); err != nil {
+		return err
+	}
+
+	if !a.CheckTotp(user, code) {
+		a.RegisterFailure(user, address, ServiceWeb)
+		return errors.New("Invalid code")
+	}
+
+	a.RegisterSuccess(user, address)
+	return nil
+}
+
+// RegisterFailure counts failed login attempt and locks login once lockout
+// threshold is reached
+func (a *Authenticator) RegisterFailure(user, address, service string) {
+	throttle := config.ConfigInstance().Throttle
+	a.addAuthEvent(user, address, service, common.AuthEventFailure)
+	if throttle.IsAllowed(address) {
+		return
+	}
+
+	now := time.Now()
+	for _, key := range throttleKeys(user, address) {
+		record := &failureRecord{}
+		err := a.failuresCollection.FindOneAndUpdate(context.Background(),
+			key,
+			bson.M{"$inc": bson.M{"failures": 1}, "$set": bson.M{"last": now}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(record)
+		if err != nil {
+			log.Printf("Unable to register login failure: %s\n", err)
+			continue
+		}
+
+		if record.Failures == throttle.LockoutThreshold {
+			a.failuresCollection.UpdateOne(context.Background(), key, bson.M{"$set": bson.M{"lockedUntil": now.Add(throttle.LockoutDuration)}})
+			log.Printf("Login is locked for %s from %s\n", key["user"], address)
+			a.addAuthEvent(user, address, service, common.AuthEventLockout)
+		}
+	}
+}
+
+// RegisterSuccess resets failures of the user from the address. Failures of
+// the address itself are kept, since other users may be attacked from it.
+func (a *Authenticator) RegisterSuccess(user, address string) {
+	if user == "" {
+		return
+	}
+	a.failuresCollection.DeleteOne(context.Background(), bson.M{"user": user, "address": address})
+}
+
+// ResetFailures removes failures and lockouts of the user and address, any
+// of them may be empty
+func (a *Authenticator) ResetFailures(user, address string) error {
+	filter := bson.M{}
+	if user != "" {
+		filter["user"] = user
+	}
+
+	if address != "" {
+		filter["address"] = address
+	}
+
+	_, err := a.failuresCollection.DeleteMany(context.Background(), filter)
+	return err
+}
+
+// GetAuthEvents returns latest authentication events filtered by user and
+// address if not empty
+func (a *Authenticator) GetAuthEvents(user, address string, limit int64) ([]*common.AuthEvent, error) {
+	filter := bson.M{}
+	if user != "" {
+		filter["user"] = user
+	}
+
+	if address != "" {
+		filter["address"] = address
+	}
+
+	cur, err := a.authEventsCollection.Find(context.Background(), filter, options.Find().SetSort(bson.M{"time": -1}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	events := []*common.AuthEvent{}
+	for cur.Next(context.Background()) {
+		result := struct {
+			Time    time.Time
+			User    string
+			Address string
+			Service string
+			Event   string
+		}{}
+
+		if err := cur.Decode(&result); err != nil {
+			continue
+		}
+
+		events = append(events, &common.AuthEvent{
+			Time:    result.Time.Unix(),
+			User:    result.User,
+			Address: result.Address,
+			Service: result.Service,
+			Event:   result.Event,
+		})
+	}
+	return events, nil
+}
+
+func (a *Authenticator) addAuthEvent(user, address, service, event string) {
+	a.authEventsCollection.InsertOne(context.Background(), bson.M{
+		"time":    time.Now(),
+		"user":    user,
+		"address": address,
+		"service": service,
+		"event":   event,
+	})
+}
+
+func (a *Authenticator) createThrottleIndexes() {
+	a.failuresCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{"user", 1}, {"address", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	a.failuresCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"last": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32(config.ConfigInstance().Throttle.LockoutDuration.Seconds())),
+	})
+	a.authEventsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"time": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32(authEventsExpire.Seconds())),
+	})
+}
+
+// throttleKeys returns filters of records that failures are counted for:
+// the user and address pair and the address
+func throttleKeys(user, address string) []bson.M {
+	keys := []bson.M{{"user": "", "address": address}}
+	if user != "" {
+		keys = append(keys, bson.M{"user": user, "address": address})
+	}
+	return keys
+}
@@ -0,0 +1,249 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	TotpIssuer         = "gostfix"
+	TotpDigits         = 6
+	TotpPeriod         = 30
+	TotpSecretLength   = 20
+	RecoveryCodesCount = 10
+	RecoveryCodeLength = 10
+)
+
+type totpRecord struct {
+	Enabled       bool
+	Secret        string
+	PendingSecret string
+	LastStep      int64
+	RecoveryCodes []string
+}
+
+// IsTotpEnabled checks if user has two-factor authentication enabled
+func (a *Authenticator) IsTotpEnabled(user string) bool {
+	totp, err := a.getTotp(user)
+	return err == nil && totp.Enabled
+}
+
+// BeginTotpEnrollment generates new TOTP secret for the user and returns the
+// secret and provisioning URI. Secret is activated only after the first code
+// is verified using ConfirmTotpEnrollment.
+func (a *Authenticator) BeginTotpEnrollment(user string) (string, string, error) {
+	if a.IsTotpEnabled(user) {
+		return "", "", errors.New("Two-factor authentication is already enabled")
+	}
+
+	secretBytes := make([]byte, TotpSecretLength)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", "", err
+	}
+
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secretBytes)
+	_, err := a.usersCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$set": bson.M{"totp.pendingSecret": secret}})
+	if err != nil {
+		return "", "", err
+	}
+
+	uri := fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s&digits=%d&period=%d",
+		url.PathEscape(TotpIssuer), url.PathEscape(user), secret, url.QueryEscape(TotpIssuer), TotpDigits, TotpPeriod)
+	return secret, uri, nil
+}
+
+// ConfirmTotpEnrollment enables two-factor authentication if code matches
+// pending secret and returns recovery codes that are shown to the user once
+func (a *Authenticator) ConfirmTotpEnrollment(user, code string) ([]string, error) {
+	totp, err := a.getTotp(user)
+	if err != nil || totp.PendingSecret == "" {
+		return nil, errors.New("Two-factor authentication enrollment is not started")
+	}
+
+	step, ok := checkTotpCode(totp.PendingSecret, code, time.Now())
+	if !ok {
+		return nil, errors.New("Invalid code")
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = a.usersCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$set": bson.M{"totp": bson.M{
+		"enabled":       true,
+		"secret":        totp.PendingSecret,
+		"lastStep":      step,
+		"recoveryCodes": hashes,
+	}}})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the user
+func (a *Authenticator) RegenerateRecoveryCodes(user string) ([]string, error) {
+	if !a.IsTotpEnabled(user) {
+		return nil, errors.New("Two-factor authentication is not enabled")
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = a.usersCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$set": bson.M{"totp.recoveryCodes": hashes}})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// CheckTotp verifies TOTP or recovery code of the user. Every TOTP code and
+// recovery code is accepted only once.
+func (a *Authenticator) CheckTotp(user, code string) bool {
+	totp, err := a.getTotp(user)
+	if err != nil || !totp.Enabled {
+		return false
+	}
+
+	code = strings.Replace(strings.Trim(code, " \t"), " ", "", -1)
+	if step, ok := checkTotpCode(totp.Secret, code, time.Now()); ok {
+		result, err := a.usersCollection.UpdateOne(context.Background(),
+			bson.M{"user": user, "totp.lastStep": bson.M{"$lt": step}},
+			bson.M{"$set": bson.M{"totp.lastStep": step}})
+		return err == nil && result.ModifiedCount > 0
+	}
+
+	result, err := a.usersCollection.UpdateOne(context.Background(),
+		bson.M{"user": user, "totp.recoveryCodes": hashRecoveryCode(code)},
+		bson.M{"$pull": bson.M{"totp.recoveryCodes": hashRecoveryCode(code)}})
+	return err == nil && result.ModifiedCount > 0
+}
+
+// ResetTotp disables two-factor authentication of the user
+func (a *Authenticator) ResetTotp(user string) error {
+	_, err := a.usersCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$unset": bson.M{"totp": ""}})
+	return err
+}
+
+// RecoveryCodesLeft returns number of recovery codes that are not used yet
+func (a *Authenticator) RecoveryCodesLeft(user string) int {
+	totp, err := a.getTotp(user)
+	if err != nil {
+		return 0
+	}
+	return len(totp.RecoveryCodes)
+}
+
+func (a *Authenticator) getTotp(user string) (*totpRecord, error) {
+	result := struct {
+		Totp *totpRecord
+	}{}
+
+	err := a.usersCollection.FindOne(context.Background(), bson.M{"user": user}).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Totp == nil {
+		return &totpRecord{}, nil
+	}
+	return result.Totp, nil
+}
+
+// checkTotpCode verifies code as described in RFC 6238. Codes of previous
+// and next time steps are accepted to compensate clock drift. Returns time
+// step of the matched code.
+func checkTotpCode(secret, code string, now time.Time) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != TotpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / TotpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpCode(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TotpDigits, value%1000000)
+}
+
+func generateRecoveryCodes() ([]string, []string, error) {
+	const alphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+	codes := make([]string, RecoveryCodesCount)
+	hashes := make([]string, RecoveryCodesCount)
+	for i := range codes {
+		random := make([]byte, RecoveryCodeLength)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+
+		for j := range random {
+			random[j] = alphabet[int(random[j])%len(alphabet)]
+		}
+		codes[i] = string(random)
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes recovery code, codes are random so salt is not
+// needed
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(code)))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,57 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package common
+
+// iTIP methods of invitations, RFC 5546
+const (
+	InvitationRequest = "REQUEST"
+	InvitationReply   = "REPLY"
+	InvitationCancel  = "CANCEL"
+)
+
+// Participation status of invitation attendee
+const (
+	PartStatAccepted  = "ACCEPTED"
+	PartStatTentative = "TENTATIVE"
+	PartStatDeclined  = "DECLINED"
+)
+
+// CalendarEvent is calendar object resource of the user's calendar. Calendar
+// keeps iCalendar object with all occurrences of the event, other fields
+// describe the main occurrence.
+type CalendarEvent struct {
+	Id        string `json:"id"`
+	Uid       string `json:"uid"`
+	Summary   string `json:"summary"`
+	Location  string `json:"location"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+	AllDay    bool   `json:"allDay"`
+	Recurring bool   `json:"recurring"`
+	Calendar  string `json:"-"`
+	Created   int64  `json:"created"`
+	Updated   int64  `json:"updated"`
+	Revision  int64  `json:"-"`
+}
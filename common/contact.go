@@ -0,0 +1,50 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package common
+
+// Contact is address book entry of the user. Contacts that are created
+// automatically from recipients of sent mail are marked as collected.
+// VCard keeps original vCard of contacts created by CardDAV clients or
+// import, so properties that are not supported by contacts are preserved.
+type Contact struct {
+	Id        string   `json:"id"`
+	Name      string   `json:"name"`
+	Emails    []string `json:"emails"`
+	Notes     string   `json:"notes"`
+	Groups    []string `json:"groups"`
+	Collected bool     `json:"collected"`
+	UseCount  int64    `json:"useCount"`
+	LastUsed  int64    `json:"lastUsed"`
+	Created   int64    `json:"created"`
+	Updated   int64    `json:"updated"`
+	VCard     string   `json:"-"`
+	Revision  int64    `json:"-"`
+}
+
+// ContactAddress is single address suggested for recipient autocomplete
+type ContactAddress struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
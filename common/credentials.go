@@ -0,0 +1,139 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"errors"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	ScramIterations = 4096
+	ScramSaltLength = 16
+)
+
+// ScramCredentials keeps SCRAM-SHA-256 keys derived from the user password
+// as described in RFC 5802
+type ScramCredentials struct {
+	Salt       []byte `bson:"salt"`
+	Iterations int    `bson:"iterations"`
+	StoredKey  []byte `bson:"storedKey"`
+	ServerKey  []byte `bson:"serverKey"`
+}
+
+// CramMD5Credentials keeps intermediate HMAC-MD5 states of the password, so
+// CRAM-MD5 digest could be verified without knowing the password
+type CramMD5Credentials struct {
+	Inner []byte `bson:"inner"`
+	Outer []byte `bson:"outer"`
+}
+
+// Credentials are stored along with password hash and are used by
+// challenge-response SASL mechanisms
+type Credentials struct {
+	Scram   *ScramCredentials   `bson:"scram"`
+	CramMD5 *CramMD5Credentials `bson:"cramMd5"`
+}
+
+func NewCredentials(password string) (*Credentials, error) {
+	salt := make([]byte, ScramSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(password), salt, ScramIterations, sha256.Size, sha256.New)
+	clientKey := HmacSha256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	key := []byte(password)
+	if len(key) > md5.BlockSize {
+		sum := md5.Sum(key)
+		key = sum[:]
+	}
+
+	inner, err := md5State(key, 0x36)
+	if err != nil {
+		return nil, err
+	}
+
+	outer, err := md5State(key, 0x5c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credentials{
+		Scram: &ScramCredentials{
+			Salt:       salt,
+			Iterations: ScramIterations,
+			StoredKey:  storedKey[:],
+			ServerKey:  HmacSha256(saltedPassword, []byte("Server Key")),
+		},
+		CramMD5: &CramMD5Credentials{
+			Inner: inner,
+			Outer: outer,
+		},
+	}, nil
+}
+
+// Digest calculates HMAC-MD5 of the challenge using stored password states
+func (c *CramMD5Credentials) Digest(challenge []byte) ([]byte, error) {
+	inner := md5.New()
+	if err := inner.(encoding.BinaryUnmarshaler).UnmarshalBinary(c.Inner); err != nil {
+		return nil, errors.New("Invalid CRAM-MD5 credentials")
+	}
+	inner.Write(challenge)
+
+	outer := md5.New()
+	if err := outer.(encoding.BinaryUnmarshaler).UnmarshalBinary(c.Outer); err != nil {
+		return nil, errors.New("Invalid CRAM-MD5 credentials")
+	}
+	outer.Write(inner.Sum(nil))
+	return outer.Sum(nil), nil
+}
+
+func HmacSha256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func md5State(key []byte, pad byte) ([]byte, error) {
+	block := make([]byte, md5.BlockSize)
+	copy(block, key)
+	for i := range block {
+		block[i] ^= pad
+	}
+
+	h := md5.New()
+	h.Write(block)
+	return h.(encoding.BinaryMarshaler).MarshalBinary()
+}
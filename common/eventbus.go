@@ -0,0 +1,215 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package common
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy defines what happens with the event when notifier queue
+// is full
+type OverflowPolicy int
+
+const (
+	// OverflowDrop drops the event immediately, publisher is never blocked
+	OverflowDrop OverflowPolicy = iota
+	// OverflowBlock makes publisher wait for the free space in the queue up
+	// to BlockTimeout, event is dropped if notifier doesn't catch up
+	OverflowBlock
+)
+
+const (
+	DefaultNotifierQueueSize    = 256
+	DefaultNotifierBlockTimeout = time.Second
+)
+
+// NotifierOptions configures queue of the notifier
+type NotifierOptions struct {
+	Name         string
+	QueueSize    int
+	Overflow     OverflowPolicy
+	BlockTimeout time.Duration
+	// Types filters events that are delivered to the notifier, all events
+	// are delivered if empty
+	Types []string
+}
+
+type eventSubscriber struct {
+	notifier Notifier
+	options  NotifierOptions
+	types    map[string]bool
+	queue    chan *Event
+	dropped  uint64
+	lock     sync.Mutex
+}
+
+// EventTransport delivers published event to all gostfix instances, every
+// instance passes received events to EventBus.Dispatch
+type EventTransport func(event *Event) error
+
+// EventBus delivers published events to registered notifiers
+// asynchronously. Every notifier has its own buffered queue, so slow
+// notifier only loses its own events.
+type EventBus struct {
+	subscribers []*eventSubscriber
+	transport   EventTransport
+	lock        sync.RWMutex
+}
+
+var (
+	eventBusInstance *EventBus
+	eventBusOnce     sync.Once
+)
+
+// EventBusInstance returns process wide event bus
+func EventBusInstance() *EventBus {
+	eventBusOnce.Do(func() {
+		eventBusInstance = NewEventBus()
+	})
+	return eventBusInstance
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe registers notifier, options may be nil to use default queue
+// with OverflowDrop policy
+func (b *EventBus) Subscribe(notifier Notifier, options *NotifierOptions) {
+	if notifier == nil {
+		return
+	}
+
+	subscriber := &eventSubscriber{
+		notifier: notifier,
+	}
+
+	if options != nil {
+		subscriber.options = *options
+	}
+
+	if subscriber.options.QueueSize <= 0 {
+		subscriber.options.QueueSize = DefaultNotifierQueueSize
+	}
+
+	if subscriber.options.BlockTimeout <= 0 {
+		subscriber.options.BlockTimeout = DefaultNotifierBlockTimeout
+	}
+
+	if len(subscriber.options.Types) > 0 {
+		subscriber.types = make(map[string]bool)
+		for _, eventType := range subscriber.options.Types {
+			subscriber.types[eventType] = true
+		}
+	}
+
+	subscriber.queue = make(chan *Event, subscriber.options.QueueSize)
+	go subscriber.run()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscribers = append(b.subscribers, subscriber)
+}
+
+// SetTransport makes bus publish events through transport instead of
+// dispatching them to local notifiers directly
+func (b *EventBus) SetTransport(transport EventTransport) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.transport = transport
+}
+
+// Publish sends event to notifiers of all instances if transport is set,
+// or to local notifiers otherwise. Event is dispatched locally if transport
+// fails, so at least this instance is notified.
+func (b *EventBus) Publish(event *Event) {
+	if event.Time == 0 {
+		event.Time = time.Now().Unix()
+	}
+
+	b.lock.RLock()
+	transport := b.transport
+	b.lock.RUnlock()
+
+	if transport != nil {
+		err := transport(event)
+		if err == nil {
+			return
+		}
+		log.Printf("Unable to publish %s event: %s\n", event.Type, err)
+	}
+
+	b.Dispatch(event)
+}
+
+// Dispatch puts event to the queues of local notifiers interested in it
+func (b *EventBus) Dispatch(event *Event) {
+	b.lock.RLock()
+	subscribers := b.subscribers
+	b.lock.RUnlock()
+
+	for _, subscriber := range subscribers {
+		if subscriber.types != nil && !subscriber.types[event.Type] {
+			continue
+		}
+		subscriber.enqueue(event)
+	}
+}
+
+func (s *eventSubscriber) enqueue(event *Event) {
+	select {
+	case s.queue <- event:
+		return
+	default:
+	}
+
+	if s.options.Overflow == OverflowBlock {
+		timer := time.NewTimer(s.options.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case s.queue <- event:
+			return
+		case <-timer.C:
+		}
+	}
+
+	s.lock.Lock()
+	s.dropped++
+	dropped := s.dropped
+	s.lock.Unlock()
+
+	//Log first drop and every 100th to not flood the log
+	if dropped%100 == 1 {
+		log.Printf("Notifier %s queue is full, %d events dropped\n", s.options.Name, dropped)
+	}
+}
+
+func (s *eventSubscriber) run() {
+	for event := range s.queue {
+		s.notifier.Notify(event)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+type testNotifier struct {
+	events  chan *Event
+	release chan struct{}
+}
+
+func newTestNotifier() *testNotifier {
+	return &testNotifier{
+		events:  make(chan *Event, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (n *testNotifier) Notify(event *Event) {
+	<-n.release
+	n.events <- event
+}
+
+func TestEventBusFilter(t *testing.T) {
+	bus := NewEventBus()
+	n := newTestNotifier()
+	close(n.release)
+	bus.Subscribe(n, &NotifierOptions{Types: []string{EventMailCreated}})
+
+	bus.Publish(&Event{Type: EventFolderStats})
+	bus.Publish(&Event{Type: EventMailCreated, Email: "user@example.com"})
+
+	select {
+	case event := <-n.events:
+		if event.Type != EventMailCreated || event.Time == 0 {
+			t.Errorf("Unexpected event %v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Event is not delivered")
+	}
+
+	select {
+	case event := <-n.events:
+		t.Errorf("Filtered event is delivered %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEventBusOverflow(t *testing.T) {
+	bus := NewEventBus()
+	dropping := newTestNotifier()
+	blocking := newTestNotifier()
+	bus.Subscribe(dropping, &NotifierOptions{Name: "drop", QueueSize: 1})
+	bus.Subscribe(blocking, &NotifierOptions{Name: "block", QueueSize: 1, Overflow: OverflowBlock, BlockTimeout: 10 * time.Second})
+
+	//First event is taken by notifier goroutines, second one fills queues
+	bus.Publish(&Event{Type: EventMailCreated})
+	time.Sleep(50 * time.Millisecond)
+	bus.Publish(&Event{Type: EventMailCreated})
+
+	published := make(chan struct{})
+	go func() {
+		bus.Publish(&Event{Type: EventMailCreated})
+		close(published)
+	}()
+
+	select {
+	case <-published:
+		t.Fatalf("Publisher is not blocked by full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(dropping.release)
+	close(blocking.release)
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatalf("Publisher is not released")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if len(dropping.events) != 2 {
+		t.Errorf("Dropping notifier received %d events, expected 2", len(dropping.events))
+	}
+	if len(blocking.events) != 3 {
+		t.Errorf("Blocking notifier received %d events, expected 3", len(blocking.events))
+	}
+}
@@ -31,3 +31,7 @@ const (
 	Spam  = "Spam"
 	Sent  = "Sent"
 )
+
+func IsStandardFolder(folder string) bool {
+	return folder == Inbox || folder == Trash || folder == Spam || folder == Sent
+}
@@ -22,10 +22,58 @@
  * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
  * DEALINGS IN THE SOFTWARE.
  */
-
 package common
 
+// Event types published by storage and authenticator
+const (
+	EventMailCreated     = "mailCreated"
+	EventMailUpdated     = "mailUpdated"
+	EventMailMoved       = "mailMoved"
+	EventMailDeleted     = "mailDeleted"
+	EventFolderCreated   = "folderCreated"
+	EventFolderStats     = "folderStats"
+	EventSettingsChanged = "settingsChanged"
+	EventSessionRevoked  = "sessionRevoked"
+)
+
+// Settings that are reported by EventSettingsChanged
+const (
+	SettingProfile    = "profile"
+	SettingVacation   = "vacation"
+	SettingForwarding = "forwarding"
+	SettingAliases    = "aliases"
+	SettingMailbox    = "mailbox"
+)
+
+// Event describes change of the user data. Single event instance is shared
+// by all notifiers, so it must not be modified after publishing.
+type Event struct {
+	// Id is unique id of the event, it's set only if events are shared
+	// between instances
+	Id    string `bson:"-"`
+	Type  string
+	User  string
+	Email string
+	Time  int64
+	// Mail is current state of the mail for mail events, or state before
+	// removal for EventMailDeleted
+	Mail *MailMetadata
+	// Previous is state of the mail before EventMailUpdated or EventMailMoved
+	Previous *MailMetadata
+	// Folder is name of the folder for EventFolderCreated
+	Folder string
+	// Stats contains updated folder statistics for EventFolderStats
+	Stats []FolderStat
+	// Setting is one of Setting constants for EventSettingsChanged
+	Setting string
+	// SessionId is id of the session for EventSessionRevoked, empty if
+	// several sessions of the user are revoked or id is unknown
+	SessionId string
+}
+
+// Notifier receives events from EventBus. Notify is called from dedicated
+// goroutine of the notifier, so it may block without affecting storage or
+// other notifiers.
 type Notifier interface {
-	NotifyMaiboxUpdate(email string, stats []FolderStat)
-	NotifyNewMail(email string, m MailMetadata)
+	Notify(event *Event)
 }
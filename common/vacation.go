@@ -0,0 +1,42 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package common
+
+type Vacation struct {
+	Email        string `bson:"email" json:"email"`
+	Enabled      bool   `bson:"enabled" json:"enabled"`
+	Start        int64  `bson:"start" json:"start"`
+	End          int64  `bson:"end" json:"end"`
+	Subject      string `bson:"subject" json:"subject"`
+	Body         string `bson:"body" json:"body"`
+	Interval     int64  `bson:"interval" json:"interval"` //Days between two replies to the same sender
+	ExcludeLists bool   `bson:"excludeLists" json:"excludeLists"`
+	ExcludeAuto  bool   `bson:"excludeAuto" json:"excludeAuto"`
+}
+
+func (v *Vacation) IsActive(now int64) bool {
+	return v.Enabled && (v.Start <= 0 || v.Start <= now) && (v.End <= 0 || now < v.End)
+}
@@ -0,0 +1,85 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package common
+
+const (
+	WebhookEventNewMail     = "newMail"
+	WebhookEventRead        = "read"
+	WebhookEventTrashed     = "trashed"
+	WebhookEventDeleted     = "deleted"
+	WebhookEventFolderStats = "folderStats"
+)
+
+var WebhookEvents = []string{
+	WebhookEventNewMail,
+	WebhookEventRead,
+	WebhookEventTrashed,
+	WebhookEventDeleted,
+	WebhookEventFolderStats,
+}
+
+// Webhook describes HTTP endpoint that receives events of the mailbox. Secret
+// is used to sign payloads and is shown once when webhook is created.
+type Webhook struct {
+	Id           string   `json:"id"`
+	Owner        string   `json:"owner"`
+	Email        string   `json:"email"`
+	Url          string   `json:"url"`
+	Secret       string   `json:"-"`
+	Events       []string `json:"events"`
+	AllowPrivate bool     `json:"allowPrivate"`
+	Created      int64    `json:"created"`
+}
+
+// HasEvent checks if webhook is subscribed to event
+func (w *Webhook) HasEvent(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidWebhookEvent checks if event is one of supported webhook events
+func IsValidWebhookEvent(event string) bool {
+	for _, e := range WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is delivery attempt record of the webhook event
+type WebhookDelivery struct {
+	Id         string `json:"id"`
+	WebhookId  string `json:"webhookId"`
+	Event      string `json:"event"`
+	Time       int64  `json:"time"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"statusCode"`
+	Error      string `json:"error"`
+}
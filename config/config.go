@@ -27,6 +27,9 @@ package config
 
 import (
 	"log"
+	"net"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -40,14 +43,28 @@ const configPath = "data/main.ini"
 const (
 	KeyWebPort              = "web_port"
 	KeySASLPort             = "sasl_port"
+	KeySASLRequireSecured   = "sasl_require_secured"
+	KeySASLSocket           = "sasl_socket"
+	KeySASLSocketOwner      = "sasl_socket_owner"
+	KeySASLSocketGroup      = "sasl_socket_group"
+	KeySASLSocketMode       = "sasl_socket_mode"
 	KeyPostfixConfig        = "postfix_config"
 	KeyMongoAddress         = "mongo_address"
 	KeyMongoUser            = "mongo_user"
 	KeyMongoPassword        = "mongo_password"
+	KeyInstanceId           = "instance_id"
 	KeyAttachmentsPath      = "attachments_path"
 	KeyAttachmentsUser      = "attachments_user"
 	KeyAttachmentsPassword  = "attachments_password"
 	KeyRegistrationEnabled  = "registration_enabled"
+	KeyPolicyPort           = "policy_port"
+	KeyQuotaSoftLimit       = "quota_soft_limit"
+	KeyQuotaHardAction      = "quota_hard_action"
+)
+
+const (
+	QuotaHardActionDefer  = "defer"
+	QuotaHardActionReject = "reject"
 )
 
 const (
@@ -57,8 +74,33 @@ const (
 )
 
 const (
-	WebSection              = "web"
-	WebKeySessionExpireTime = "session_expire_time"
+	WebSection               = "web"
+	WebKeySessionExpireTime  = "session_expire_time"
+	WebKeySessionKeys        = "session_keys"
+	WebKeySessionKeyRotation = "session_key_rotation"
+	WebKeySecureCookie       = "secure_cookie"
+	WebKeySessionMaxAge      = "session_max_age"
+	WebKeyTokenKey           = "token_key"
+	WebKeyHostnames          = "hostnames"
+	WebKeyVapidKey           = "vapid_key"
+	WebKeyVapidSubject       = "vapid_subject"
+)
+
+const (
+	PolicySection           = "policy"
+	PolicyKeyRateLimit      = "rate_limit"
+	PolicyKeyGreylistDelay  = "greylist_delay"
+	PolicyKeyGreylistExpire = "greylist_expire"
+)
+
+const (
+	ThrottleSection             = "throttle"
+	ThrottleKeyFreeAttempts     = "free_attempts"
+	ThrottleKeyBaseDelay        = "base_delay"
+	ThrottleKeyMaxDelay         = "max_delay"
+	ThrottleKeyLockoutThreshold = "lockout_threshold"
+	ThrottleKeyLockoutDuration  = "lockout_duration"
+	ThrottleKeyAllowlist        = "allowlist"
 )
 
 const (
@@ -66,6 +108,8 @@ const (
 	PostfixKeyVirtualMailboxMaps    = "virtual_mailbox_maps"
 	PostfixKeyVirtualMailboxBase    = "virtual_mailbox_base"
 	PostfixKeyVirtualMailboxDomains = "virtual_mailbox_domains"
+	PostfixKeyVirtualAliasMaps      = "virtual_alias_maps"
+	PostfixKeyRecipientDelimiter    = "recipient_delimiter"
 )
 
 type GostfixConfig gostfixConfig
@@ -85,20 +129,122 @@ func ConfigInstance() *GostfixConfig {
 }
 
 type gostfixConfig struct {
-	WebPort              string
-	SASLPort             string
-	MyDomain             string
-	VMailboxMaps         string
-	VMailboxBase         string
-	VMailboxDomains      []string
-	MongoUser            string
-	MongoPassword        string
-	MongoAddress         string
-	AttachmentsPath      string
-	RegistrationEnabled  bool
-	WebSessionExpireTime time.Duration
-	SetupEnabled         bool
-	SetupPassword        string
+	WebPort               string
+	SASLPort              string
+	SASLRequireSecured    bool
+	SASLSocket            string
+	SASLSocketOwner       string
+	SASLSocketGroup       string
+	SASLSocketMode        os.FileMode
+	PolicyPort            string
+	MyDomain              string
+	VMailboxMaps          string
+	VMailboxBase          string
+	VMailboxDomains       []string
+	VAliasMaps            string
+	RecipientDelimiter    string
+	MongoUser             string
+	MongoPassword         string
+	MongoAddress          string
+	InstanceId            string
+	AttachmentsPath       string
+	RegistrationEnabled   bool
+	WebSessionExpireTime  time.Duration
+	WebSessionKeys        string
+	WebSessionKeyRotation time.Duration
+	WebSecureCookie       bool
+	WebSessionMaxAge      time.Duration
+	WebTokenKey           string
+	WebHostnames          []string
+	WebVapidKey           string
+	WebVapidSubject       string
+	QuotaSoftLimit        int64
+	QuotaHardAction       string
+	PolicyRateLimit       int64
+	PolicyGreylistDelay   time.Duration
+	PolicyGreylistExpire  time.Duration
+	Throttle              *ThrottleConfig
+	SetupEnabled          bool
+	SetupPassword         string
+}
+
+// ThrottleConfig describes protection against brute-force login attempts
+type ThrottleConfig struct {
+	FreeAttempts     int64
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int64
+	LockoutDuration  time.Duration
+	Allowlist        []*net.IPNet
+}
+
+// IsAllowed checks if address is not a subject for login throttling
+func (c *ThrottleConfig) IsAllowed(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range c.Allowlist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func newThrottleConfig(section *ini.Section) *ThrottleConfig {
+	throttle := &ThrottleConfig{}
+	var err error
+
+	throttle.FreeAttempts, err = section.Key(ThrottleKeyFreeAttempts).Int64()
+	if err != nil || throttle.FreeAttempts < 0 {
+		throttle.FreeAttempts = 3
+	}
+
+	throttle.BaseDelay, err = time.ParseDuration(section.Key(ThrottleKeyBaseDelay).String())
+	if err != nil || throttle.BaseDelay <= 0 {
+		throttle.BaseDelay = time.Second
+	}
+
+	throttle.MaxDelay, err = time.ParseDuration(section.Key(ThrottleKeyMaxDelay).String())
+	if err != nil || throttle.MaxDelay < throttle.BaseDelay {
+		throttle.MaxDelay = 10 * time.Minute
+	}
+
+	throttle.LockoutThreshold, err = section.Key(ThrottleKeyLockoutThreshold).Int64()
+	if err != nil || throttle.LockoutThreshold <= 0 {
+		throttle.LockoutThreshold = 10
+	}
+
+	throttle.LockoutDuration, err = time.ParseDuration(section.Key(ThrottleKeyLockoutDuration).String())
+	if err != nil || throttle.LockoutDuration <= 0 {
+		throttle.LockoutDuration = time.Hour
+	}
+
+	for _, network := range strings.Split(section.Key(ThrottleKeyAllowlist).String(), ",") {
+		network = strings.Trim(network, " \t")
+		if network == "" {
+			continue
+		}
+
+		if !strings.Contains(network, "/") {
+			if strings.Contains(network, ":") {
+				network += "/128"
+			} else {
+				network += "/32"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			log.Printf("Invalid network %s in throttle allowlist\n", network)
+			continue
+		}
+		throttle.Allowlist = append(throttle.Allowlist, ipNet)
+	}
+
+	return throttle
 }
 
 func newConfig() (config *gostfixConfig, err error) {
@@ -156,6 +302,22 @@ func newConfig() (config *gostfixConfig, err error) {
 		return
 	}
 
+	aliasMaps := ""
+	aliasMapsList := strings.FieldsFunc(postfixCfg.Section("").Key(PostfixKeyVirtualAliasMaps).String(), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	for _, aliasMap := range aliasMapsList {
+		aliasMapParts := strings.Split(aliasMap, ":")
+		if len(aliasMapParts) == 2 && aliasMapParts[0] == "hash" {
+			aliasMaps = aliasMapParts[1] + ".db"
+			break
+		}
+	}
+
+	if aliasMaps == "" {
+		log.Printf("%s is not set proper way in %s. Should be hash:<path/to/virtual/alias/map>, mail forwarding is disabled\n", PostfixKeyVirtualAliasMaps, postfixConfigPath)
+	}
+
 	domains := postfixCfg.Section("").Key(PostfixKeyVirtualMailboxDomains).String()
 	domainsList := strings.Split(domains, " ")
 	var validDomains []string
@@ -172,6 +334,8 @@ func newConfig() (config *gostfixConfig, err error) {
 
 	myDomain := postfixCfg.Section("").Key(PostfixKeyMyDomain).String()
 
+	recipientDelimiter := postfixCfg.Section("").Key(PostfixKeyRecipientDelimiter).String()
+
 	if len(myDomain) <= 0 {
 		myDomain = "localhost"
 	}
@@ -186,6 +350,15 @@ func newConfig() (config *gostfixConfig, err error) {
 		mongoAddress = "localhost:27017"
 	}
 
+	instanceId := cfg.Section("").Key(KeyInstanceId).String()
+	if instanceId == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "localhost"
+		}
+		instanceId = hostname + ":" + webPort
+	}
+
 	attachmentsPath := cfg.Section("").Key(KeyAttachmentsPath).String()
 
 	if attachmentsPath == "" {
@@ -200,27 +373,134 @@ func newConfig() (config *gostfixConfig, err error) {
 		saslPort = "65201"
 	}
 
+	saslRequireSecured, _ := cfg.Section("").Key(KeySASLRequireSecured).Bool()
+
+	saslSocket := cfg.Section("").Key(KeySASLSocket).String()
+	saslSocketOwner := cfg.Section("").Key(KeySASLSocketOwner).String()
+	saslSocketGroup := cfg.Section("").Key(KeySASLSocketGroup).String()
+	saslSocketMode, err := strconv.ParseUint(cfg.Section("").Key(KeySASLSocketMode).String(), 8, 32)
+	if err != nil {
+		saslSocketMode = 0660
+	}
+
+	policyPort := cfg.Section("").Key(KeyPolicyPort).String()
+	if policyPort == "" {
+		log.Printf("Policy server port is not specified in configuration file, use default 65202")
+		policyPort = "65202"
+	}
+
+	quotaSoftLimit, err := cfg.Section("").Key(KeyQuotaSoftLimit).Int64()
+	if err != nil || quotaSoftLimit <= 0 || quotaSoftLimit > 100 {
+		quotaSoftLimit = 90
+	}
+
+	quotaHardAction := cfg.Section("").Key(KeyQuotaHardAction).String()
+	if quotaHardAction != QuotaHardActionReject {
+		quotaHardAction = QuotaHardActionDefer
+	}
+
+	policyRateLimit, err := cfg.Section(PolicySection).Key(PolicyKeyRateLimit).Int64()
+	if err != nil || policyRateLimit < 0 {
+		policyRateLimit = 100
+	}
+
+	policyGreylistDelay, err := time.ParseDuration(cfg.Section(PolicySection).Key(PolicyKeyGreylistDelay).String())
+	if err != nil || policyGreylistDelay < 0 {
+		policyGreylistDelay = 5 * time.Minute
+	}
+
+	policyGreylistExpire, err := time.ParseDuration(cfg.Section(PolicySection).Key(PolicyKeyGreylistExpire).String())
+	if err != nil || policyGreylistExpire <= 0 {
+		policyGreylistExpire = 35 * 24 * time.Hour
+	}
+
 	webSessionExpireTime, err := time.ParseDuration(cfg.Section(WebSection).Key(WebKeySessionExpireTime).String())
 	if err != nil {
 		webSessionExpireTime = time.Hour * 24
 		log.Printf("Unable to read web session expire time. 24h by default.");
 	}
 
+	webSessionKeys := cfg.Section(WebSection).Key(WebKeySessionKeys).String()
+	if webSessionKeys == "" {
+		webSessionKeys = "data/session_keys"
+	}
+
+	webSessionKeyRotation, err := time.ParseDuration(cfg.Section(WebSection).Key(WebKeySessionKeyRotation).String())
+	if err != nil || webSessionKeyRotation < 0 {
+		webSessionKeyRotation = 30 * 24 * time.Hour
+	}
+
+	webSecureCookie, err := cfg.Section(WebSection).Key(WebKeySecureCookie).Bool()
+	if err != nil {
+		webSecureCookie = true
+	}
+
+	webSessionMaxAge, err := time.ParseDuration(cfg.Section(WebSection).Key(WebKeySessionMaxAge).String())
+	if err != nil || webSessionMaxAge < 0 {
+		webSessionMaxAge = 30 * 24 * time.Hour
+	}
+
+	webTokenKey := cfg.Section(WebSection).Key(WebKeyTokenKey).String()
+	if webTokenKey == "" {
+		webTokenKey = "data/token_key"
+	}
+
+	webHostnames := []string{}
+	for _, hostname := range strings.Split(cfg.Section(WebSection).Key(WebKeyHostnames).String(), ",") {
+		hostname = strings.Trim(hostname, " \t")
+		if hostname != "" {
+			webHostnames = append(webHostnames, strings.ToLower(hostname))
+		}
+	}
+
+	webVapidKey := cfg.Section(WebSection).Key(WebKeyVapidKey).String()
+	if webVapidKey == "" {
+		webVapidKey = "data/vapid_key"
+	}
+
+	webVapidSubject := cfg.Section(WebSection).Key(WebKeyVapidSubject).String()
+	if webVapidSubject == "" {
+		webVapidSubject = "mailto:postmaster@" + myDomain
+	}
+
 	config = &gostfixConfig{
-		WebPort:              webPort,
-		SASLPort:             saslPort,
-		MyDomain:             myDomain,
-		VMailboxBase:         baseDir,
-		VMailboxMaps:         mapsList[1] + ".db",
-		VMailboxDomains:      validDomains,
-		MongoUser:            mongoUser,
-		MongoPassword:        mongoPassword,
-		MongoAddress:         mongoAddress,
-		AttachmentsPath:      attachmentsPath,
-		RegistrationEnabled:  registrationEnabled == "true",
-		WebSessionExpireTime: webSessionExpireTime * 1000,
-		SetupEnabled:         initialSetup,
-		SetupPassword:        initialPassword,
+		WebPort:               webPort,
+		SASLPort:              saslPort,
+		SASLRequireSecured:    saslRequireSecured,
+		SASLSocket:            saslSocket,
+		SASLSocketOwner:       saslSocketOwner,
+		SASLSocketGroup:       saslSocketGroup,
+		SASLSocketMode:        os.FileMode(saslSocketMode),
+		PolicyPort:            policyPort,
+		MyDomain:              myDomain,
+		VMailboxBase:          baseDir,
+		VMailboxMaps:          mapsList[1] + ".db",
+		VMailboxDomains:       validDomains,
+		VAliasMaps:            aliasMaps,
+		RecipientDelimiter:    recipientDelimiter,
+		MongoUser:             mongoUser,
+		MongoPassword:         mongoPassword,
+		MongoAddress:          mongoAddress,
+		InstanceId:            instanceId,
+		AttachmentsPath:       attachmentsPath,
+		RegistrationEnabled:   registrationEnabled == "true",
+		WebSessionExpireTime:  webSessionExpireTime,
+		WebSessionKeys:        webSessionKeys,
+		WebSessionKeyRotation: webSessionKeyRotation,
+		WebSecureCookie:       webSecureCookie,
+		WebSessionMaxAge:      webSessionMaxAge,
+		WebTokenKey:           webTokenKey,
+		WebHostnames:          webHostnames,
+		WebVapidKey:           webVapidKey,
+		WebVapidSubject:       webVapidSubject,
+		QuotaSoftLimit:        quotaSoftLimit,
+		QuotaHardAction:       quotaHardAction,
+		PolicyRateLimit:       policyRateLimit,
+		PolicyGreylistDelay:   policyGreylistDelay,
+		PolicyGreylistExpire:  policyGreylistExpire,
+		Throttle:              newThrottleConfig(cfg.Section(ThrottleSection)),
+		SetupEnabled:          initialSetup,
+		SetupPassword:         initialPassword,
 	}
 	return
 }
@@ -0,0 +1,361 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package dav
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	db "git.semlanik.org/semlanik/gostfix/db"
+	ical "git.semlanik.org/semlanik/gostfix/ical"
+	mongo "go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	calendarName        = "calendar"
+	icalExtension       = ".ics"
+	icalContentType     = "text/calendar; charset=utf-8"
+	timeRangeFormat     = "20060102T150405Z"
+	calendarDisplayName = "Calendar"
+)
+
+var (
+	propCalendarHomeSet       = calDavName("calendar-home-set")
+	propCalendarUserAddresses = calDavName("calendar-user-address-set")
+	propCalendarDescription   = calDavName("calendar-description")
+	propSupportedComponents   = calDavName("supported-calendar-component-set")
+	propSupportedCalendarData = calDavName("supported-calendar-data")
+	propCalendarData          = calDavName("calendar-data")
+)
+
+func calDavName(local string) xml.Name {
+	return xml.Name{Space: nsCalDav, Local: local}
+}
+
+// handleCalendars serves requests to calendar home of the user, every user
+// has single calendar with events
+func (s *Server) handleCalendars(w http.ResponseWriter, r *http.Request, user string, parts []string) {
+	if len(parts) == 0 {
+		s.handleCollection(w, r, &calendarHomeResource{user}, func() ([]resource, error) {
+			calendar, err := s.calendar(user)
+			return []resource{calendar}, err
+		})
+		return
+	}
+
+	if parts[0] != calendarName || len(parts) > 2 {
+		http.Error(w, "Calendar not found", http.StatusNotFound)
+		return
+	}
+
+	calendar, err := s.calendar(user)
+	if err != nil {
+		log.Printf("Unable to read calendar of %s: %s\n", user, err)
+		http.Error(w, "Unable to read calendar", http.StatusInternalServerError)
+		return
+	}
+
+	if len(parts) == 2 {
+		s.handleMember(w, r, calendar, parts[1])
+		return
+	}
+
+	switch r.Method {
+	case "REPORT":
+		s.calendarReport(w, r, calendar)
+	case "PROPFIND":
+		s.propfind(w, r, calendar, calendar.members)
+	default:
+		s.handleCollection(w, r, calendar, nil)
+	}
+}
+
+func (s *Server) calendar(user string) (*calendarResource, error) {
+	revision, err := s.storage.GetRevision(user, db.SyncCalendar)
+	if err != nil {
+		return nil, err
+	}
+	return &calendarResource{s.storage, user, revision}, nil
+}
+
+// calendarReport serves calendar-multiget, calendar-query and
+// sync-collection reports
+func (s *Server) calendarReport(w http.ResponseWriter, r *http.Request, calendar *calendarResource) {
+	request, err := parseRequest(r)
+	if err != nil || request == nil {
+		http.Error(w, "Invalid REPORT request", http.StatusBadRequest)
+		return
+	}
+
+	switch request.name {
+	case calDavName("calendar-multiget"):
+		s.multiget(w, calendar, request)
+	case calDavName("calendar-query"):
+		filter := request.child(nsCalDav, "filter")
+		s.query(w, calendar, request, -1, func(member resource) bool {
+			return filter == nil || matchCalendarFilter(member.(*eventResource).event, filter)
+		})
+	case davName("sync-collection"):
+		s.syncCollection(w, calendar, request)
+	default:
+		writeError(w, http.StatusForbidden, davName("supported-report"))
+	}
+}
+
+// matchCalendarFilter checks if event matches comp-filter of VEVENT
+// component with optional time-range. Recurring events always match time
+// range, because recurrence rules are not expanded. Property filters are
+// not supported and always match.
+func matchCalendarFilter(event *common.CalendarEvent, filter *element) bool {
+	calendarFilter := filter.child(nsCalDav, "comp-filter")
+	if calendarFilter == nil || calendarFilter.attr("name", "") != "VCALENDAR" {
+		return calendarFilter == nil
+	}
+
+	componentFilters := calendarFilter.all(nsCalDav, "comp-filter")
+	if len(componentFilters) == 0 {
+		return true
+	}
+
+	for _, componentFilter := range componentFilters {
+		isNotDefined := componentFilter.child(nsCalDav, "is-not-defined") != nil
+		if componentFilter.attr("name", "") != "VEVENT" {
+			if !isNotDefined {
+				return false
+			}
+			continue
+		}
+
+		if isNotDefined {
+			return false
+		}
+
+		if timeRange := componentFilter.child(nsCalDav, "time-range"); timeRange != nil && !event.Recurring {
+			start, startErr := time.Parse(timeRangeFormat, timeRange.attr("start", ""))
+			end, endErr := time.Parse(timeRangeFormat, timeRange.attr("end", ""))
+			if startErr == nil && event.End <= start.Unix() && !(event.End == event.Start && event.Start >= start.Unix()) {
+				return false
+			}
+			if endErr == nil && event.Start >= end.Unix() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// calendarHomeResource is collection of user's calendars
+type calendarHomeResource struct {
+	user string
+}
+
+func (r *calendarHomeResource) href() string {
+	return calendarHomePath(r.user)
+}
+
+func (r *calendarHomeResource) properties() []xml.Name {
+	return []xml.Name{propResourceType, propCurrentUserPrincipal}
+}
+
+func (r *calendarHomeResource) property(name xml.Name) (string, bool) {
+	switch name {
+	case propResourceType:
+		return "<d:collection/>", true
+	}
+	return userProperty(r.user, name, false)
+}
+
+// calendarResource is calendar with all events of the user
+type calendarResource struct {
+	storage      *db.Storage
+	user         string
+	lastRevision int64
+}
+
+func (r *calendarResource) href() string {
+	return calendarHomePath(r.user) + calendarName + "/"
+}
+
+func (r *calendarResource) properties() []xml.Name {
+	return []xml.Name{propResourceType, propDisplayName, propCalendarDescription, propGetCTag, propSyncToken,
+		propSupportedReportSet, propSupportedComponents, propSupportedCalendarData, calDavName("max-resource-size"),
+		propCurrentUserPrincipal}
+}
+
+func (r *calendarResource) property(name xml.Name) (string, bool) {
+	switch name {
+	case propResourceType:
+		return "<d:collection/><cal:calendar/>", true
+	case propDisplayName:
+		return calendarDisplayName, true
+	case propCalendarDescription:
+		return "Calendar of " + escape(r.user), true
+	case propGetCTag, propSyncToken:
+		return escape(syncToken(r.lastRevision)), true
+	case propSupportedReportSet:
+		return supportedReports(calDavName("calendar-multiget"), calDavName("calendar-query"), davName("sync-collection")), true
+	case propSupportedComponents:
+		return "<cal:comp name=\"VEVENT\"/>", true
+	case propSupportedCalendarData:
+		return "<cal:calendar-data content-type=\"text/calendar\" version=\"2.0\"/>", true
+	case calDavName("max-resource-size"):
+		return strconv.Itoa(maxResourceSize), true
+	}
+	return userProperty(r.user, name, true)
+}
+
+func (r *calendarResource) namespace() string {
+	return nsCalDav
+}
+
+func (r *calendarResource) extension() string {
+	return icalExtension
+}
+
+func (r *calendarResource) revision() int64 {
+	return r.lastRevision
+}
+
+func (r *calendarResource) syncFloor() (int64, error) {
+	return r.storage.GetSyncFloor(r.user, db.SyncCalendar)
+}
+
+func (r *calendarResource) members() ([]resource, error) {
+	events, err := r.storage.GetEvents(r.user)
+	if err != nil {
+		return nil, err
+	}
+	return r.eventResources(events), nil
+}
+
+func (r *calendarResource) member(id string) (member, error) {
+	event, err := r.storage.GetEvent(r.user, id)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &eventResource{r, event}, nil
+}
+
+func (r *calendarResource) changes(revision int64) ([]resource, []string, error) {
+	events, err := r.storage.GetEventChanges(r.user, revision)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	removed := []string{}
+	if revision > 0 {
+		removed, err = r.storage.GetTombstones(r.user, db.SyncCalendar, revision)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return r.eventResources(events), removed, nil
+}
+
+// put saves calendar object resource with single event, iTIP method is
+// removed from the object
+func (r *calendarResource) put(id, content string) (bool, error) {
+	calendar, err := ical.Parse(strings.NewReader(content))
+	if err != nil {
+		return false, &preconditionError{calDavName("valid-calendar-data")}
+	}
+	calendar.Remove("METHOD")
+
+	event, err := ical.EventFromCalendar(calendar)
+	if err != nil {
+		return false, &preconditionError{calDavName("valid-calendar-object-resource")}
+	}
+
+	event.Id = id
+	created, err := r.storage.PutEvent(r.user, event)
+	if err == db.ErrUidConflict {
+		return false, &preconditionError{calDavName("no-uid-conflict")}
+	}
+	return created, err
+}
+
+func (r *calendarResource) remove(id string) error {
+	return r.storage.RemoveEvent(r.user, id)
+}
+
+func (r *calendarResource) eventResources(events []*common.CalendarEvent) []resource {
+	resources := make([]resource, len(events))
+	for i, event := range events {
+		resources[i] = &eventResource{r, event}
+	}
+	return resources
+}
+
+// eventResource is calendar object resource of the event
+type eventResource struct {
+	calendar *calendarResource
+	event    *common.CalendarEvent
+}
+
+func (r *eventResource) href() string {
+	return memberPath(r.calendar, r.event.Id)
+}
+
+func (r *eventResource) properties() []xml.Name {
+	return []xml.Name{propResourceType, propGetETag, propGetContentType, propGetContentLength, propGetLastModified}
+}
+
+func (r *eventResource) property(name xml.Name) (string, bool) {
+	switch name {
+	case propCalendarData:
+		return escape(r.event.Calendar), true
+	}
+	return memberProperty(r, r.calendar.user, name)
+}
+
+func (r *eventResource) etag() string {
+	return contentETag(r.event.Calendar)
+}
+
+func (r *eventResource) contentType() string {
+	return icalContentType
+}
+
+func (r *eventResource) content() string {
+	return r.event.Calendar
+}
+
+func (r *eventResource) modified() int64 {
+	return r.event.Updated
+}
+
+func calendarHomePath(user string) string {
+	return rootPath + "calendars/" + url.PathEscape(user) + "/"
+}
@@ -0,0 +1,405 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package dav
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	db "git.semlanik.org/semlanik/gostfix/db"
+	vcard "git.semlanik.org/semlanik/gostfix/vcard"
+	mongo "go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	addressBookName  = "contacts"
+	vcardExtension   = ".vcf"
+	vcardContentType = "text/vcard; charset=utf-8"
+)
+
+var (
+	propAddressBookHomeSet     = cardDavName("addressbook-home-set")
+	propAddressBookDescription = cardDavName("addressbook-description")
+	propSupportedAddressData   = cardDavName("supported-address-data")
+	propAddressData            = cardDavName("address-data")
+)
+
+func cardDavName(local string) xml.Name {
+	return xml.Name{Space: nsCardDav, Local: local}
+}
+
+// handleAddressBooks serves requests to address book home of the user,
+// every user has single address book with contacts
+func (s *Server) handleAddressBooks(w http.ResponseWriter, r *http.Request, user string, parts []string) {
+	if len(parts) == 0 {
+		s.handleCollection(w, r, &addressBookHomeResource{user}, func() ([]resource, error) {
+			book, err := s.addressBook(user)
+			return []resource{book}, err
+		})
+		return
+	}
+
+	if parts[0] != addressBookName || len(parts) > 2 {
+		http.Error(w, "Address book not found", http.StatusNotFound)
+		return
+	}
+
+	book, err := s.addressBook(user)
+	if err != nil {
+		log.Printf("Unable to read address book of %s: %s\n", user, err)
+		http.Error(w, "Unable to read address book", http.StatusInternalServerError)
+		return
+	}
+
+	if len(parts) == 2 {
+		s.handleMember(w, r, book, parts[1])
+		return
+	}
+
+	switch r.Method {
+	case "REPORT":
+		s.addressBookReport(w, r, book)
+	case "PROPFIND":
+		s.propfind(w, r, book, book.members)
+	default:
+		s.handleCollection(w, r, book, nil)
+	}
+}
+
+func (s *Server) addressBook(user string) (*addressBookResource, error) {
+	revision, err := s.storage.GetRevision(user, db.SyncContacts)
+	if err != nil {
+		return nil, err
+	}
+	return &addressBookResource{s.storage, user, revision}, nil
+}
+
+// addressBookReport serves addressbook-multiget, addressbook-query and
+// sync-collection reports
+func (s *Server) addressBookReport(w http.ResponseWriter, r *http.Request, book *addressBookResource) {
+	request, err := parseRequest(r)
+	if err != nil || request == nil {
+		http.Error(w, "Invalid REPORT request", http.StatusBadRequest)
+		return
+	}
+
+	switch request.name {
+	case cardDavName("addressbook-multiget"):
+		s.multiget(w, book, request)
+	case cardDavName("addressbook-query"):
+		filter := request.child(nsCardDav, "filter")
+		s.query(w, book, request, queryLimit(request, nsCardDav), func(member resource) bool {
+			return filter == nil || matchFilter(member.(*contactResource).card, filter)
+		})
+	case davName("sync-collection"):
+		s.syncCollection(w, book, request)
+	default:
+		writeError(w, http.StatusForbidden, davName("supported-report"))
+	}
+}
+
+// matchFilter checks if vCard matches prop-filter elements of the query
+// filter, param-filter elements are not supported and always match
+func matchFilter(card *vcard.Card, filter *element) bool {
+	propFilters := filter.all(nsCardDav, "prop-filter")
+	if len(propFilters) == 0 {
+		return true
+	}
+
+	allOf := filter.attr("test", "anyof") == "allof"
+	for _, propFilter := range propFilters {
+		if matchPropFilter(card, propFilter) != allOf {
+			return !allOf
+		}
+	}
+	return allOf
+}
+
+func matchPropFilter(card *vcard.Card, propFilter *element) bool {
+	properties := card.GetAll(strings.ToUpper(propFilter.attr("name", "")))
+	if propFilter.child(nsCardDav, "is-not-defined") != nil {
+		return len(properties) == 0
+	}
+
+	if len(properties) == 0 {
+		return false
+	}
+
+	textMatches := propFilter.all(nsCardDav, "text-match")
+	if len(textMatches) == 0 {
+		return true
+	}
+
+	allOf := propFilter.attr("test", "anyof") == "allof"
+	for _, textMatch := range textMatches {
+		matches := false
+		for _, property := range properties {
+			if matchText(property.Text(), textMatch) {
+				matches = true
+				break
+			}
+		}
+
+		if matches != allOf {
+			return !allOf
+		}
+	}
+	return allOf
+}
+
+// matchText compares values case-insensitively regardless of collation
+func matchText(value string, textMatch *element) bool {
+	value = strings.ToLower(value)
+	text := strings.ToLower(textMatch.text)
+
+	matches := false
+	switch textMatch.attr("match-type", "contains") {
+	case "equals":
+		matches = value == text
+	case "starts-with":
+		matches = strings.HasPrefix(value, text)
+	case "ends-with":
+		matches = strings.HasSuffix(value, text)
+	default:
+		matches = strings.Contains(value, text)
+	}
+	return matches != (textMatch.attr("negate-condition", "no") == "yes")
+}
+
+// addressBookHomeResource is collection of user's address books
+type addressBookHomeResource struct {
+	user string
+}
+
+func (r *addressBookHomeResource) href() string {
+	return addressBookHomePath(r.user)
+}
+
+func (r *addressBookHomeResource) properties() []xml.Name {
+	return []xml.Name{propResourceType, propCurrentUserPrincipal}
+}
+
+func (r *addressBookHomeResource) property(name xml.Name) (string, bool) {
+	switch name {
+	case propResourceType:
+		return "<d:collection/>", true
+	}
+	return userProperty(r.user, name, false)
+}
+
+// addressBookResource is address book with all contacts of the user
+type addressBookResource struct {
+	storage      *db.Storage
+	user         string
+	lastRevision int64
+}
+
+func (r *addressBookResource) href() string {
+	return addressBookHomePath(r.user) + addressBookName + "/"
+}
+
+func (r *addressBookResource) properties() []xml.Name {
+	return []xml.Name{propResourceType, propDisplayName, propAddressBookDescription, propGetCTag, propSyncToken,
+		propSupportedReportSet, propSupportedAddressData, cardDavName("max-resource-size"), propCurrentUserPrincipal}
+}
+
+func (r *addressBookResource) property(name xml.Name) (string, bool) {
+	switch name {
+	case propResourceType:
+		return "<d:collection/><card:addressbook/>", true
+	case propDisplayName:
+		return "Contacts", true
+	case propAddressBookDescription:
+		return "Contacts of " + escape(r.user), true
+	case propGetCTag, propSyncToken:
+		return escape(syncToken(r.lastRevision)), true
+	case propSupportedReportSet:
+		return supportedReports(cardDavName("addressbook-multiget"), cardDavName("addressbook-query"), davName("sync-collection")), true
+	case propSupportedAddressData:
+		return "<card:address-data-type content-type=\"text/vcard\" version=\"3.0\"/>" +
+			"<card:address-data-type content-type=\"text/vcard\" version=\"4.0\"/>", true
+	case cardDavName("max-resource-size"):
+		return strconv.Itoa(maxResourceSize), true
+	}
+	return userProperty(r.user, name, true)
+}
+
+func (r *addressBookResource) namespace() string {
+	return nsCardDav
+}
+
+func (r *addressBookResource) extension() string {
+	return vcardExtension
+}
+
+func (r *addressBookResource) revision() int64 {
+	return r.lastRevision
+}
+
+func (r *addressBookResource) syncFloor() (int64, error) {
+	return r.storage.GetSyncFloor(r.user, db.SyncContacts)
+}
+
+func (r *addressBookResource) members() ([]resource, error) {
+	contacts, err := r.storage.GetContacts(r.user)
+	if err != nil {
+		return nil, err
+	}
+	return r.contactResources(contacts), nil
+}
+
+func (r *addressBookResource) member(id string) (member, error) {
+	contact, err := r.storage.GetContact(r.user, id)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return newContactResource(r, contact), nil
+}
+
+func (r *addressBookResource) changes(revision int64) ([]resource, []string, error) {
+	contacts, err := r.storage.GetContactChanges(r.user, revision)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	removed := []string{}
+	if revision > 0 {
+		removed, err = r.storage.GetTombstones(r.user, db.SyncContacts, revision)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return r.contactResources(contacts), removed, nil
+}
+
+// put saves contact with vCard, original vCard is kept
+func (r *addressBookResource) put(id, content string) (bool, error) {
+	cards, err := vcard.Parse(strings.NewReader(content))
+	if err != nil || len(cards) != 1 {
+		return false, &preconditionError{cardDavName("valid-address-data")}
+	}
+
+	contact := vcard.ContactFromCard(cards[0])
+	contact.Id = id
+	contact.VCard = cards[0].String()
+	return r.storage.PutContact(r.user, contact)
+}
+
+func (r *addressBookResource) remove(id string) error {
+	return r.storage.RemoveContact(r.user, id)
+}
+
+func (r *addressBookResource) contactResources(contacts []*common.Contact) []resource {
+	resources := make([]resource, len(contacts))
+	for i, contact := range contacts {
+		resources[i] = newContactResource(r, contact)
+	}
+	return resources
+}
+
+// contactResource is vCard of the contact
+type contactResource struct {
+	book    *addressBookResource
+	contact *common.Contact
+	card    *vcard.Card
+	data    string
+	tag     string
+}
+
+func newContactResource(book *addressBookResource, contact *common.Contact) *contactResource {
+	card := vcard.CardForContact(contact)
+	data := card.String()
+	return &contactResource{
+		book:    book,
+		contact: contact,
+		card:    card,
+		data:    data,
+		tag:     contentETag(data),
+	}
+}
+
+func (r *contactResource) href() string {
+	return memberPath(r.book, r.contact.Id)
+}
+
+func (r *contactResource) properties() []xml.Name {
+	return []xml.Name{propResourceType, propGetETag, propGetContentType, propGetContentLength, propGetLastModified}
+}
+
+func (r *contactResource) property(name xml.Name) (string, bool) {
+	switch name {
+	case propAddressData:
+		return escape(r.data), true
+	}
+	return memberProperty(r, r.book.user, name)
+}
+
+func (r *contactResource) etag() string {
+	return r.tag
+}
+
+func (r *contactResource) contentType() string {
+	return vcardContentType
+}
+
+func (r *contactResource) content() string {
+	return r.data
+}
+
+func (r *contactResource) modified() int64 {
+	return r.contact.Updated
+}
+
+// memberProperty returns properties that are common for all members of
+// collections
+func memberProperty(m member, user string, name xml.Name) (string, bool) {
+	switch name {
+	case propResourceType:
+		return "", true
+	case propGetETag:
+		return escape(m.etag()), true
+	case propGetContentType:
+		return m.contentType(), true
+	case propGetContentLength:
+		return strconv.Itoa(len(m.content())), true
+	case propGetLastModified:
+		return time.Unix(m.modified(), 0).UTC().Format(http.TimeFormat), true
+	}
+	return userProperty(user, name, true)
+}
+
+func addressBookHomePath(user string) string {
+	return rootPath + "addressbooks/" + url.PathEscape(user) + "/"
+}
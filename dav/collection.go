@@ -0,0 +1,302 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package dav
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// collection is synchronized collection of the user like address book or
+// calendar. Members are stored by id, their names have collection specific
+// extension. Changes are known since syncFloor revision only, older sync
+// tokens are rejected.
+type collection interface {
+	resource
+	namespace() string
+	extension() string
+	revision() int64
+	syncFloor() (int64, error)
+	members() ([]resource, error)
+	member(id string) (member, error)
+	changes(revision int64) ([]resource, []string, error)
+	put(id, content string) (bool, error)
+	remove(id string) error
+}
+
+// member is resource of the collection with content, member is nil if it
+// doesn't exist
+type member interface {
+	resource
+	etag() string
+	contentType() string
+	content() string
+	modified() int64
+}
+
+// preconditionError is returned by collection if member content violates
+// precondition of the protocol
+type preconditionError struct {
+	name xml.Name
+}
+
+func (e *preconditionError) Error() string {
+	return "Precondition failed: " + e.name.Local
+}
+
+func memberPath(c collection, id string) string {
+	return c.href() + url.PathEscape(id) + c.extension()
+}
+
+// contentETag returns strong ETag of member content
+func contentETag(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "\"" + hex.EncodeToString(sum[:16]) + "\""
+}
+
+// handleMember serves requests to member of the collection
+func (s *Server) handleMember(w http.ResponseWriter, r *http.Request, c collection, name string) {
+	id := strings.TrimSuffix(name, c.extension())
+	current, err := c.member(id)
+	if err != nil {
+		log.Printf("Unable to read %s: %s\n", memberPath(c, id), err)
+		http.Error(w, "Unable to read resource", http.StatusInternalServerError)
+		return
+	}
+
+	if current == nil && r.Method != "PUT" {
+		http.Error(w, "Resource not found", http.StatusNotFound)
+		return
+	}
+
+	etag := ""
+	if current != nil {
+		etag = current.etag()
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		w.Header().Set("Content-Type", current.contentType())
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Length", strconv.Itoa(len(current.content())))
+		if current.modified() > 0 {
+			w.Header().Set("Last-Modified", time.Unix(current.modified(), 0).UTC().Format(http.TimeFormat))
+		}
+		if r.Method == "GET" {
+			io.WriteString(w, current.content())
+		}
+	case "PUT":
+		s.putMember(w, r, c, id, etag)
+	case "DELETE":
+		if !checkPreconditions(r, etag) {
+			http.Error(w, "Resource is changed", http.StatusPreconditionFailed)
+			return
+		}
+
+		if err := c.remove(id); err != nil {
+			log.Printf("Unable to remove %s: %s\n", memberPath(c, id), err)
+			http.Error(w, "Unable to remove resource", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "PROPFIND":
+		s.propfind(w, r, current, nil)
+	default:
+		s.handleCollection(w, r, current, nil)
+	}
+}
+
+// putMember creates or replaces member with content from the request. ETag
+// is not returned, because stored content may differ from request content.
+func (s *Server) putMember(w http.ResponseWriter, r *http.Request, c collection, id, etag string) {
+	if !checkPreconditions(r, etag) {
+		http.Error(w, "Resource is changed", http.StatusPreconditionFailed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxResourceSize+1))
+	if err != nil {
+		http.Error(w, "Unable to read resource", http.StatusBadRequest)
+		return
+	}
+
+	if len(body) > maxResourceSize {
+		writeError(w, http.StatusForbidden, xml.Name{Space: c.namespace(), Local: "max-resource-size"})
+		return
+	}
+
+	created, err := c.put(id, string(body))
+	if precondition, ok := err.(*preconditionError); ok {
+		writeError(w, http.StatusForbidden, precondition.name)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Unable to save %s: %s\n", memberPath(c, id), err)
+		http.Error(w, "Unable to save resource: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// multiget reports requested properties of collection members referenced by
+// href elements of the request
+func (s *Server) multiget(w http.ResponseWriter, c collection, request *element) {
+	responses := []*response{}
+	for _, href := range request.all(nsDav, "href") {
+		path := strings.TrimSpace(href.text)
+		if parsed, err := url.Parse(path); err == nil {
+			path = parsed.EscapedPath()
+		}
+
+		parts, err := splitPath(strings.TrimPrefix(path, c.href()))
+		if err != nil || len(parts) != 1 || !strings.HasPrefix(path, c.href()) {
+			responses = append(responses, &response{path: path, status: http.StatusNotFound})
+			continue
+		}
+
+		member, err := c.member(strings.TrimSuffix(parts[0], c.extension()))
+		if err != nil || member == nil {
+			responses = append(responses, &response{path: path, status: http.StatusNotFound})
+			continue
+		}
+		responses = append(responses, propResponse(member, request))
+	}
+	writeMultistatus(w, responses, "")
+}
+
+// query reports requested properties of collection members that match
+// filter, match is called for every member
+func (s *Server) query(w http.ResponseWriter, c collection, request *element, limit int, match func(member resource) bool) {
+	members, err := c.members()
+	if err != nil {
+		log.Printf("Unable to read %s: %s\n", c.href(), err)
+		http.Error(w, "Unable to read collection", http.StatusInternalServerError)
+		return
+	}
+
+	responses := []*response{}
+	for _, member := range members {
+		if limit >= 0 && len(responses) >= limit {
+			break
+		}
+
+		if match(member) {
+			responses = append(responses, propResponse(member, request))
+		}
+	}
+	writeMultistatus(w, responses, "")
+}
+
+// syncCollection reports members changed and removed since revision in sync
+// token, all members are reported if token is empty, RFC 6578
+func (s *Server) syncCollection(w http.ResponseWriter, c collection, request *element) {
+	revision := int64(0)
+	if token := request.child(nsDav, "sync-token"); token != nil && strings.TrimSpace(token.text) != "" {
+		var err error
+		revision, err = parseSyncToken(strings.TrimSpace(token.text))
+		if err != nil || revision > c.revision() {
+			writeError(w, http.StatusForbidden, davName("valid-sync-token"))
+			return
+		}
+
+		floor, err := c.syncFloor()
+		if err != nil {
+			log.Printf("Unable to read sync floor of %s: %s\n", c.href(), err)
+			http.Error(w, "Unable to read collection", http.StatusInternalServerError)
+			return
+		}
+
+		//Removals before the floor are forgotten, client should resync
+		if revision < floor {
+			writeError(w, http.StatusForbidden, davName("valid-sync-token"))
+			return
+		}
+	}
+
+	changed, removed, err := c.changes(revision)
+	if err != nil {
+		log.Printf("Unable to read changes of %s: %s\n", c.href(), err)
+		http.Error(w, "Unable to read collection", http.StatusInternalServerError)
+		return
+	}
+
+	responses := []*response{}
+	for _, member := range changed {
+		responses = append(responses, propResponse(member, request))
+	}
+	for _, id := range removed {
+		responses = append(responses, &response{path: memberPath(c, id), status: http.StatusNotFound})
+	}
+	writeMultistatus(w, responses, syncToken(c.revision()))
+}
+
+func syncToken(revision int64) string {
+	return syncTokenPrefix + strconv.FormatInt(revision, 10)
+}
+
+func parseSyncToken(token string) (int64, error) {
+	if !strings.HasPrefix(token, syncTokenPrefix) {
+		return 0, strconv.ErrSyntax
+	}
+	return strconv.ParseInt(strings.TrimPrefix(token, syncTokenPrefix), 10, 64)
+}
+
+// queryLimit returns value of limit element of the query or -1 if results
+// are not limited
+func queryLimit(request *element, namespace string) int {
+	limit := -1
+	if element := request.child(namespace, "limit"); element != nil {
+		if nresults := element.child(namespace, "nresults"); nresults != nil {
+			if value, err := strconv.Atoi(strings.TrimSpace(nresults.text)); err == nil {
+				limit = value
+			}
+		}
+	}
+	return limit
+}
+
+// supportedReports returns supported-report-set content
+func supportedReports(reports ...xml.Name) string {
+	value := ""
+	for _, report := range reports {
+		value += "<d:supported-report><d:report>" + xmlElement(report, "") + "</d:report></d:supported-report>"
+	}
+	return value
+}
@@ -0,0 +1,564 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package dav
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	db "git.semlanik.org/semlanik/gostfix/db"
+)
+
+const (
+	nsDav            = "DAV:"
+	nsCardDav        = "urn:ietf:params:xml:ns:carddav"
+	nsCalDav         = "urn:ietf:params:xml:ns:caldav"
+	nsCalendarServer = "http://calendarserver.org/ns/"
+)
+
+// namespacePrefixes are prefixes of known namespaces used in responses
+var namespacePrefixes = map[string]string{
+	nsDav:            "d",
+	nsCardDav:        "card",
+	nsCalDav:         "cal",
+	nsCalendarServer: "cs",
+}
+
+const (
+	rootPath        = "/dav/"
+	syncTokenPrefix = "https://git.semlanik.org/semlanik/gostfix/sync/"
+	maxRequestSize  = 1024 * 1024
+	maxResourceSize = 256 * 1024
+)
+
+var (
+	propResourceType          = davName("resourcetype")
+	propDisplayName           = davName("displayname")
+	propCurrentUserPrincipal  = davName("current-user-principal")
+	propPrincipalUrl          = davName("principal-URL")
+	propPrincipalCollection   = davName("principal-collection-set")
+	propCurrentUserPrivileges = davName("current-user-privilege-set")
+	propOwner                 = davName("owner")
+	propSupportedReportSet    = davName("supported-report-set")
+	propSyncToken             = davName("sync-token")
+	propGetETag               = davName("getetag")
+	propGetContentType        = davName("getcontenttype")
+	propGetContentLength      = davName("getcontentlength")
+	propGetLastModified       = davName("getlastmodified")
+	propGetCTag               = xml.Name{Space: nsCalendarServer, Local: "getctag"}
+)
+
+// Server serves WebDAV requests of authenticated users to their address
+// books and calendars
+type Server struct {
+	storage *db.Storage
+}
+
+func NewServer(storage *db.Storage) *Server {
+	return &Server{
+		storage: storage,
+	}
+}
+
+// resource is WebDAV resource that reports its properties. Property values
+// are XML content of the property element.
+type resource interface {
+	href() string
+	properties() []xml.Name
+	property(name xml.Name) (string, bool)
+}
+
+// Handle serves WebDAV request of the user, requests to resources of other
+// users are forbidden
+func (s *Server) Handle(w http.ResponseWriter, r *http.Request, user string) {
+	parts, err := splitPath(strings.TrimPrefix(r.URL.EscapedPath(), rootPath))
+	if err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("DAV", "1, 3, addressbook, calendar-access")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, REPORT")
+		return
+	}
+
+	if len(parts) == 0 {
+		s.handleCollection(w, r, &rootResource{user}, nil)
+		return
+	}
+
+	if len(parts) > 1 && parts[1] != user {
+		http.Error(w, "You are not allowed to access this resource", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case parts[0] == "principals" && len(parts) == 2:
+		s.handleCollection(w, r, &principalResource{user}, nil)
+	case parts[0] == "addressbooks" && len(parts) > 1:
+		s.handleAddressBooks(w, r, user, parts[2:])
+	case parts[0] == "calendars" && len(parts) > 1:
+		s.handleCalendars(w, r, user, parts[2:])
+	default:
+		http.Error(w, "Resource not found", http.StatusNotFound)
+	}
+}
+
+// handleCollection serves read-only requests to the collection
+func (s *Server) handleCollection(w http.ResponseWriter, r *http.Request, collection resource, children func() ([]resource, error)) {
+	switch r.Method {
+	case "PROPFIND":
+		s.propfind(w, r, collection, children)
+	case "PROPPATCH":
+		s.proppatch(w, r, collection)
+	default:
+		http.Error(w, "Method is not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// splitPath splits escaped path to unescaped segments, empty segments are
+// skipped
+func splitPath(path string) ([]string, error) {
+	parts := []string{}
+	for _, part := range strings.Split(path, "/") {
+		if part == "" {
+			continue
+		}
+
+		part, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// propfind reports properties of the resource and its children, children
+// are not reported if Depth header is 0
+func (s *Server) propfind(w http.ResponseWriter, r *http.Request, self resource, children func() ([]resource, error)) {
+	request, err := parseRequest(r)
+	if err != nil || (request != nil && request.name != davName("propfind")) {
+		http.Error(w, "Invalid PROPFIND request", http.StatusBadRequest)
+		return
+	}
+
+	resources := []resource{self}
+	if children != nil && r.Header.Get("Depth") != "0" {
+		childResources, err := children()
+		if err != nil {
+			log.Printf("Unable to read WebDAV collection %s: %s\n", self.href(), err)
+			http.Error(w, "Unable to read collection", http.StatusInternalServerError)
+			return
+		}
+		resources = append(resources, childResources...)
+	}
+
+	responses := make([]*response, len(resources))
+	for i, resource := range resources {
+		responses[i] = propResponse(resource, request)
+	}
+	writeMultistatus(w, responses, "")
+}
+
+// proppatch refuses changes of all properties, properties of resources
+// are derived from stored data
+func (s *Server) proppatch(w http.ResponseWriter, r *http.Request, self resource) {
+	request, err := parseRequest(r)
+	if err != nil || request == nil || request.name != davName("propertyupdate") {
+		http.Error(w, "Invalid PROPPATCH request", http.StatusBadRequest)
+		return
+	}
+
+	result := &response{
+		path:      self.href(),
+		forbidden: []xml.Name{},
+	}
+	for _, update := range request.children {
+		for _, prop := range update.all(nsDav, "prop") {
+			for _, property := range prop.children {
+				result.forbidden = append(result.forbidden, property.name)
+			}
+		}
+	}
+	writeMultistatus(w, []*response{result}, "")
+}
+
+// propResponse returns requested properties of the resource, all properties
+// are returned if request is empty
+func propResponse(resource resource, request *element) *response {
+	result := &response{
+		path: resource.href(),
+	}
+
+	var prop *element
+	if request != nil {
+		if request.child(nsDav, "propname") != nil {
+			for _, name := range resource.properties() {
+				result.found = append(result.found, property{name, ""})
+			}
+			return result
+		}
+		prop = request.child(nsDav, "prop")
+	}
+
+	names := resource.properties()
+	if prop != nil {
+		names = make([]xml.Name, len(prop.children))
+		for i, child := range prop.children {
+			names[i] = child.name
+		}
+	}
+
+	for _, name := range names {
+		if value, ok := resource.property(name); ok {
+			result.found = append(result.found, property{name, value})
+		} else {
+			result.missing = append(result.missing, name)
+		}
+	}
+	return result
+}
+
+// property is found property of the resource with its XML content
+type property struct {
+	name  xml.Name
+	value string
+}
+
+// response is single response of the multistatus, only status is reported
+// if it's set
+type response struct {
+	path      string
+	status    int
+	found     []property
+	missing   []xml.Name
+	forbidden []xml.Name
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []*response, syncToken string) {
+	var out strings.Builder
+	out.WriteString(xml.Header)
+	out.WriteString("<d:multistatus" + namespaceDeclarations() + ">")
+
+	for _, response := range responses {
+		out.WriteString("<d:response>" + hrefValue(response.path))
+		if response.status != 0 {
+			out.WriteString("<d:status>" + statusLine(response.status) + "</d:status>")
+		}
+
+		if len(response.found) > 0 {
+			out.WriteString("<d:propstat><d:prop>")
+			for _, property := range response.found {
+				out.WriteString(xmlElement(property.name, property.value))
+			}
+			out.WriteString("</d:prop><d:status>" + statusLine(http.StatusOK) + "</d:status></d:propstat>")
+		}
+
+		writeEmptyPropstat(&out, response.missing, http.StatusNotFound)
+		writeEmptyPropstat(&out, response.forbidden, http.StatusForbidden)
+		out.WriteString("</d:response>")
+	}
+
+	if syncToken != "" {
+		out.WriteString("<d:sync-token>" + escape(syncToken) + "</d:sync-token>")
+	}
+	out.WriteString("</d:multistatus>")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, out.String())
+}
+
+// writeEmptyPropstat writes propstat of properties without values
+func writeEmptyPropstat(out *strings.Builder, names []xml.Name, status int) {
+	if len(names) == 0 {
+		return
+	}
+
+	out.WriteString("<d:propstat><d:prop>")
+	for _, name := range names {
+		out.WriteString(xmlElement(name, ""))
+	}
+	out.WriteString("</d:prop><d:status>" + statusLine(status) + "</d:status></d:propstat>")
+}
+
+// writeError writes WebDAV error response with failed precondition
+func writeError(w http.ResponseWriter, status int, precondition xml.Name) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header+"<d:error"+namespaceDeclarations()+">"+xmlElement(precondition, "")+"</d:error>")
+}
+
+// namespaceDeclarations returns declarations of known namespace prefixes
+func namespaceDeclarations() string {
+	namespaces := make([]string, 0, len(namespacePrefixes))
+	for namespace := range namespacePrefixes {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	declarations := ""
+	for _, namespace := range namespaces {
+		declarations += " xmlns:" + namespacePrefixes[namespace] + "=\"" + escape(namespace) + "\""
+	}
+	return declarations
+}
+
+func statusLine(status int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", status, http.StatusText(status))
+}
+
+// xmlElement returns element with XML content, elements of unknown
+// namespaces declare their namespace
+func xmlElement(name xml.Name, value string) string {
+	tag := name.Local
+	declaration := ""
+	if prefix, ok := namespacePrefixes[name.Space]; ok {
+		tag = prefix + ":" + name.Local
+	} else if name.Space != "" {
+		tag = "x:" + name.Local
+		declaration = " xmlns:x=\"" + escape(name.Space) + "\""
+	}
+
+	if value == "" {
+		return "<" + tag + declaration + "/>"
+	}
+	return "<" + tag + declaration + ">" + value + "</" + tag + ">"
+}
+
+func hrefValue(path string) string {
+	return "<d:href>" + escape(path) + "</d:href>"
+}
+
+func escape(s string) string {
+	var out strings.Builder
+	xml.EscapeText(&out, []byte(s))
+	return out.String()
+}
+
+func davName(local string) xml.Name {
+	return xml.Name{Space: nsDav, Local: local}
+}
+
+// privilegesValue returns current-user-privilege-set content
+func privilegesValue(writable bool) string {
+	privileges := []string{"read", "read-current-user-privilege-set"}
+	if writable {
+		privileges = append(privileges, "write", "write-properties", "write-content", "bind", "unbind")
+	}
+
+	var out strings.Builder
+	for _, privilege := range privileges {
+		out.WriteString("<d:privilege><d:" + privilege + "/></d:privilege>")
+	}
+	return out.String()
+}
+
+// element is node of XML request body
+type element struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	text     string
+	children []*element
+}
+
+// parseRequest reads XML body of the request, nil is returned for empty
+// body
+func parseRequest(r *http.Request) (*element, error) {
+	decoder := xml.NewDecoder(io.LimitReader(r.Body, maxRequestSize))
+	var root *element
+	stack := []*element{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			current := &element{name: token.Name, attrs: token.Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, current)
+			} else if root == nil {
+				root = current
+			} else {
+				return nil, errors.New("Multiple root elements")
+			}
+			stack = append(stack, current)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(token)
+			}
+		}
+	}
+	return root, nil
+}
+
+// child returns first child element with name or nil
+func (e *element) child(space, local string) *element {
+	for _, child := range e.children {
+		if child.name.Space == space && child.name.Local == local {
+			return child
+		}
+	}
+	return nil
+}
+
+// all returns all child elements with name
+func (e *element) all(space, local string) []*element {
+	children := []*element{}
+	for _, child := range e.children {
+		if child.name.Space == space && child.name.Local == local {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// attr returns value of attribute or default value if attribute is not set
+func (e *element) attr(local, defaultValue string) string {
+	for _, attr := range e.attrs {
+		if attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+	return defaultValue
+}
+
+// checkPreconditions verifies If-Match and If-None-Match headers against
+// ETag of existing resource, etag is empty if resource doesn't exist
+func checkPreconditions(r *http.Request, etag string) bool {
+	if match := r.Header.Get("If-Match"); match != "" {
+		if etag == "" || (match != "*" && !containsETag(match, etag)) {
+			return false
+		}
+	}
+
+	if noneMatch := r.Header.Get("If-None-Match"); noneMatch != "" {
+		if etag != "" && (noneMatch == "*" || containsETag(noneMatch, etag)) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsETag(list, etag string) bool {
+	for _, value := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(value), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// rootResource is root of the WebDAV server, clients use it to discover
+// principal of the user
+type rootResource struct {
+	user string
+}
+
+func (r *rootResource) href() string {
+	return rootPath
+}
+
+func (r *rootResource) properties() []xml.Name {
+	return []xml.Name{propResourceType, propCurrentUserPrincipal}
+}
+
+func (r *rootResource) property(name xml.Name) (string, bool) {
+	switch name {
+	case propResourceType:
+		return "<d:collection/>", true
+	}
+	return userProperty(r.user, name, false)
+}
+
+// principalResource is principal of the user, it refers home collections
+// of the user
+type principalResource struct {
+	user string
+}
+
+func (r *principalResource) href() string {
+	return principalPath(r.user)
+}
+
+func (r *principalResource) properties() []xml.Name {
+	return []xml.Name{propResourceType, propDisplayName, propPrincipalUrl, propAddressBookHomeSet, propCalendarHomeSet,
+		propCalendarUserAddresses, propCurrentUserPrincipal}
+}
+
+func (r *principalResource) property(name xml.Name) (string, bool) {
+	switch name {
+	case propResourceType:
+		return "<d:collection/><d:principal/>", true
+	case propDisplayName:
+		return escape(r.user), true
+	case propPrincipalUrl:
+		return hrefValue(principalPath(r.user)), true
+	case propPrincipalCollection:
+		return hrefValue(rootPath + "principals/"), true
+	case propAddressBookHomeSet:
+		return hrefValue(addressBookHomePath(r.user)), true
+	case propCalendarHomeSet:
+		return hrefValue(calendarHomePath(r.user)), true
+	case propCalendarUserAddresses:
+		return hrefValue("mailto:" + r.user), true
+	}
+	return userProperty(r.user, name, false)
+}
+
+// userProperty returns properties that are common for all resources of the
+// user
+func userProperty(user string, name xml.Name, writable bool) (string, bool) {
+	switch name {
+	case propCurrentUserPrincipal:
+		return hrefValue(principalPath(user)), true
+	case propCurrentUserPrivileges:
+		return privilegesValue(writable), true
+	case propOwner:
+		return hrefValue(principalPath(user)), true
+	}
+	return "", false
+}
+
+func principalPath(user string) string {
+	return rootPath + "principals/" + url.PathEscape(user) + "/"
+}
@@ -0,0 +1,157 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package dav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	vcard "git.semlanik.org/semlanik/gostfix/vcard"
+)
+
+const testUser = "user@example.com"
+
+func TestPropfindPrincipal(t *testing.T) {
+	s := NewServer(nil)
+	request := httptest.NewRequest("PROPFIND", "/dav/", strings.NewReader(`<?xml version="1.0"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:current-user-principal/><d:unknown/></d:prop></d:propfind>`))
+	request.Header.Set("Depth", "0")
+	recorder := httptest.NewRecorder()
+	s.Handle(recorder, request, testUser)
+
+	body := recorder.Body.String()
+	if recorder.Code != http.StatusMultiStatus {
+		t.Fatalf("Unexpected status %d: %s", recorder.Code, body)
+	}
+	if !strings.Contains(body, "<d:current-user-principal><d:href>/dav/principals/user@example.com/</d:href></d:current-user-principal>") {
+		t.Errorf("Principal is not reported: %s", body)
+	}
+	if !strings.Contains(body, "<d:unknown/></d:prop><d:status>HTTP/1.1 404 Not Found</d:status>") {
+		t.Errorf("Unknown property is not reported as missing: %s", body)
+	}
+
+	request = httptest.NewRequest("PROPFIND", "/dav/principals/user@example.com/", strings.NewReader(`<?xml version="1.0"?>
+<d:propfind xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav"><d:prop><card:addressbook-home-set/></d:prop></d:propfind>`))
+	recorder = httptest.NewRecorder()
+	s.Handle(recorder, request, testUser)
+	if body := recorder.Body.String(); !strings.Contains(body, "<card:addressbook-home-set><d:href>/dav/addressbooks/user@example.com/</d:href></card:addressbook-home-set>") {
+		t.Errorf("Address book home is not reported: %s", body)
+	}
+
+	request = httptest.NewRequest("PROPFIND", "/dav/addressbooks/other@example.com/contacts/", nil)
+	recorder = httptest.NewRecorder()
+	s.Handle(recorder, request, testUser)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Address book of other user is not forbidden: %d", recorder.Code)
+	}
+}
+
+func TestMatchFilter(t *testing.T) {
+	cards, err := vcard.Parse(strings.NewReader("BEGIN:VCARD\r\nVERSION:3.0\r\nFN:John Doe\r\nEMAIL:john@example.com\r\nEND:VCARD\r\n"))
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+
+	for filter, expected := range map[string]bool{
+		`<card:filter/>`: true,
+		`<card:filter><card:prop-filter name="FN"><card:text-match>JOHN</card:text-match></card:prop-filter></card:filter>`:                                   true,
+		`<card:filter><card:prop-filter name="FN"><card:text-match match-type="equals">john</card:text-match></card:prop-filter></card:filter>`:               false,
+		`<card:filter><card:prop-filter name="EMAIL"><card:text-match negate-condition="yes">example</card:text-match></card:prop-filter></card:filter>`:      false,
+		`<card:filter><card:prop-filter name="TEL"><card:is-not-defined/></card:prop-filter></card:filter>`:                                                   true,
+		`<card:filter test="allof"><card:prop-filter name="FN"/><card:prop-filter name="NICKNAME"/></card:filter>`:                                            false,
+		`<card:filter><card:prop-filter name="FN"/><card:prop-filter name="NICKNAME"/></card:filter>`:                                                         true,
+		`<card:filter><card:prop-filter name="EMAIL"><card:text-match match-type="ends-with">@example.com</card:text-match></card:prop-filter></card:filter>`: true,
+		`<card:filter><card:prop-filter name="EMAIL"><card:text-match match-type="starts-with">doe</card:text-match></card:prop-filter></card:filter>`:        false,
+	} {
+		request := httptest.NewRequest("REPORT", "/", strings.NewReader(`<card:filter-test xmlns:card="urn:ietf:params:xml:ns:carddav">`+filter+`</card:filter-test>`))
+		root, err := parseRequest(request)
+		if err != nil {
+			t.Fatalf("Unable to parse filter %s: %s", filter, err)
+		}
+
+		if matchFilter(cards[0], root.child(nsCardDav, "filter")) != expected {
+			t.Errorf("Unexpected result of filter %s", filter)
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	for _, test := range []struct {
+		header   string
+		value    string
+		etag     string
+		expected bool
+	}{
+		{"If-Match", "\"abc\"", "\"abc\"", true},
+		{"If-Match", "\"abc\"", "\"def\"", false},
+		{"If-Match", "*", "", false},
+		{"If-None-Match", "*", "", true},
+		{"If-None-Match", "*", "\"abc\"", false},
+		{"If-None-Match", "W/\"abc\", \"def\"", "\"abc\"", false},
+	} {
+		request := httptest.NewRequest("PUT", "/", nil)
+		request.Header.Set(test.header, test.value)
+		if checkPreconditions(request, test.etag) != test.expected {
+			t.Errorf("Unexpected result for %s: %s with ETag %s", test.header, test.value, test.etag)
+		}
+	}
+}
+
+func TestMatchCalendarFilter(t *testing.T) {
+	event := &common.CalendarEvent{
+		Start: time.Date(2020, 10, 5, 10, 0, 0, 0, time.UTC).Unix(),
+		End:   time.Date(2020, 10, 5, 11, 0, 0, 0, time.UTC).Unix(),
+	}
+
+	for filter, expected := range map[string]bool{
+		`<cal:filter><cal:comp-filter name="VCALENDAR"/></cal:filter>`:                                                                                                             true,
+		`<cal:filter><cal:comp-filter name="VCALENDAR"><cal:comp-filter name="VEVENT"/></cal:comp-filter></cal:filter>`:                                                            true,
+		`<cal:filter><cal:comp-filter name="VCALENDAR"><cal:comp-filter name="VTODO"/></cal:comp-filter></cal:filter>`:                                                             false,
+		`<cal:filter><cal:comp-filter name="VCALENDAR"><cal:comp-filter name="VEVENT"><cal:time-range start="20201005T103000Z"/></cal:comp-filter></cal:comp-filter></cal:filter>`: true,
+		`<cal:filter><cal:comp-filter name="VCALENDAR"><cal:comp-filter name="VEVENT"><cal:time-range start="20201005T110000Z"/></cal:comp-filter></cal:comp-filter></cal:filter>`: false,
+		`<cal:filter><cal:comp-filter name="VCALENDAR"><cal:comp-filter name="VEVENT"><cal:time-range end="20201005T100000Z"/></cal:comp-filter></cal:comp-filter></cal:filter>`:   false,
+	} {
+		request := httptest.NewRequest("REPORT", "/", strings.NewReader(`<cal:filter-test xmlns:cal="urn:ietf:params:xml:ns:caldav">`+filter+`</cal:filter-test>`))
+		root, err := parseRequest(request)
+		if err != nil {
+			t.Fatalf("Unable to parse filter %s: %s", filter, err)
+		}
+
+		if matchCalendarFilter(event, root.child(nsCalDav, "filter")) != expected {
+			t.Errorf("Unexpected result of filter %s", filter)
+		}
+	}
+
+	event.Recurring = true
+	request := httptest.NewRequest("REPORT", "/", strings.NewReader(`<cal:filter xmlns:cal="urn:ietf:params:xml:ns:caldav"><cal:comp-filter name="VCALENDAR"><cal:comp-filter name="VEVENT"><cal:time-range start="20211005T000000Z"/></cal:comp-filter></cal:comp-filter></cal:filter>`))
+	root, err := parseRequest(request)
+	if err != nil || !matchCalendarFilter(event, root) {
+		t.Error("Recurring event doesn't match time range")
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	config "git.semlanik.org/semlanik/gostfix/config"
+	utils "git.semlanik.org/semlanik/gostfix/utils"
+	bson "go.mongodb.org/mongo-driver/bson"
+	mongo "go.mongodb.org/mongo-driver/mongo"
+	options "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (s *Storage) AddAlias(user, email, alias string) error {
+	if config.ConfigInstance().VAliasMaps == "" {
+		return errors.New("Aliases are disabled")
+	}
+
+	if !s.checkUserEmail(user, email) {
+		return errors.New("Email doesn't belong to user")
+	}
+
+	alias = strings.ToLower(strings.TrimSpace(alias))
+	if !utils.RegExpUtilsInstance().EmailChecker.MatchString(alias) {
+		return errors.New("Invalid alias format")
+	}
+
+	if !IsLocalDomain(emailDomain(alias)) {
+		return errors.New("Alias domain is not served by this server")
+	}
+
+	if s.CheckEmailExists(alias) {
+		return errors.New("Email exists")
+	}
+
+	_, err := s.aliasesCollection.InsertOne(context.Background(), &common.Alias{
+		Alias: alias,
+		Email: email,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = putAliasMaps(alias, email)
+	if err != nil {
+		s.aliasesCollection.DeleteOne(context.Background(), bson.M{"alias": alias})
+		return err
+	}
+
+	s.publishSettingsChanged(user, email, common.SettingAliases)
+	return nil
+}
+
+func (s *Storage) RemoveAlias(user, alias string) error {
+	alias = strings.ToLower(strings.TrimSpace(alias))
+	result := &common.Alias{}
+	err := s.aliasesCollection.FindOne(context.Background(), bson.M{"alias": alias}).Decode(result)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(alias, "@") || !s.checkUserEmail(user, result.Email) {
+		return errors.New("Alias doesn't belong to user")
+	}
+
+	err = s.removeAlias(alias)
+	if err == nil {
+		s.publishSettingsChanged(user, result.Email, common.SettingAliases)
+	}
+	return err
+}
+
+func (s *Storage) removeAlias(alias string) error {
+	err := deleteAliasMaps(alias)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.aliasesCollection.DeleteOne(context.Background(), bson.M{"alias": alias})
+	return err
+}
+
+func (s *Storage) GetAliases(email string) (aliases []string, err error) {
+	cur, err := s.aliasesCollection.Find(context.Background(), bson.M{
+		"email": email,
+		"alias": bson.M{"$not": bson.M{"$regex": "^@"}},
+	}, options.Find().SetSort(bson.M{"alias": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	aliases = []string{}
+	for cur.Next(context.Background()) {
+		result := &common.Alias{}
+		if err = cur.Decode(result); err == nil {
+			aliases = append(aliases, result.Alias)
+		}
+	}
+	return aliases, nil
+}
+
+func (s *Storage) CheckAlias(email, alias string) bool {
+	return !strings.HasPrefix(alias, "@") &&
+		s.aliasesCollection.FindOne(context.Background(), bson.M{"alias": strings.ToLower(alias), "email": email}).Err() == nil
+}
+
+// ResolveAlias returns the mailbox email that alias is pointing to
+func (s *Storage) ResolveAlias(alias string) (string, error) {
+	result := &common.Alias{}
+	err := s.aliasesCollection.FindOne(context.Background(), bson.M{"alias": strings.ToLower(alias)}).Decode(result)
+	return result.Email, err
+}
+
+func (s *Storage) GetCatchAll(domain string) (string, error) {
+	email, err := s.ResolveAlias("@" + domain)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	return email, err
+}
+
+// SetCatchAll delivers mail addressed to any non-existing address of the domain
+// to the email. Empty email disables catch-all for the domain.
+func (s *Storage) SetCatchAll(domain, email string) error {
+	if config.ConfigInstance().VAliasMaps == "" {
+		return errors.New("Aliases are disabled")
+	}
+
+	if !IsLocalDomain(domain) {
+		return errors.New("Domain is not served by this server")
+	}
+
+	catchAll := "@" + domain
+	if email == "" {
+		err := s.removeAlias(catchAll)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+	} else {
+		owner, err := s.GetEmailOwner(email)
+		if err != nil || owner == "" {
+			return errors.New("Catch-all email doesn't exist")
+		}
+
+		_, err = s.aliasesCollection.UpdateOne(context.Background(),
+			bson.M{"alias": catchAll},
+			bson.M{"$set": &common.Alias{Alias: catchAll, Email: email}},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+
+		err = putAliasMaps(catchAll, email)
+		if err != nil {
+			return err
+		}
+	}
+
+	//Catch-all record has precedence over virtual mailbox maps in postfix,
+	//so each mailbox of the domain needs explicit virtual alias record
+	emails, err := s.GetAllEmails()
+	if err != nil {
+		return err
+	}
+
+	for _, existingEmail := range emails {
+		if strings.HasSuffix(existingEmail, catchAll) {
+			if err := s.updateAliasMaps(existingEmail); err != nil {
+				log.Printf("Unable to update virtual alias maps for %s: %s\n", existingEmail, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Storage) GetMailboxOptions(email string) (*common.MailboxOptions, error) {
+	mailboxOptions := &common.MailboxOptions{
+		Email: email,
+	}
+
+	err := s.mailboxOptionsCollection.FindOne(context.Background(), bson.M{"email": email}).Decode(mailboxOptions)
+	if err == mongo.ErrNoDocuments {
+		return mailboxOptions, nil
+	}
+	return mailboxOptions, err
+}
+
+func (s *Storage) SetMailboxOptions(user string, mailboxOptions *common.MailboxOptions) error {
+	if !s.checkUserEmail(user, mailboxOptions.Email) {
+		return errors.New("Email doesn't belong to user")
+	}
+
+	_, err := s.mailboxOptionsCollection.UpdateOne(context.Background(),
+		bson.M{"email": mailboxOptions.Email},
+		bson.M{"$set": mailboxOptions},
+		options.Update().SetUpsert(true))
+	if err == nil {
+		s.publishSettingsChanged(user, mailboxOptions.Email, common.SettingMailbox)
+	}
+	return err
+}
+
+func (s *Storage) removeAliases(email string) {
+	cur, err := s.aliasesCollection.Find(context.Background(), bson.M{"email": email})
+	if err != nil {
+		log.Printf("Unable to read aliases of %s: %s\n", email, err)
+		return
+	}
+	defer cur.Close(context.Background())
+
+	for cur.Next(context.Background()) {
+		result := &common.Alias{}
+		if cur.Decode(result) != nil {
+			continue
+		}
+
+		if err := s.removeAlias(result.Alias); err != nil {
+			log.Printf("Unable to remove alias %s: %s\n", result.Alias, err)
+		}
+	}
+	s.mailboxOptionsCollection.DeleteOne(context.Background(), bson.M{"email": email})
+}
@@ -0,0 +1,161 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	bson "go.mongodb.org/mongo-driver/bson"
+	mongo "go.mongodb.org/mongo-driver/mongo"
+	options "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxEventsPerUser = 10000
+	maxEventSize     = 256 * 1024
+)
+
+// ErrUidConflict is returned if calendar already contains event with the
+// same UID in other calendar object
+var ErrUidConflict = errors.New("Event with the same UID already exists")
+
+// eventRecord is event document in calendar collection
+type eventRecord struct {
+	User                 string
+	common.CalendarEvent `bson:",inline"`
+}
+
+func (s *Storage) findEvents(filter bson.M, opts *options.FindOptions) ([]*common.CalendarEvent, error) {
+	cur, err := s.calendarCollection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	events := []*common.CalendarEvent{}
+	for cur.Next(context.Background()) {
+		record := &eventRecord{}
+		if err := cur.Decode(record); err != nil {
+			continue
+		}
+		events = append(events, &record.CalendarEvent)
+	}
+	return events, nil
+}
+
+func (s *Storage) findEvent(filter bson.M) (*common.CalendarEvent, error) {
+	record := &eventRecord{}
+	err := s.calendarCollection.FindOne(context.Background(), filter).Decode(record)
+	if err != nil {
+		return nil, err
+	}
+	return &record.CalendarEvent, nil
+}
+
+func (s *Storage) GetEvents(user string) ([]*common.CalendarEvent, error) {
+	return s.findEvents(bson.M{"user": user}, options.Find().SetSort(bson.M{"start": 1}))
+}
+
+func (s *Storage) GetEvent(user, id string) (*common.CalendarEvent, error) {
+	return s.findEvent(bson.M{"user": user, "id": id})
+}
+
+func (s *Storage) GetEventByUid(user, uid string) (*common.CalendarEvent, error) {
+	return s.findEvent(bson.M{"user": user, "uid": uid})
+}
+
+// PutEvent saves event with the given id, existing event is replaced.
+// Returns true if new event was created.
+func (s *Storage) PutEvent(user string, event *common.CalendarEvent) (bool, error) {
+	if event.Id == "" || event.Uid == "" {
+		return false, errors.New("Event id and UID should be set")
+	}
+
+	if len(event.Calendar) > maxEventSize {
+		return false, errors.New("Event is too large")
+	}
+
+	if conflict, err := s.GetEventByUid(user, event.Uid); err == nil && conflict.Id != event.Id {
+		return false, ErrUidConflict
+	}
+
+	created := false
+	now := time.Now().Unix()
+	existing, err := s.GetEvent(user, event.Id)
+	if err == nil {
+		event.Created = existing.Created
+	} else if err == mongo.ErrNoDocuments {
+		count, err := s.calendarCollection.CountDocuments(context.Background(), bson.M{"user": user})
+		if err != nil {
+			return false, err
+		}
+
+		if count >= maxEventsPerUser {
+			return false, errors.New("Too many events")
+		}
+		event.Created = now
+		created = true
+	} else {
+		return false, err
+	}
+
+	event.Updated = now
+	err = s.withRevision(user, SyncCalendar, func(revision int64) error {
+		event.Revision = revision
+		_, err := s.calendarCollection.ReplaceOne(context.Background(),
+			bson.M{"user": user, "id": event.Id},
+			&eventRecord{user, *event},
+			options.Replace().SetUpsert(true))
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if created {
+		s.removeTombstone(user, SyncCalendar, event.Id)
+	}
+	return created, nil
+}
+
+func (s *Storage) RemoveEvent(user, id string) error {
+	result, err := s.calendarCollection.DeleteOne(context.Background(), bson.M{"user": user, "id": id})
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return errors.New("Event not found")
+	}
+	return s.addTombstone(user, SyncCalendar, id)
+}
+
+// GetEventChanges returns events that are changed after revision
+func (s *Storage) GetEventChanges(user string, revision int64) ([]*common.CalendarEvent, error) {
+	return s.findEvents(bson.M{"user": user, "revision": bson.M{"$gt": revision}}, options.Find().SetSort(bson.M{"revision": 1}))
+}
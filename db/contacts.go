@@ -0,0 +1,394 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package db
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	utils "git.semlanik.org/semlanik/gostfix/utils"
+	uuid "github.com/google/uuid"
+	bson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongo "go.mongodb.org/mongo-driver/mongo"
+	options "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxContactsPerUser  = 5000
+	maxContactEmails    = 16
+	maxContactGroups    = 16
+	maxContactFieldSize = 256
+	maxContactNotesSize = 4096
+	maxContactCardSize  = 256 * 1024
+)
+
+// contactRecord is contact document in contacts collection
+type contactRecord struct {
+	User           string
+	common.Contact `bson:",inline"`
+}
+
+// validateContact normalizes contact fields and checks their limits
+func validateContact(contact *common.Contact) error {
+	contact.Name = strings.TrimSpace(contact.Name)
+	if len(contact.Name) > maxContactFieldSize || len(contact.Notes) > maxContactNotesSize || len(contact.Id) > maxContactFieldSize {
+		return errors.New("Contact field is too long")
+	}
+
+	if len(contact.VCard) > maxContactCardSize {
+		return errors.New("Contact vCard is too large")
+	}
+
+	emails := []string{}
+	for _, email := range contact.Emails {
+		email = strings.ToLower(strings.TrimSpace(email))
+		if email == "" {
+			continue
+		}
+		if !utils.RegExpUtilsInstance().EmailChecker.MatchString(email) {
+			return errors.New("Invalid contact email " + email)
+		}
+		emails = append(emails, email)
+	}
+	contact.Emails = emails
+
+	groups := []string{}
+	for _, group := range contact.Groups {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			continue
+		}
+		if len(group) > maxContactFieldSize {
+			return errors.New("Contact group name is too long")
+		}
+		groups = append(groups, group)
+	}
+	contact.Groups = groups
+
+	if len(contact.Emails) > maxContactEmails || len(contact.Groups) > maxContactGroups {
+		return errors.New("Too many contact emails or groups")
+	}
+
+	if contact.Name == "" && len(contact.Emails) == 0 {
+		return errors.New("Contact should have name or email")
+	}
+	return nil
+}
+
+func (s *Storage) checkContactsLimit(user string) error {
+	count, err := s.contactsCollection.CountDocuments(context.Background(), bson.M{"user": user})
+	if err != nil {
+		return err
+	}
+
+	if count >= maxContactsPerUser {
+		return errors.New("Too many contacts")
+	}
+	return nil
+}
+
+func (s *Storage) findContacts(filter bson.M, opts *options.FindOptions) ([]*common.Contact, error) {
+	cur, err := s.contactsCollection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	contacts := []*common.Contact{}
+	for cur.Next(context.Background()) {
+		record := &contactRecord{}
+		if err := cur.Decode(record); err != nil {
+			continue
+		}
+		contacts = append(contacts, &record.Contact)
+	}
+	return contacts, nil
+}
+
+func (s *Storage) GetContacts(user string) ([]*common.Contact, error) {
+	return s.findContacts(bson.M{"user": user}, options.Find().SetSort(bson.M{"name": 1}))
+}
+
+func (s *Storage) GetContact(user, id string) (*common.Contact, error) {
+	record := &contactRecord{}
+	err := s.contactsCollection.FindOne(context.Background(), bson.M{"user": user, "id": id}).Decode(record)
+	if err != nil {
+		return nil, err
+	}
+	return &record.Contact, nil
+}
+
+func (s *Storage) AddContact(user string, contact *common.Contact) error {
+	if err := validateContact(contact); err != nil {
+		return err
+	}
+
+	if err := s.checkContactsLimit(user); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	contact.Id = uuid.New().String()
+	contact.Created = now
+	contact.Updated = now
+	return s.withRevision(user, SyncContacts, func(revision int64) error {
+		contact.Revision = revision
+		return s.replaceContact(user, contact)
+	})
+}
+
+func (s *Storage) replaceContact(user string, contact *common.Contact) error {
+	_, err := s.contactsCollection.ReplaceOne(context.Background(),
+		bson.M{"user": user, "id": contact.Id},
+		&contactRecord{user, *contact},
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// UpdateContact updates contact fields that are edited by user, contact is
+// not treated as collected anymore
+func (s *Storage) UpdateContact(user string, contact *common.Contact) error {
+	if err := validateContact(contact); err != nil {
+		return err
+	}
+
+	contact.Updated = time.Now().Unix()
+	return s.withRevision(user, SyncContacts, func(revision int64) error {
+		contact.Revision = revision
+		result, err := s.contactsCollection.UpdateOne(context.Background(),
+			bson.M{"user": user, "id": contact.Id},
+			bson.M{"$set": bson.M{
+				"name":      contact.Name,
+				"emails":    contact.Emails,
+				"notes":     contact.Notes,
+				"groups":    contact.Groups,
+				"collected": false,
+				"updated":   contact.Updated,
+				"revision":  contact.Revision,
+			}})
+		if err != nil {
+			return err
+		}
+
+		if result.MatchedCount == 0 {
+			return errors.New("Contact not found")
+		}
+		return nil
+	})
+}
+
+func (s *Storage) RemoveContact(user, id string) error {
+	result, err := s.contactsCollection.DeleteOne(context.Background(), bson.M{"user": user, "id": id})
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return errors.New("Contact not found")
+	}
+	return s.addTombstone(user, SyncContacts, id)
+}
+
+// PutContact saves contact with the given id, existing contact is replaced.
+// Returns true if new contact was created.
+func (s *Storage) PutContact(user string, contact *common.Contact) (bool, error) {
+	if err := validateContact(contact); err != nil {
+		return false, err
+	}
+
+	created := false
+	now := time.Now().Unix()
+	existing, err := s.GetContact(user, contact.Id)
+	if err == nil {
+		contact.Created = existing.Created
+		contact.UseCount = existing.UseCount
+		contact.LastUsed = existing.LastUsed
+	} else if err == mongo.ErrNoDocuments {
+		if err := s.checkContactsLimit(user); err != nil {
+			return false, err
+		}
+		contact.Created = now
+		created = true
+	} else {
+		return false, err
+	}
+
+	contact.Collected = false
+	contact.Updated = now
+	err = s.withRevision(user, SyncContacts, func(revision int64) error {
+		contact.Revision = revision
+		return s.replaceContact(user, contact)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if created {
+		s.removeTombstone(user, SyncContacts, contact.Id)
+	}
+	return created, nil
+}
+
+// ImportContacts saves contacts, contacts with existing id are replaced.
+// Returns number of imported contacts, invalid contacts are skipped.
+func (s *Storage) ImportContacts(user string, contacts []*common.Contact) (int, error) {
+	imported := 0
+	for _, contact := range contacts {
+		if validateContact(contact) != nil {
+			continue
+		}
+
+		if contact.Id == "" {
+			contact.Id = uuid.New().String()
+		}
+
+		if _, err := s.PutContact(user, contact); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// GetContactChanges returns contacts that are changed after revision
+func (s *Storage) GetContactChanges(user string, revision int64) ([]*common.Contact, error) {
+	return s.findContacts(bson.M{"user": user, "revision": bson.M{"$gt": revision}}, options.Find().SetSort(bson.M{"revision": 1}))
+}
+
+// SearchContacts returns addresses of the contacts which name or email
+// contains query. Frequently used contacts are suggested first.
+func (s *Storage) SearchContacts(user, query string, limit int) ([]*common.ContactAddress, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	addresses := []*common.ContactAddress{}
+	if query == "" {
+		return addresses, nil
+	}
+
+	pattern := primitive.Regex{Pattern: regexp.QuoteMeta(query), Options: "i"}
+	contacts, err := s.findContacts(bson.M{
+		"user": user,
+		"$or": bson.A{
+			bson.M{"name": pattern},
+			bson.M{"emails": pattern},
+		},
+	}, options.Find().SetSort(bson.D{{"usecount", -1}, {"name", 1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, contact := range contacts {
+		nameMatches := strings.Contains(strings.ToLower(contact.Name), query)
+		for _, email := range contact.Emails {
+			if nameMatches || strings.Contains(email, query) {
+				addresses = append(addresses, &common.ContactAddress{Name: contact.Name, Email: email})
+			}
+		}
+
+		if len(addresses) >= limit {
+			return addresses[:limit], nil
+		}
+	}
+	return addresses, nil
+}
+
+// CollectContacts updates usage of contacts with addresses, contacts are
+// created for unknown addresses. Addresses are in RFC 5322 format.
+func (s *Storage) CollectContacts(user string, addresses []string) {
+	now := time.Now().Unix()
+	for _, address := range addresses {
+		name := ""
+		email := strings.TrimSpace(address)
+		if parsed, err := mail.ParseAddress(address); err == nil {
+			name = parsed.Name
+			email = parsed.Address
+		}
+
+		email = strings.ToLower(email)
+		if !utils.RegExpUtilsInstance().EmailChecker.MatchString(email) {
+			continue
+		}
+
+		result, err := s.contactsCollection.UpdateOne(context.Background(),
+			bson.M{"user": user, "emails": email},
+			bson.M{"$inc": bson.M{"usecount": 1}, "$set": bson.M{"lastused": now}})
+		if err != nil || result.MatchedCount > 0 {
+			continue
+		}
+
+		if s.checkContactsLimit(user) != nil {
+			return
+		}
+
+		contact := &common.Contact{
+			Id:        uuid.New().String(),
+			Name:      name,
+			Emails:    []string{email},
+			Groups:    []string{},
+			Collected: true,
+			UseCount:  1,
+			LastUsed:  now,
+			Created:   now,
+			Updated:   now,
+		}
+		err = s.withRevision(user, SyncContacts, func(revision int64) error {
+			contact.Revision = revision
+			return s.replaceContact(user, contact)
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// recipients returns all recipient addresses of the mail header
+func recipients(header *common.MailHeader) []string {
+	addresses := []string{}
+	if header == nil {
+		return addresses
+	}
+
+	for _, field := range []string{header.To, header.Cc, header.Bcc} {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+
+		list, err := mail.ParseAddressList(field)
+		if err != nil {
+			addresses = append(addresses, strings.Split(field, ",")...)
+			continue
+		}
+
+		for _, address := range list {
+			addresses = append(addresses, address.String())
+		}
+	}
+	return addresses
+}
@@ -34,7 +34,6 @@ import (
 	"log"
 	"os"
 	"strings"
-	"sync"
 	"time"
 
 	common "git.semlanik.org/semlanik/gostfix/common"
@@ -50,21 +49,28 @@ import (
 	config "git.semlanik.org/semlanik/gostfix/config"
 )
 
-type StuctNotifiers struct {
-	notifiers     []common.Notifier
-	notifiersLock sync.Mutex
-}
-
-var notifiers StuctNotifiers = StuctNotifiers{
-	notifiers: []common.Notifier{},
-}
-
 type Storage struct {
 	db                  *mongo.Database
 	usersCollection     *mongo.Collection
 	tokensCollection    *mongo.Collection
 	emailsCollection    *mongo.Collection
 	allEmailsCollection *mongo.Collection
+	vacationsCollection *mongo.Collection
+	repliesCollection   *mongo.Collection
+	forwardsCollection  *mongo.Collection
+	aliasesCollection   *mongo.Collection
+	domainsCollection   *mongo.Collection
+	sendRateCollection  *mongo.Collection
+	greylistCollection  *mongo.Collection
+	webhooksCollection  *mongo.Collection
+
+	mailboxOptionsCollection    *mongo.Collection
+	webhookDeliveriesCollection *mongo.Collection
+	pushSubscriptionsCollection *mongo.Collection
+	contactsCollection          *mongo.Collection
+	calendarCollection          *mongo.Collection
+	revisionsCollection         *mongo.Collection
+	tombstonesCollection        *mongo.Collection
 }
 
 func qualifiedMailCollection(user string) string {
@@ -136,12 +142,115 @@ func NewStorage() (s *Storage, err error) {
 		tokensCollection:    db.Collection("tokens"),
 		emailsCollection:    db.Collection("emails"),
 		allEmailsCollection: db.Collection("allEmails"),
+		vacationsCollection: db.Collection("vacations"),
+		repliesCollection:   db.Collection("vacationReplies"),
+		forwardsCollection:  db.Collection("forwards"),
+		aliasesCollection:   db.Collection("aliases"),
+		domainsCollection:   db.Collection("domains"),
+		sendRateCollection:  db.Collection("sendRate"),
+		greylistCollection:  db.Collection("greylist"),
+		webhooksCollection:  db.Collection("webhooks"),
+
+		mailboxOptionsCollection:    db.Collection("mailboxOptions"),
+		webhookDeliveriesCollection: db.Collection("webhookDeliveries"),
+		pushSubscriptionsCollection: db.Collection("pushSubscriptions"),
+		contactsCollection:          db.Collection("contacts"),
+		calendarCollection:          db.Collection("calendarEvents"),
+		revisionsCollection:         db.Collection("syncRevisions"),
+		tombstonesCollection:        db.Collection("syncTombstones"),
 	}
 
 	//Initial database setup
 	s.usersCollection.Indexes().CreateOne(context.Background(), index)
 	s.tokensCollection.Indexes().CreateOne(context.Background(), index)
 	s.emailsCollection.Indexes().CreateOne(context.Background(), index)
+	s.vacationsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"email": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	s.repliesCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{"email", 1}, {"sender", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	s.forwardsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"email": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	s.aliasesCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"alias": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	s.domainsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"domain": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	s.mailboxOptionsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"email": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	s.sendRateCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"time": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32(time.Hour.Seconds())),
+	})
+	s.greylistCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{"client", 1}, {"sender", 1}, {"recipient", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	s.greylistCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"updated": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32(config.ConfigInstance().PolicyGreylistExpire.Seconds())),
+	})
+	s.webhooksCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	s.webhooksCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.M{"email": 1},
+	})
+	s.webhookDeliveriesCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"expire": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32(webhookDeliveryExpire.Seconds())),
+	})
+	s.pushSubscriptionsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"endpoint": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	s.pushSubscriptionsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.M{"user": 1},
+	})
+	s.contactsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{"user", 1}, {"id", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	s.contactsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{"user", 1}, {"emails", 1}},
+	})
+	s.contactsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{"user", 1}, {"revision", 1}},
+	})
+	s.calendarCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{"user", 1}, {"id", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	s.calendarCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{"user", 1}, {"uid", 1}},
+	})
+	s.calendarCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{"user", 1}, {"revision", 1}},
+	})
+	s.revisionsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{"user", 1}, {"collection", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	s.tombstonesCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{"user", 1}, {"collection", 1}, {"id", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	s.tombstonesCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{"user", 1}, {"collection", 1}, {"deleted", 1}},
+	})
+
+	startEventStream(db)
 
 	return
 }
@@ -152,11 +261,17 @@ func (s *Storage) AddUser(user, password, fullName string) error {
 		return err
 	}
 
+	credentials, err := common.NewCredentials(password)
+	if err != nil {
+		return err
+	}
+
 	hashString := string(hash)
 	userInfo := bson.M{
-		"user":     user,
-		"password": hashString,
-		"fullName": fullName,
+		"user":        user,
+		"password":    hashString,
+		"credentials": credentials,
+		"fullName":    fullName,
 	}
 	_, err = s.usersCollection.InsertOne(context.Background(), userInfo)
 	if err != nil {
@@ -180,8 +295,13 @@ func (s *Storage) UpdateUser(user, password, fullName string) error {
 		if err != nil {
 			return err
 		}
+		credentials, err := common.NewCredentials(password)
+		if err != nil {
+			return err
+		}
 		hashString := string(hash)
 		userInfo["password"] = hashString
+		userInfo["credentials"] = credentials
 	}
 
 	if len(fullName) > 0 && len(fullName) < 128 && utils.RegExpUtilsInstance().FullNameChecker.MatchString(fullName) {
@@ -193,6 +313,7 @@ func (s *Storage) UpdateUser(user, password, fullName string) error {
 		if err != nil {
 			return err
 		}
+		s.publishSettingsChanged(user, "", common.SettingProfile)
 	}
 
 	return nil
@@ -224,12 +345,20 @@ func (s *Storage) addEmail(user string, email string, upsert bool) error {
 		}
 	}
 
+	if s.aliasesCollection.FindOne(context.Background(), bson.M{"alias": email}).Err() == nil {
+		return errors.New("Email exists")
+	}
+
 	emailParts := strings.Split(email, "@")
 
-	if len(emailParts) != 2 {
+	if len(emailParts) != 2 || !utils.RegExpUtilsInstance().EmailChecker.MatchString(email) {
 		return errors.New("Invalid email format")
 	}
 
+	if !IsLocalDomain(emailParts[1]) {
+		return errors.New("Domain is not served by this server")
+	}
+
 	db, err := berkeleydb.NewDB()
 	if err != nil {
 		log.Fatal(err)
@@ -250,6 +379,13 @@ func (s *Storage) addEmail(user string, email string, upsert bool) error {
 		bson.M{"user": user},
 		bson.M{"$addToSet": bson.M{"email": email}},
 		options.Update().SetUpsert(upsert))
+	if err != nil {
+		return err
+	}
+
+	if catchAll, _ := s.GetCatchAll(emailParts[1]); catchAll != "" {
+		err = s.updateAliasMaps(email)
+	}
 
 	return err
 }
@@ -289,6 +425,11 @@ func (s *Storage) RemoveEmail(user string, email string) error {
 
 	mailsCollection := s.db.Collection(qualifiedMailCollection(user))
 	mailsCollection.DeleteMany(context.Background(), bson.M{"email": email})
+	s.RecalculateUsage(user)
+	s.vacationsCollection.DeleteOne(context.Background(), bson.M{"email": email})
+	s.repliesCollection.DeleteMany(context.Background(), bson.M{"email": email})
+	s.removeForwarding(email)
+	s.removeAliases(email)
 
 	_, err = s.emailsCollection.UpdateOne(context.Background(),
 		bson.M{"user": user},
@@ -322,20 +463,29 @@ func (s *Storage) SaveMail(email, folder string, m *common.Mail, read bool) erro
 		return err
 	}
 
+	s.addUsage(user.User, m.Size)
+
+	if folder == common.Sent {
+		s.CollectContacts(user.User, recipients(m.Header))
+	}
+
 	mail := *m //deep copy for multithreading
-	s.notifyNewMail(email, common.MailMetadata{
-		Id:     result.InsertedID.(primitive.ObjectID).Hex(),
-		Read:   false,
-		Trash:  false,
-		Folder: folder,
-		User:   user.User,
-		Mail:   &mail,
+	s.publish(&common.Event{
+		Type:  common.EventMailCreated,
+		User:  user.User,
+		Email: email,
+		Mail: &common.MailMetadata{
+			Id:     result.InsertedID.(primitive.ObjectID).Hex(),
+			Email:  email,
+			Read:   read,
+			Trash:  false,
+			Folder: folder,
+			User:   user.User,
+			Mail:   &mail,
+		},
 	})
 
-	stats, err := s.GetEmailStats(user.User, email, folder)
-	if err == nil {
-		s.notifyMailboxUpdate(email, []common.FolderStat{stats})
-	}
+	s.publishFolderStats(user.User, email, folder)
 
 	return nil
 }
@@ -359,13 +509,27 @@ func (s *Storage) DeleteMail(user string, mailId string) error {
 	}
 
 	_, err = mailsCollection.DeleteOne(context.Background(), bson.M{"_id": oId})
+	if err != nil {
+		return err
+	}
+
+	s.addUsage(user, -result.Mail.Size)
 
-	stats, errTemp := s.GetEmailStats(user, result.Email, common.Trash)
-	if errTemp == nil {
-		s.notifyMailboxUpdate(result.Email, []common.FolderStat{stats})
+	result.User = user
+	s.publish(&common.Event{
+		Type:  common.EventMailDeleted,
+		User:  user,
+		Email: result.Email,
+		Mail:  &result,
+	})
+
+	folder := result.Folder
+	if result.Trash {
+		folder = common.Trash
 	}
+	s.publishFolderStats(user, result.Email, folder)
 
-	return err
+	return nil
 }
 
 func (s *Storage) GetMailList(user, email, folder string, frame common.Frame) ([]*common.MailMetadata, error) {
@@ -494,11 +658,22 @@ func (s *Storage) SetRead(user string, id string, read bool) error {
 	if err != nil {
 		return err
 	}
-	_, err = mailsCollection.UpdateOne(context.Background(), bson.M{"_id": oId}, bson.M{"$set": bson.M{"read": read}})
 
-	s.notifyMailboxUpdateForMail(user, id)
+	previous, err := s.GetMail(user, id)
+	if err != nil {
+		return err
+	}
 
-	return err
+	result, err := mailsCollection.UpdateOne(context.Background(), bson.M{"_id": oId}, bson.M{"$set": bson.M{"read": read}})
+	if err != nil {
+		return err
+	}
+
+	if result.ModifiedCount > 0 {
+		s.publishMailUpdate(user, previous)
+	}
+
+	return nil
 }
 
 func (s *Storage) UpdateMail(user string, id string, mailMap interface{}) error {
@@ -509,23 +684,21 @@ func (s *Storage) UpdateMail(user string, id string, mailMap interface{}) error
 		return err
 	}
 
-	fromFolder := ""
-	metadata, err := s.GetMail(user, id)
-	if err == nil {
-		if metadata.Trash {
-			fromFolder = common.Trash
-		} else {
-			fromFolder = metadata.Folder
-		}
-	} else {
-		log.Printf("Unable to get mail info to update folder statistics %s", err)
+	previous, err := s.GetMail(user, id)
+	if err != nil {
+		return err
 	}
 
-	_, err = mailsCollection.UpdateOne(context.Background(), bson.M{"_id": oId}, bson.M{"$set": mailMap})
+	result, err := mailsCollection.UpdateOne(context.Background(), bson.M{"_id": oId}, bson.M{"$set": mailMap})
+	if err != nil {
+		return err
+	}
 
-	s.notifyMailboxUpdateForMail(user, id, fromFolder)
+	if result.ModifiedCount > 0 {
+		s.publishMailUpdate(user, previous)
+	}
 
-	return err
+	return nil
 }
 
 func (s *Storage) GetUsers() (users []string, err error) {
@@ -543,6 +716,14 @@ func (s *Storage) GetEmails(user string) (emails []string, err error) {
 	return result.Email, nil
 }
 
+func (s *Storage) GetEmailOwner(email string) (string, error) {
+	result := &struct {
+		User string
+	}{}
+	err := s.emailsCollection.FindOne(context.Background(), bson.M{"email": email}).Decode(result)
+	return result.User, err
+}
+
 func (s *Storage) GetAllEmails() (emails []string, err error) {
 	cur, err := s.allEmailsCollection.Find(context.Background(), bson.M{})
 	if cur.Next(context.Background()) {
@@ -559,16 +740,36 @@ func (s *Storage) GetAllEmails() (emails []string, err error) {
 
 func (s *Storage) CheckEmailExists(email string) bool {
 	result := s.allEmailsCollection.FindOne(context.Background(), bson.M{"emails": email})
+	if result.Err() == nil {
+		return true
+	}
+
+	result = s.aliasesCollection.FindOne(context.Background(), bson.M{"alias": email})
 	return result.Err() == nil
 }
 
-func (s *Storage) GetFolders(email string) (folders []*common.Folder) {
+func (s *Storage) GetFolders(user, email string) (folders []*common.Folder) {
 	folders = []*common.Folder{
 		{Name: common.Inbox, Custom: false},
 		{Name: common.Sent, Custom: false},
 		{Name: common.Trash, Custom: false},
 		{Name: common.Spam, Custom: false},
 	}
+
+	mailsCollection := s.db.Collection(qualifiedMailCollection(user))
+	customFolders, err := mailsCollection.Distinct(context.Background(), "folder", bson.M{"email": email})
+	if err != nil {
+		log.Printf("Unable to read custom folders %s\n", err)
+		return
+	}
+
+	for _, customFolder := range customFolders {
+		name, ok := customFolder.(string)
+		if !ok || common.IsStandardFolder(name) {
+			continue
+		}
+		folders = append(folders, &common.Folder{Name: name, Custom: true})
+	}
 	return
 }
 
@@ -673,56 +874,108 @@ func (s *Storage) CheckAttachment(user, attachment string) bool {
 	return result.Err() == nil
 }
 
-func (s *Storage) RegisterNotifier(notifier common.Notifier) {
-	if notifier != nil {
-		notifiers.notifiersLock.Lock()
-		defer notifiers.notifiersLock.Unlock()
-		notifiers.notifiers = append(notifiers.notifiers, notifier)
-	}
+// RegisterNotifier subscribes notifier to the events of all storages,
+// options may be nil to use default queue
+func (s *Storage) RegisterNotifier(notifier common.Notifier, options *common.NotifierOptions) {
+	common.EventBusInstance().Subscribe(notifier, options)
 }
 
-func (s *Storage) notifyNewMail(email string, mail common.MailMetadata) {
-	notifiers.notifiersLock.Lock()
-	defer notifiers.notifiersLock.Unlock()
-	for _, notifier := range notifiers.notifiers {
-		notifier.NotifyNewMail(email, mail)
-	}
+// publish sends event to the notifiers of all instances, it's called only
+// after the change is written to the database
+func (s *Storage) publish(event *common.Event) {
+	common.EventBusInstance().Publish(event)
 }
 
-func (s *Storage) notifyMailboxUpdate(email string, stats []common.FolderStat) {
-	notifiers.notifiersLock.Lock()
-	defer notifiers.notifiersLock.Unlock()
-	for _, notifier := range notifiers.notifiers {
-		notifier.NotifyMaiboxUpdate(email, stats)
+func folderOf(metadata *common.MailMetadata) string {
+	if metadata.Trash {
+		return common.Trash
 	}
+	return metadata.Folder
 }
 
-func (s *Storage) notifyMailboxUpdateForMail(user, id string, folders ...string) {
-	metadata, err := s.GetMail(user, id)
-
+// publishMailUpdate publishes updated or moved event for the mail, previous
+// is state of the mail before update
+func (s *Storage) publishMailUpdate(user string, previous *common.MailMetadata) {
+	metadata, err := s.GetMail(user, previous.Id)
 	if err != nil {
-		log.Printf("Unable to get mail metadata to update mailbox stat %v\n", err)
+		log.Printf("Unable to get mail metadata to publish mail update %v\n", err)
 		return
 	}
+	metadata.User = user
+	previous.User = user
 
-	if metadata.Trash {
-		folders = append(folders, common.Trash)
+	fromFolder := folderOf(previous)
+	toFolder := folderOf(metadata)
+
+	eventType := common.EventMailUpdated
+	if fromFolder != toFolder || previous.Folder != metadata.Folder {
+		eventType = common.EventMailMoved
+	}
+
+	s.publish(&common.Event{
+		Type:     eventType,
+		User:     user,
+		Email:    metadata.Email,
+		Mail:     metadata,
+		Previous: previous,
+	})
+
+	if fromFolder == toFolder {
+		s.publishFolderStats(user, metadata.Email, toFolder)
+	} else {
+		s.publishFolderStats(user, metadata.Email, fromFolder, toFolder)
 	}
+}
 
+// publishFolderStats publishes statistics of the folders. Custom folders
+// exist while they have mails, so folder is reported as created when it gets
+// its first mail.
+func (s *Storage) publishFolderStats(user, email string, folders ...string) {
 	var stats []common.FolderStat
-	stat, err := s.GetEmailStats(user, metadata.Email, metadata.Folder)
-	stats = append(stats, stat)
 	for _, folder := range folders {
-		if folder == metadata.Folder {
+		stat, err := s.GetEmailStats(user, email, folder)
+		if err != nil {
+			log.Printf("Unable to update mailbox stat %v\n", err)
 			continue
 		}
-
-		stat, err = s.GetEmailStats(user, metadata.Email, folder)
-		if err == nil {
-			stats = append(stats, stat)
-		} else {
-			log.Printf("Unable to update mailbox stat %v\n", err)
+		stats = append(stats, stat)
+
+		if !common.IsStandardFolder(folder) && stat.Total == 1 && s.countFolderMails(user, email, folder) == 1 {
+			s.publish(&common.Event{
+				Type:   common.EventFolderCreated,
+				User:   user,
+				Email:  email,
+				Folder: folder,
+			})
 		}
 	}
-	s.notifyMailboxUpdate(metadata.Email, stats)
+
+	if len(stats) > 0 {
+		s.publish(&common.Event{
+			Type:  common.EventFolderStats,
+			User:  user,
+			Email: email,
+			Stats: stats,
+		})
+	}
+}
+
+func (s *Storage) countFolderMails(user, email, folder string) int64 {
+	mailsCollection := s.db.Collection(qualifiedMailCollection(user))
+	count, err := mailsCollection.CountDocuments(context.Background(), bson.M{"email": email, "folder": folder})
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// publishSettingsChanged publishes change of the user or email settings,
+// email is empty for settings of the user account
+func (s *Storage) publishSettingsChanged(user, email, setting string) {
+	s.publish(&common.Event{
+		Type:    common.EventSettingsChanged,
+		User:    user,
+		Email:   email,
+		Setting: setting,
+	})
 }
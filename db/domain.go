@@ -0,0 +1,143 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	config "git.semlanik.org/semlanik/gostfix/config"
+	bson "go.mongodb.org/mongo-driver/bson"
+	mongo "go.mongodb.org/mongo-driver/mongo"
+	options "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (s *Storage) GetDomainSettings(domain string) (*common.DomainSettings, error) {
+	if !IsLocalDomain(domain) {
+		return nil, errors.New("Domain is not served by this server")
+	}
+
+	settings := &common.DomainSettings{
+		Domain:              domain,
+		RegistrationEnabled: domain == primaryDomain(),
+		Owners:              []string{},
+	}
+
+	err := s.domainsCollection.FindOne(context.Background(), bson.M{"domain": domain}).Decode(settings)
+	if err == mongo.ErrNoDocuments {
+		return settings, nil
+	}
+	return settings, err
+}
+
+func (s *Storage) SetDomainSettings(settings *common.DomainSettings) error {
+	if !IsLocalDomain(settings.Domain) {
+		return errors.New("Domain is not served by this server")
+	}
+
+	if settings.DefaultQuota < 0 {
+		return errors.New("Invalid default quota")
+	}
+
+	for _, owner := range settings.Owners {
+		if s.usersCollection.FindOne(context.Background(), bson.M{"user": owner}).Err() != nil {
+			return errors.New("Domain owner " + owner + " doesn't exist")
+		}
+	}
+
+	_, err := s.domainsCollection.UpdateOne(context.Background(),
+		bson.M{"domain": settings.Domain},
+		bson.M{"$set": settings},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// GetDomains returns settings of all domains served by this server
+func (s *Storage) GetDomains() (domains []*common.DomainSettings, err error) {
+	for _, domain := range config.ConfigInstance().VMailboxDomains {
+		settings, err := s.GetDomainSettings(domain)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, settings)
+	}
+	return domains, nil
+}
+
+func (s *Storage) GetRegistrationDomains() (domains []string) {
+	all, err := s.GetDomains()
+	if err != nil {
+		return nil
+	}
+
+	for _, settings := range all {
+		if settings.RegistrationEnabled {
+			domains = append(domains, settings.Domain)
+		}
+	}
+	return domains
+}
+
+func (s *Storage) GetDomainEmails(domain string) (emails []string, err error) {
+	allEmails, err := s.GetAllEmails()
+	if err != nil {
+		return nil, err
+	}
+
+	emails = []string{}
+	for _, email := range allEmails {
+		if strings.HasSuffix(email, "@"+domain) {
+			emails = append(emails, email)
+		}
+	}
+	return emails, nil
+}
+
+// IsLocalDomain checks if domain is one of virtual mailbox domains served by gostfix
+func IsLocalDomain(domain string) bool {
+	for _, localDomain := range config.ConfigInstance().VMailboxDomains {
+		if localDomain == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// primaryDomain is the only domain that allows registration unless other is
+// configured. It's mydomain from postfix configuration if served by this
+// server or the first virtual mailbox domain otherwise.
+func primaryDomain() string {
+	if IsLocalDomain(config.ConfigInstance().MyDomain) {
+		return config.ConfigInstance().MyDomain
+	}
+	return config.ConfigInstance().VMailboxDomains[0]
+}
+
+func emailDomain(email string) string {
+	return email[strings.LastIndex(email, "@")+1:]
+}
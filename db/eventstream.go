@@ -0,0 +1,223 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package db
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	config "git.semlanik.org/semlanik/gostfix/config"
+	bson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongo "go.mongodb.org/mongo-driver/mongo"
+	options "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	//Events are kept for instances that are restarted or lost connection
+	eventExpire                = 24 * time.Hour
+	eventStreamRetryDelay      = 5 * time.Second
+	eventStreamTokenSavePeriod = time.Second
+)
+
+// storedEvent is document of events collection
+type storedEvent struct {
+	Id           primitive.ObjectID `bson:"_id,omitempty"`
+	common.Event `bson:",inline"`
+	Instance     string
+	Created      time.Time
+}
+
+// eventStream shares events between gostfix instances that use the same
+// database. Published events are inserted to events collection and every
+// instance dispatches them to local notifiers from the collection change
+// stream. Change streams require replica set, events are dispatched within
+// the process if they are not available.
+type eventStream struct {
+	events      *mongo.Collection
+	tokens      *mongo.Collection
+	claims      *mongo.Collection
+	instance    string
+	stream      *mongo.ChangeStream
+	resumeToken bson.Raw
+	tokenSaved  time.Time
+}
+
+var (
+	eventStreamInstance *eventStream
+	eventStreamOnce     sync.Once
+)
+
+// startEventStream is called by every storage, but only the first one
+// starts the stream
+func startEventStream(db *mongo.Database) {
+	eventStreamOnce.Do(func() {
+		es := &eventStream{
+			events:   db.Collection("events"),
+			tokens:   db.Collection("eventStreamTokens"),
+			claims:   db.Collection("eventClaims"),
+			instance: config.ConfigInstance().InstanceId,
+		}
+
+		es.events.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+			Keys:    bson.M{"created": 1},
+			Options: options.Index().SetExpireAfterSeconds(int32(eventExpire.Seconds())),
+		})
+		es.claims.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+			Keys:    bson.M{"created": 1},
+			Options: options.Index().SetExpireAfterSeconds(int32(eventExpire.Seconds())),
+		})
+
+		es.loadResumeToken()
+		if err := es.open(); err != nil {
+			log.Printf("Mongo change streams are not available, events are delivered within the process only: %s\n", err)
+			return
+		}
+
+		eventStreamInstance = es
+		common.EventBusInstance().SetTransport(es.publish)
+		go es.run()
+	})
+}
+
+func (es *eventStream) publish(event *common.Event) error {
+	_, err := es.events.InsertOne(context.Background(), &storedEvent{
+		Event:    *event,
+		Instance: es.instance,
+		Created:  time.Now(),
+	})
+	return err
+}
+
+// open opens change stream from the saved resume token. Stream is started
+// from the current moment if token is too old and the oplog doesn't
+// contain it anymore.
+func (es *eventStream) open() error {
+	pipeline := mongo.Pipeline{bson.D{{"$match", bson.M{"operationType": "insert"}}}}
+	if es.resumeToken != nil {
+		stream, err := es.events.Watch(context.Background(), pipeline, options.ChangeStream().SetStartAfter(es.resumeToken))
+		if err == nil {
+			es.stream = stream
+			return nil
+		}
+		log.Printf("Unable to resume event stream of %s, starting from now: %s\n", es.instance, err)
+		es.resumeToken = nil
+	}
+
+	stream, err := es.events.Watch(context.Background(), pipeline)
+	if err != nil {
+		return err
+	}
+	es.stream = stream
+	return nil
+}
+
+func (es *eventStream) run() {
+	for {
+		for es.stream.Next(context.Background()) {
+			change := &struct {
+				FullDocument storedEvent `bson:"fullDocument"`
+			}{}
+
+			if err := es.stream.Decode(change); err != nil {
+				log.Printf("Unable to decode event: %s\n", err)
+			} else {
+				event := change.FullDocument.Event
+				event.Id = change.FullDocument.Id.Hex()
+				common.EventBusInstance().Dispatch(&event)
+			}
+
+			es.resumeToken = es.stream.ResumeToken()
+			if time.Since(es.tokenSaved) > eventStreamTokenSavePeriod {
+				es.saveResumeToken()
+			}
+		}
+
+		log.Printf("Event stream is interrupted: %v\n", es.stream.Err())
+		es.stream.Close(context.Background())
+		es.saveResumeToken()
+
+		for {
+			time.Sleep(eventStreamRetryDelay)
+			if err := es.open(); err == nil {
+				break
+			} else {
+				log.Printf("Unable to reopen event stream: %s\n", err)
+			}
+		}
+	}
+}
+
+func (es *eventStream) loadResumeToken() {
+	result := &struct {
+		Token bson.Raw
+	}{}
+
+	err := es.tokens.FindOne(context.Background(), bson.M{"instance": es.instance}).Decode(result)
+	if err == nil && len(result.Token) > 0 {
+		es.resumeToken = result.Token
+	}
+}
+
+func (es *eventStream) saveResumeToken() {
+	if es.resumeToken == nil {
+		return
+	}
+
+	es.tokenSaved = time.Now()
+	_, err := es.tokens.UpdateOne(context.Background(),
+		bson.M{"instance": es.instance},
+		bson.M{"$set": bson.M{"token": es.resumeToken, "updated": es.tokenSaved}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		log.Printf("Unable to save event stream position: %s\n", err)
+	}
+}
+
+// ClaimEvent makes sure that event is handled by single instance. Notifiers
+// that have external side effects, like webhooks, claim every event and
+// skip it if it's already claimed by notifier of other instance.
+func (s *Storage) ClaimEvent(event *common.Event, notifier string) bool {
+	if event.Id == "" || eventStreamInstance == nil {
+		return true
+	}
+
+	_, err := eventStreamInstance.claims.InsertOne(context.Background(), bson.M{
+		"_id":      notifier + ":" + event.Id,
+		"instance": eventStreamInstance.instance,
+		"created":  time.Now(),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return false
+	}
+
+	if err != nil {
+		log.Printf("Unable to claim event %s: %s\n", event.Id, err)
+	}
+	return true
+}
@@ -0,0 +1,185 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	config "git.semlanik.org/semlanik/gostfix/config"
+	utils "git.semlanik.org/semlanik/gostfix/utils"
+	"github.com/semlanik/berkeleydb"
+	bson "go.mongodb.org/mongo-driver/bson"
+	mongo "go.mongodb.org/mongo-driver/mongo"
+	options "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxForwardingTargets = 10
+
+func (s *Storage) GetForwarding(email string) (*common.Forwarding, error) {
+	forwarding := &common.Forwarding{
+		Email:    email,
+		Targets:  []string{},
+		KeepCopy: true,
+	}
+
+	err := s.forwardsCollection.FindOne(context.Background(), bson.M{"email": email}).Decode(forwarding)
+	if err == mongo.ErrNoDocuments {
+		return forwarding, nil
+	}
+
+	return forwarding, err
+}
+
+func (s *Storage) SetForwarding(user string, forwarding *common.Forwarding) error {
+	if config.ConfigInstance().VAliasMaps == "" {
+		return errors.New("Mail forwarding is disabled")
+	}
+
+	if !s.checkUserEmail(user, forwarding.Email) {
+		return errors.New("Email doesn't belong to user")
+	}
+
+	if len(forwarding.Targets) > maxForwardingTargets {
+		return errors.New("Too many forwarding targets")
+	}
+
+	for _, target := range forwarding.Targets {
+		if !utils.RegExpUtilsInstance().EmailChecker.MatchString(target) || target == forwarding.Email {
+			return errors.New("Invalid forwarding target " + target)
+		}
+	}
+
+	_, err := s.forwardsCollection.UpdateOne(context.Background(),
+		bson.M{"email": forwarding.Email},
+		bson.M{"$set": forwarding},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	err = s.updateAliasMaps(forwarding.Email)
+	if err == nil {
+		s.publishSettingsChanged(user, forwarding.Email, common.SettingForwarding)
+	}
+	return err
+}
+
+// updateAliasMaps synchronizes virtual alias maps record of the email with
+// the forwarding rules stored in database
+func (s *Storage) updateAliasMaps(email string) error {
+	forwarding, err := s.GetForwarding(email)
+	if err != nil {
+		return err
+	}
+
+	var targets []string
+	if len(forwarding.Targets) > 0 {
+		if forwarding.KeepCopy {
+			targets = append(targets, email)
+		}
+		targets = append(targets, forwarding.Targets...)
+	}
+
+	if len(targets) == 0 {
+		if catchAll, _ := s.GetCatchAll(emailDomain(email)); catchAll != "" {
+			return putAliasMaps(email, email)
+		}
+		return deleteAliasMaps(email)
+	}
+
+	return putAliasMaps(email, strings.Join(targets, ","))
+}
+
+func (s *Storage) removeForwarding(email string) {
+	s.forwardsCollection.DeleteOne(context.Background(), bson.M{"email": email})
+	if config.ConfigInstance().VAliasMaps == "" {
+		return
+	}
+
+	err := deleteAliasMaps(email)
+	if err != nil {
+		log.Printf("Unable to remove %s from virtual alias maps: %s\n", email, err)
+	}
+}
+
+func openAliasMaps() (*berkeleydb.Db, error) {
+	if config.ConfigInstance().VAliasMaps == "" {
+		return nil, errors.New("Virtual alias maps are not configured")
+	}
+
+	db, err := berkeleydb.NewDB()
+	if err != nil {
+		return nil, err
+	}
+
+	if !utils.FileExists(config.ConfigInstance().VAliasMaps) {
+		err = db.Open(config.ConfigInstance().VAliasMaps, berkeleydb.DbHash, berkeleydb.DbCreate)
+	} else {
+		err = db.Open(config.ConfigInstance().VAliasMaps, berkeleydb.DbHash, 0)
+	}
+
+	if err != nil {
+		return nil, errors.New("Unable to open virtual alias maps " + config.ConfigInstance().VAliasMaps + " " + err.Error())
+	}
+
+	return db, nil
+}
+
+func putAliasMaps(key, value string) error {
+	db, err := openAliasMaps()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = db.Put(key, value)
+	if err != nil {
+		return errors.New("Unable to add alias to maps " + err.Error())
+	}
+	return nil
+}
+
+func deleteAliasMaps(key string) error {
+	db, err := openAliasMaps()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Get(key); err != nil {
+		return nil //Nothing to remove
+	}
+
+	err = db.Delete(key)
+	if err != nil {
+		return errors.New("Unable to remove alias from maps " + err.Error())
+	}
+	return nil
+}
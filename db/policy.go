@@ -0,0 +1,90 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package db
+
+import (
+	"context"
+	"time"
+
+	bson "go.mongodb.org/mongo-driver/bson"
+	mongo "go.mongodb.org/mongo-driver/mongo"
+	options "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CheckSenderLogin checks if authenticated user is allowed to send mail from
+// sender address. Only own emails, their aliases and subaddresses are allowed.
+func (s *Storage) CheckSenderLogin(user, sender string) bool {
+	email, err := s.resolveAddress(sender, false)
+	if err != nil {
+		return false
+	}
+
+	owner, err := s.GetEmailOwner(email)
+	return err == nil && owner == user
+}
+
+// CheckSendRate registers new message sent by the user and returns false if
+// user already sent limit messages during the last hour
+func (s *Storage) CheckSendRate(user string, limit int64) bool {
+	now := time.Now()
+	count, err := s.sendRateCollection.CountDocuments(context.Background(), bson.M{
+		"user": user,
+		"time": bson.M{"$gt": now.Add(-time.Hour)},
+	})
+	if err != nil {
+		return true
+	}
+
+	if count >= limit {
+		return false
+	}
+
+	s.sendRateCollection.InsertOne(context.Background(), bson.M{"user": user, "time": now})
+	return true
+}
+
+// CheckGreylist returns true if the sender/recipient/client triplet was seen
+// at least delay ago. New triplets are recorded and temporary refused.
+func (s *Storage) CheckGreylist(client, sender, recipient string, delay time.Duration) bool {
+	now := time.Now()
+	result := struct {
+		First time.Time
+	}{}
+
+	err := s.greylistCollection.FindOneAndUpdate(context.Background(),
+		bson.M{"client": client, "sender": sender, "recipient": recipient},
+		bson.M{"$set": bson.M{"updated": now}, "$setOnInsert": bson.M{"first": now}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	return now.Sub(result.First) >= delay
+}
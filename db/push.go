@@ -0,0 +1,94 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	bson "go.mongodb.org/mongo-driver/bson"
+	options "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxPushSubscriptionsPerUser = 16
+
+// AddPushSubscription saves push subscription of the browser. Subscription
+// with the same endpoint is replaced, so browser may renew its keys.
+func (s *Storage) AddPushSubscription(subscription *common.PushSubscription) error {
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return errors.New("Invalid push endpoint")
+	}
+
+	p256dh, err := base64.RawURLEncoding.DecodeString(subscription.P256dh)
+	if err != nil || len(p256dh) != 65 {
+		return errors.New("Invalid push subscription key")
+	}
+
+	auth, err := base64.RawURLEncoding.DecodeString(subscription.Auth)
+	if err != nil || len(auth) != 16 {
+		return errors.New("Invalid push subscription secret")
+	}
+
+	count, err := s.pushSubscriptionsCollection.CountDocuments(context.Background(), bson.M{"user": subscription.User, "endpoint": bson.M{"$ne": subscription.Endpoint}})
+	if err != nil {
+		return err
+	}
+
+	if count >= maxPushSubscriptionsPerUser {
+		return errors.New("Too many push subscriptions")
+	}
+
+	subscription.Created = time.Now().Unix()
+	_, err = s.pushSubscriptionsCollection.ReplaceOne(context.Background(), bson.M{"endpoint": subscription.Endpoint}, subscription, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *Storage) GetPushSubscriptions(user string) ([]*common.PushSubscription, error) {
+	cur, err := s.pushSubscriptionsCollection.Find(context.Background(), bson.M{"user": user})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	subscriptions := []*common.PushSubscription{}
+	for cur.Next(context.Background()) {
+		subscription := &common.PushSubscription{}
+		if err := cur.Decode(subscription); err != nil {
+			continue
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, nil
+}
+
+func (s *Storage) RemovePushSubscription(user, endpoint string) error {
+	_, err := s.pushSubscriptionsCollection.DeleteOne(context.Background(), bson.M{"user": user, "endpoint": endpoint})
+	return err
+}
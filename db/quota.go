@@ -0,0 +1,224 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	config "git.semlanik.org/semlanik/gostfix/config"
+	bson "go.mongodb.org/mongo-driver/bson"
+)
+
+// GetQuota returns storage usage of the user and effective limits. Per-user
+// quota is inherited from the domain default if not set explicitly and is
+// additionally limited by space that is left in the domain quota.
+func (s *Storage) GetQuota(user string) (*common.Quota, error) {
+	result := struct {
+		Usage *int64
+		Quota int64
+	}{}
+
+	err := s.usersCollection.FindOne(context.Background(), bson.M{"user": user}).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	quota := &common.Quota{
+		Hard: result.Quota,
+	}
+
+	if result.Usage != nil {
+		quota.Usage = *result.Usage
+	} else {
+		quota.Usage, err = s.RecalculateUsage(user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	domain, err := s.GetDomainSettings(emailDomain(user))
+	if err == nil {
+		if quota.Hard == 0 {
+			quota.Hard = domain.DefaultQuota
+		}
+
+		if domain.Quota > 0 {
+			domainLeft := domain.Quota - s.getDomainUsage(domain.Domain)
+			if domainLeft < 0 {
+				domainLeft = 0
+			}
+
+			if quota.Hard == 0 || quota.Usage+domainLeft < quota.Hard {
+				quota.Hard = quota.Usage + domainLeft
+			}
+		}
+	}
+
+	if quota.Hard > 0 {
+		quota.Soft = quota.Hard * config.ConfigInstance().QuotaSoftLimit / 100
+	}
+
+	return quota, nil
+}
+
+func (s *Storage) SetUserQuota(user string, hard int64) error {
+	if hard < 0 {
+		return errors.New("Invalid quota")
+	}
+
+	_, err := s.usersCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$set": bson.M{"quota": hard}})
+	return err
+}
+
+// RecalculateUsage sums sizes of all mails and attachments stored for the user
+func (s *Storage) RecalculateUsage(user string) (int64, error) {
+	mailsCollection := s.db.Collection(qualifiedMailCollection(user))
+	cur, err := mailsCollection.Aggregate(context.Background(), bson.A{
+		bson.M{"$group": bson.M{"_id": nil, "usage": bson.M{"$sum": "$mail.size"}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(context.Background())
+
+	result := struct {
+		Usage int64
+	}{}
+
+	if cur.Next(context.Background()) {
+		if err = cur.Decode(&result); err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = s.usersCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$set": bson.M{"usage": result.Usage}})
+	return result.Usage, err
+}
+
+// CheckQuotaWarning returns true once the user exceeded soft quota, so only
+// single warning is sent until usage drops below soft quota again
+func (s *Storage) CheckQuotaWarning(user string) bool {
+	quota, err := s.GetQuota(user)
+	if err != nil {
+		return false
+	}
+
+	if !quota.SoftExceeded() {
+		s.usersCollection.UpdateOne(context.Background(), bson.M{"user": user}, bson.M{"$set": bson.M{"quotaWarned": false}})
+		return false
+	}
+
+	result, err := s.usersCollection.UpdateOne(context.Background(),
+		bson.M{"user": user, "quotaWarned": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"quotaWarned": true}})
+	return err == nil && result.ModifiedCount > 0
+}
+
+// ResolveRecipient returns the mailbox email that receives mail addressed to
+// the recipient, taking into account aliases, subaddressing and catch-all
+func (s *Storage) ResolveRecipient(recipient string) (string, error) {
+	return s.resolveAddress(recipient, true)
+}
+
+func (s *Storage) resolveAddress(address string, catchAll bool) (string, error) {
+	address = strings.ToLower(address)
+	atIndex := strings.LastIndex(address, "@")
+	if atIndex <= 0 || !IsLocalDomain(address[atIndex+1:]) {
+		return "", errors.New("Address is not served by this server")
+	}
+
+	if s.allEmailsCollection.FindOne(context.Background(), bson.M{"emails": address}).Err() == nil {
+		return address, nil
+	}
+
+	if email, err := s.ResolveAlias(address); err == nil {
+		return email, nil
+	}
+
+	delimiter := config.ConfigInstance().RecipientDelimiter
+	if delimiter != "" {
+		if delimiterIndex := strings.IndexAny(address[:atIndex], delimiter); delimiterIndex > 0 {
+			return s.resolveAddress(address[:delimiterIndex]+address[atIndex:], catchAll)
+		}
+	}
+
+	if catchAll {
+		if email, err := s.GetCatchAll(address[atIndex+1:]); err == nil && email != "" {
+			return email, nil
+		}
+	}
+
+	return "", errors.New("Address doesn't exist")
+}
+
+// RemoveAttachments removes attachment files of the mail that was not saved
+func (s *Storage) RemoveAttachments(m *common.Mail) {
+	if m.Body == nil {
+		return
+	}
+
+	for _, attachment := range m.Body.Attachments {
+		removeAttachment(attachment.Id)
+	}
+}
+
+func (s *Storage) addUsage(user string, size int64) {
+	if size == 0 {
+		return
+	}
+
+	//Usage is recalculated on the next quota request if it was never calculated before
+	_, err := s.usersCollection.UpdateOne(context.Background(),
+		bson.M{"user": user, "usage": bson.M{"$exists": true}},
+		bson.M{"$inc": bson.M{"usage": size}})
+	if err != nil {
+		log.Printf("Unable to update storage usage of %s: %s\n", user, err)
+	}
+}
+
+func (s *Storage) getDomainUsage(domain string) int64 {
+	cur, err := s.usersCollection.Aggregate(context.Background(), bson.A{
+		bson.M{"$match": bson.M{"user": bson.M{"$regex": "@" + strings.ReplaceAll(domain, ".", "\\.") + "$"}}},
+		bson.M{"$group": bson.M{"_id": nil, "usage": bson.M{"$sum": "$usage"}}},
+	})
+	if err != nil {
+		return 0
+	}
+	defer cur.Close(context.Background())
+
+	result := struct {
+		Usage int64
+	}{}
+
+	if cur.Next(context.Background()) {
+		cur.Decode(&result)
+	}
+	return result.Usage
+}
@@ -0,0 +1,195 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	bson "go.mongodb.org/mongo-driver/bson"
+	mongo "go.mongodb.org/mongo-driver/mongo"
+	options "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Sync collections of the user, revisions of items in different sync
+// collections are independent
+const (
+	SyncContacts = "contacts"
+	SyncCalendar = "calendar"
+)
+
+// tombstoneExpire is time that removed items are reported to syncing
+// clients. Expired tombstones raise floor revision of the sync collection,
+// clients that didn't sync since revision below the floor should resync all
+// items.
+const tombstoneExpire = 90 * 24 * time.Hour
+
+// tombstoneRecord is removed item of the sync collection
+type tombstoneRecord struct {
+	User       string
+	Collection string
+	Id         string
+	Revision   int64
+	Deleted    time.Time
+}
+
+// maxRevisionAttempts limits retries of changes that compete for the same
+// revision of the sync collection
+const maxRevisionAttempts = 100
+
+// withRevision writes change of the user's sync collection item with the
+// next revision of the collection. Every change gets new revision, so
+// clients may request changes since revision they know. Revision of the
+// collection is advanced only after the item is written, so sync token is
+// never issued before the changes it includes are visible. If revision is
+// taken by concurrent change, item is written again with the next one, so
+// write should be idempotent.
+func (s *Storage) withRevision(user, collection string, write func(revision int64) error) error {
+	for attempt := 0; attempt < maxRevisionAttempts; attempt++ {
+		current, err := s.GetRevision(user, collection)
+		if err != nil {
+			return err
+		}
+
+		if err := write(current + 1); err != nil {
+			return err
+		}
+
+		filter := bson.M{"user": user, "collection": collection, "revision": current}
+		if current == 0 {
+			filter["revision"] = bson.M{"$in": bson.A{0, nil}}
+		}
+
+		//Document is inserted for the first revision, duplicate key means
+		//that revision is taken by concurrent change
+		result, err := s.revisionsCollection.UpdateOne(context.Background(), filter,
+			bson.M{"$set": bson.M{"revision": current + 1}},
+			options.Update().SetUpsert(true))
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if result.MatchedCount > 0 || result.UpsertedCount > 0 {
+			return nil
+		}
+	}
+	return errors.New("Too many concurrent changes of " + collection)
+}
+
+// GetRevision returns last revision of the user's sync collection
+func (s *Storage) GetRevision(user, collection string) (int64, error) {
+	result := struct {
+		Revision int64
+	}{}
+	err := s.revisionsCollection.FindOne(context.Background(), bson.M{"user": user, "collection": collection}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return result.Revision, err
+}
+
+// GetSyncFloor removes expired tombstones of the user's sync collection and
+// returns the lowest revision that changes are still known since
+func (s *Storage) GetSyncFloor(user, collection string) (int64, error) {
+	filter := bson.M{
+		"user":       user,
+		"collection": collection,
+		"deleted":    bson.M{"$lt": time.Now().Add(-tombstoneExpire)},
+	}
+
+	expired := &tombstoneRecord{}
+	err := s.tombstonesCollection.FindOne(context.Background(), filter,
+		options.FindOne().SetSort(bson.M{"revision": -1})).Decode(expired)
+	if err == nil {
+		//Floor is raised before tombstones are removed, so removal is never
+		//lost if it's interrupted
+		_, err = s.revisionsCollection.UpdateOne(context.Background(),
+			bson.M{"user": user, "collection": collection},
+			bson.M{"$max": bson.M{"floor": expired.Revision}})
+		if err != nil {
+			return 0, err
+		}
+
+		filter["revision"] = bson.M{"$lte": expired.Revision}
+		s.tombstonesCollection.DeleteMany(context.Background(), filter)
+	} else if err != mongo.ErrNoDocuments {
+		return 0, err
+	}
+
+	result := struct {
+		Floor int64
+	}{}
+	err = s.revisionsCollection.FindOne(context.Background(), bson.M{"user": user, "collection": collection}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return result.Floor, err
+}
+
+// addTombstone records removal of the item from sync collection
+func (s *Storage) addTombstone(user, collection, id string) error {
+	return s.withRevision(user, collection, func(revision int64) error {
+		_, err := s.tombstonesCollection.ReplaceOne(context.Background(),
+			bson.M{"user": user, "collection": collection, "id": id},
+			&tombstoneRecord{user, collection, id, revision, time.Now()},
+			options.Replace().SetUpsert(true))
+		return err
+	})
+}
+
+// removeTombstone forgets removal of the item, if item with the same id is
+// created again
+func (s *Storage) removeTombstone(user, collection, id string) {
+	s.tombstonesCollection.DeleteOne(context.Background(), bson.M{"user": user, "collection": collection, "id": id})
+}
+
+// GetTombstones returns ids of items removed from sync collection after
+// revision
+func (s *Storage) GetTombstones(user, collection string, revision int64) ([]string, error) {
+	cur, err := s.tombstonesCollection.Find(context.Background(), bson.M{
+		"user":       user,
+		"collection": collection,
+		"revision":   bson.M{"$gt": revision},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	ids := []string{}
+	for cur.Next(context.Background()) {
+		record := &tombstoneRecord{}
+		if err := cur.Decode(record); err != nil {
+			continue
+		}
+		ids = append(ids, record.Id)
+	}
+	return ids, nil
+}
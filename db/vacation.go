@@ -0,0 +1,108 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	bson "go.mongodb.org/mongo-driver/bson"
+	mongo "go.mongodb.org/mongo-driver/mongo"
+	options "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (s *Storage) GetVacation(email string) (*common.Vacation, error) {
+	vacation := &common.Vacation{
+		Email:        email,
+		Interval:     7,
+		ExcludeLists: true,
+		ExcludeAuto:  true,
+	}
+
+	err := s.vacationsCollection.FindOne(context.Background(), bson.M{"email": email}).Decode(vacation)
+	if err == mongo.ErrNoDocuments {
+		return vacation, nil
+	}
+
+	return vacation, err
+}
+
+func (s *Storage) SetVacation(user string, vacation *common.Vacation) error {
+	if !s.checkUserEmail(user, vacation.Email) {
+		return errors.New("Email doesn't belong to user")
+	}
+
+	if vacation.Interval < 0 {
+		vacation.Interval = 0
+	}
+
+	_, err := s.vacationsCollection.UpdateOne(context.Background(),
+		bson.M{"email": vacation.Email},
+		bson.M{"$set": vacation},
+		options.Update().SetUpsert(true))
+
+	if err != nil {
+		return err
+	}
+
+	if !vacation.Enabled {
+		s.repliesCollection.DeleteMany(context.Background(), bson.M{"email": vacation.Email})
+	}
+
+	s.publishSettingsChanged(user, vacation.Email, common.SettingVacation)
+	return nil
+}
+
+// CheckVacationReply registers auto-reply to the sender and returns true if
+// no reply was sent to the sender within the vacation interval
+func (s *Storage) CheckVacationReply(vacation *common.Vacation, sender string) bool {
+	now := time.Now().Unix()
+	sender = strings.ToLower(sender)
+
+	filter := bson.M{
+		"email":  vacation.Email,
+		"sender": sender,
+		"time":   bson.M{"$gt": now - vacation.Interval*int64(24*time.Hour/time.Second)},
+	}
+
+	if s.repliesCollection.FindOne(context.Background(), filter).Err() == nil {
+		return false
+	}
+
+	_, err := s.repliesCollection.UpdateOne(context.Background(),
+		bson.M{"email": vacation.Email, "sender": sender},
+		bson.M{"$set": bson.M{"time": now}},
+		options.Update().SetUpsert(true))
+
+	return err == nil
+}
+
+func (s *Storage) checkUserEmail(user, email string) bool {
+	return s.emailsCollection.FindOne(context.Background(), bson.M{"user": user, "email": email}).Err() == nil
+}
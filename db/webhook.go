@@ -0,0 +1,167 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	uuid "github.com/google/uuid"
+	bson "go.mongodb.org/mongo-driver/bson"
+	options "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxWebhooksPerEmail   = 10
+	webhookSecretLength   = 32
+	webhookDeliveryExpire = 7 * 24 * time.Hour
+)
+
+// AddWebhook creates webhook for the email, owner is the user that manages
+// webhook. Returns created webhook with generated secret.
+func (s *Storage) AddWebhook(owner, email, webhookUrl string, events []string, allowPrivate bool) (*common.Webhook, error) {
+	parsedUrl, err := url.Parse(webhookUrl)
+	if err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") || parsedUrl.Host == "" {
+		return nil, errors.New("Invalid webhook URL")
+	}
+
+	if len(events) == 0 {
+		return nil, errors.New("No webhook events selected")
+	}
+
+	for _, event := range events {
+		if !common.IsValidWebhookEvent(event) {
+			return nil, errors.New("Invalid webhook event " + event)
+		}
+	}
+
+	count, err := s.webhooksCollection.CountDocuments(context.Background(), bson.M{"email": email})
+	if err != nil {
+		return nil, err
+	}
+
+	if count >= maxWebhooksPerEmail {
+		return nil, errors.New("Too many webhooks")
+	}
+
+	secret := make([]byte, webhookSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	webhook := &common.Webhook{
+		Id:           uuid.New().String(),
+		Owner:        owner,
+		Email:        email,
+		Url:          webhookUrl,
+		Secret:       hex.EncodeToString(secret),
+		Events:       events,
+		AllowPrivate: allowPrivate,
+		Created:      time.Now().Unix(),
+	}
+
+	_, err = s.webhooksCollection.InsertOne(context.Background(), webhook)
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (s *Storage) GetWebhook(id string) (*common.Webhook, error) {
+	webhook := &common.Webhook{}
+	err := s.webhooksCollection.FindOne(context.Background(), bson.M{"id": id}).Decode(webhook)
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// GetWebhooks returns webhooks of the email, or webhooks of all emails
+// that are subscribed to event if event is not empty
+func (s *Storage) GetWebhooks(email, event string) ([]*common.Webhook, error) {
+	filter := bson.M{"email": email}
+	if event != "" {
+		filter["events"] = event
+	}
+
+	cur, err := s.webhooksCollection.Find(context.Background(), filter, options.Find().SetSort(bson.M{"created": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	webhooks := []*common.Webhook{}
+	for cur.Next(context.Background()) {
+		webhook := &common.Webhook{}
+		if err := cur.Decode(webhook); err != nil {
+			continue
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+func (s *Storage) RemoveWebhook(id string) error {
+	_, err := s.webhooksCollection.DeleteOne(context.Background(), bson.M{"id": id})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.webhookDeliveriesCollection.DeleteMany(context.Background(), bson.M{"webhookid": id})
+	return err
+}
+
+func (s *Storage) AddWebhookDelivery(delivery *common.WebhookDelivery) error {
+	_, err := s.webhookDeliveriesCollection.InsertOne(context.Background(), &struct {
+		common.WebhookDelivery `bson:",inline"`
+		Expire                 time.Time
+	}{*delivery, time.Now()})
+	return err
+}
+
+// GetWebhookDeliveries returns latest delivery attempts of the webhook
+func (s *Storage) GetWebhookDeliveries(webhookId string, limit int64) ([]*common.WebhookDelivery, error) {
+	cur, err := s.webhookDeliveriesCollection.Find(context.Background(), bson.M{"webhookid": webhookId},
+		options.Find().SetSort(bson.M{"time": -1}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	deliveries := []*common.WebhookDelivery{}
+	for cur.Next(context.Background()) {
+		delivery := &common.WebhookDelivery{}
+		if err := cur.Decode(delivery); err != nil {
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
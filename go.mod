@@ -12,6 +12,7 @@ require (
 	github.com/jsimonetti/berkeleydb v0.0.0-20170815141343-5cde5eaaf78c // indirect
 	github.com/pkg/profile v1.6.0
 	github.com/semlanik/berkeleydb v0.0.0-20200324082802-7b28da5446c0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
 	go.mongodb.org/mongo-driver v1.5.1
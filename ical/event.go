@@ -0,0 +1,133 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package ical
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+)
+
+// MainEvent returns VEVENT that describes all occurrences of the event, first
+// VEVENT is returned if calendar contains overridden occurrences only
+func MainEvent(calendar *Component) *Component {
+	events := calendar.Children("VEVENT")
+	for _, event := range events {
+		if event.Get("RECURRENCE-ID") == nil {
+			return event
+		}
+	}
+
+	if len(events) > 0 {
+		return events[0]
+	}
+	return nil
+}
+
+// EventFromCalendar verifies that calendar object contains single event and
+// returns its description. All VEVENT components of the object should have
+// the same UID, other components except VTIMEZONE are not supported.
+func EventFromCalendar(calendar *Component) (*common.CalendarEvent, error) {
+	uid := ""
+	for _, component := range calendar.Components {
+		switch component.Name {
+		case "VTIMEZONE":
+			continue
+		case "VEVENT":
+			eventUid := strings.TrimSpace(component.Value("UID"))
+			if eventUid == "" || (uid != "" && uid != eventUid) {
+				return nil, errors.New("Calendar object should contain events with the same UID")
+			}
+			uid = eventUid
+		default:
+			return nil, errors.New("Unsupported calendar component " + component.Name)
+		}
+	}
+
+	main := MainEvent(calendar)
+	if main == nil {
+		return nil, errors.New("Calendar object contains no events")
+	}
+
+	start, end, allDay, err := eventTime(main)
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.CalendarEvent{
+		Uid:       uid,
+		Summary:   main.Value("SUMMARY"),
+		Location:  main.Value("LOCATION"),
+		Start:     start.Unix(),
+		End:       end.Unix(),
+		AllDay:    allDay,
+		Recurring: main.Get("RRULE") != nil || main.Get("RDATE") != nil,
+		Calendar:  calendar.String(),
+	}, nil
+}
+
+// eventTime returns start and end of the event, end is calculated from
+// DURATION if DTEND is not set
+func eventTime(event *Component) (time.Time, time.Time, bool, error) {
+	dtstart := event.Get("DTSTART")
+	if dtstart == nil {
+		return time.Time{}, time.Time{}, false, errors.New("Event start is not set")
+	}
+
+	start, allDay, err := ParseTime(dtstart)
+	if err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+
+	if dtend := event.Get("DTEND"); dtend != nil {
+		end, _, err := ParseTime(dtend)
+		return start, end, allDay, err
+	}
+
+	if duration := event.Get("DURATION"); duration != nil {
+		d, err := ParseDuration(duration.Value)
+		return start, start.Add(d), allDay, err
+	}
+
+	if allDay {
+		return start, start.AddDate(0, 0, 1), allDay, nil
+	}
+	return start, start, allDay, nil
+}
+
+// Address returns email of calendar user address like mailto:user@example.com
+func Address(property *Property) string {
+	if property == nil {
+		return ""
+	}
+
+	address := strings.TrimSpace(property.Value)
+	if len(address) > 7 && strings.EqualFold(address[:7], "mailto:") {
+		address = address[7:]
+	}
+	return strings.ToLower(address)
+}
@@ -0,0 +1,268 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package ical
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	vcard "git.semlanik.org/semlanik/gostfix/vcard"
+)
+
+const (
+	maxNestingLevel = 8
+	dateFormat      = "20060102"
+	dateTimeFormat  = "20060102T150405"
+)
+
+// Property is content line of iCalendar object, content lines of iCalendar
+// and vCard have the same syntax
+type Property = vcard.Property
+
+// Component is iCalendar component like VCALENDAR or VEVENT, as described in
+// RFC 5545
+type Component struct {
+	Name       string
+	Properties []*Property
+	Components []*Component
+}
+
+// Parse reads single iCalendar object from r
+func Parse(r io.Reader) (*Component, error) {
+	lines, err := vcard.ReadLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var root *Component
+	stack := []*Component{}
+	for _, line := range lines {
+		property, err := vcard.ParseProperty(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch property.Name {
+		case "BEGIN":
+			component := &Component{Name: strings.ToUpper(property.Value)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Components = append(parent.Components, component)
+			} else if root == nil {
+				root = component
+			} else {
+				return nil, errors.New("Multiple iCalendar objects")
+			}
+
+			stack = append(stack, component)
+			if len(stack) > maxNestingLevel {
+				return nil, errors.New("Too deep nesting of iCalendar components")
+			}
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(property.Value) {
+				return nil, errors.New("Unexpected end of component " + property.Value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, errors.New("Property outside of component")
+			}
+			component := stack[len(stack)-1]
+			component.Properties = append(component.Properties, property)
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, errors.New("Unterminated component " + stack[len(stack)-1].Name)
+	}
+
+	if root == nil || root.Name != "VCALENDAR" {
+		return nil, errors.New("Not an iCalendar object")
+	}
+	return root, nil
+}
+
+// Encode writes component with nested components to w
+func (c *Component) Encode(w io.Writer) error {
+	if _, err := io.WriteString(w, "BEGIN:"+c.Name+"\r\n"); err != nil {
+		return err
+	}
+	for _, property := range c.Properties {
+		if _, err := io.WriteString(w, vcard.Fold(property.String())); err != nil {
+			return err
+		}
+	}
+	for _, component := range c.Components {
+		if err := component.Encode(w); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "END:"+c.Name+"\r\n")
+	return err
+}
+
+// String returns component in iCalendar format
+func (c *Component) String() string {
+	var result strings.Builder
+	c.Encode(&result)
+	return result.String()
+}
+
+// Get returns first property with name or nil
+func (c *Component) Get(name string) *Property {
+	for _, property := range c.Properties {
+		if property.Name == name {
+			return property
+		}
+	}
+	return nil
+}
+
+// GetAll returns all properties with name
+func (c *Component) GetAll(name string) []*Property {
+	properties := []*Property{}
+	for _, property := range c.Properties {
+		if property.Name == name {
+			properties = append(properties, property)
+		}
+	}
+	return properties
+}
+
+// Value returns unescaped text value of the first property with name
+func (c *Component) Value(name string) string {
+	if property := c.Get(name); property != nil {
+		return property.Text()
+	}
+	return ""
+}
+
+// Add appends property with raw value
+func (c *Component) Add(name, value string) *Property {
+	property := &Property{Name: name, Value: value}
+	c.Properties = append(c.Properties, property)
+	return property
+}
+
+// Remove removes all properties with name
+func (c *Component) Remove(name string) {
+	properties := c.Properties[:0]
+	for _, property := range c.Properties {
+		if property.Name != name {
+			properties = append(properties, property)
+		}
+	}
+	c.Properties = properties
+}
+
+// Children returns nested components with name
+func (c *Component) Children(name string) []*Component {
+	components := []*Component{}
+	for _, component := range c.Components {
+		if component.Name == name {
+			components = append(components, component)
+		}
+	}
+	return components
+}
+
+// ParseTime parses DATE or DATE-TIME value of the property, returns true if
+// value is DATE. Time zones are resolved using system time zone database,
+// unknown time zones and floating time are treated as UTC.
+func ParseTime(property *Property) (time.Time, bool, error) {
+	value := strings.TrimSpace(property.Value)
+	if len(value) == len(dateFormat) {
+		date, err := time.Parse(dateFormat, value)
+		return date, true, err
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		dateTime, err := time.Parse(dateTimeFormat, strings.TrimSuffix(value, "Z"))
+		return dateTime, false, err
+	}
+
+	location := time.UTC
+	if tzid, ok := property.Params["TZID"]; ok && len(tzid) > 0 {
+		if tz, err := time.LoadLocation(strings.TrimPrefix(tzid[0], "/")); err == nil {
+			location = tz
+		}
+	}
+	dateTime, err := time.ParseInLocation(dateTimeFormat, value, location)
+	return dateTime, false, err
+}
+
+// FormatTime formats time as UTC DATE-TIME value
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(dateTimeFormat) + "Z"
+}
+
+// ParseDuration parses DURATION value like P1W or -PT1H30M
+func ParseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	sign := time.Duration(1)
+	if strings.HasPrefix(value, "-") {
+		sign = -1
+	}
+	value = strings.TrimLeft(value, "+-")
+	if !strings.HasPrefix(value, "P") || len(value) < 3 {
+		return 0, errors.New("Invalid duration " + value)
+	}
+
+	units := map[byte]time.Duration{
+		'W': 7 * 24 * time.Hour,
+		'D': 24 * time.Hour,
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+	}
+
+	duration := time.Duration(0)
+	number := ""
+	for i := 1; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c >= '0' && c <= '9':
+			number += string(c)
+		case c == 'T':
+		case units[c] != 0 && number != "":
+			n, err := strconv.Atoi(number)
+			if err != nil {
+				return 0, err
+			}
+			duration += time.Duration(n) * units[c]
+			number = ""
+		default:
+			return 0, errors.New("Invalid duration " + value)
+		}
+	}
+
+	if number != "" {
+		return 0, errors.New("Invalid duration " + value)
+	}
+	return sign * duration, nil
+}
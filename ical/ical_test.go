@@ -0,0 +1,166 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"git.semlanik.org/semlanik/gostfix/common"
+)
+
+const testInvitation = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Example//Calendar//EN\r\n" +
+	"METHOD:REQUEST\r\n" +
+	"BEGIN:VTIMEZONE\r\n" +
+	"TZID:Europe/Berlin\r\n" +
+	"END:VTIMEZONE\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:meeting-1@example.com\r\n" +
+	"SEQUENCE:2\r\n" +
+	"DTSTAMP:20201001T080000Z\r\n" +
+	"DTSTART;TZID=Europe/Berlin:20201005T100000\r\n" +
+	"DURATION:PT1H30M\r\n" +
+	"SUMMARY:Weekly sync\\, planning\r\n" +
+	"LOCATION:Room 1\r\n" +
+	"RRULE:FREQ=WEEKLY\r\n" +
+	"ORGANIZER;CN=Boss:mailto:boss@example.com\r\n" +
+	"ATTENDEE;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:User@Example.org\r\n" +
+	"ATTENDEE;PARTSTAT=ACCEPTED:mailto:other@example.com\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseInvitation(t *testing.T) {
+	invitation, err := ParseInvitation(testInvitation)
+	if err != nil {
+		t.Fatalf("ParseInvitation failed: %s", err)
+	}
+
+	if invitation.Method != common.InvitationRequest || invitation.Uid != "meeting-1@example.com" || invitation.Sequence != 2 {
+		t.Errorf("Unexpected invitation %+v", invitation)
+	}
+	if invitation.Summary != "Weekly sync, planning" || invitation.Organizer != "boss@example.com" {
+		t.Errorf("Unexpected summary %q or organizer %q", invitation.Summary, invitation.Organizer)
+	}
+	if len(invitation.Attendees) != 2 || invitation.Attendees[0] != "user@example.org" {
+		t.Errorf("Unexpected attendees %v", invitation.Attendees)
+	}
+
+	location, err := time.LoadLocation("Europe/Berlin")
+	if err == nil {
+		start := time.Date(2020, 10, 5, 10, 0, 0, 0, location)
+		if invitation.Start != start.Unix() || invitation.End != start.Add(90*time.Minute).Unix() {
+			t.Errorf("Unexpected event time %d - %d", invitation.Start, invitation.End)
+		}
+	}
+
+	if _, err := ParseInvitation(strings.Replace(testInvitation, "METHOD:REQUEST", "METHOD:PUBLISH", 1)); err == nil {
+		t.Error("Invitation with unsupported method is accepted")
+	}
+}
+
+func TestEventFromCalendar(t *testing.T) {
+	calendar, err := Parse(strings.NewReader(testInvitation))
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+
+	event, err := EventFromCalendar(calendar)
+	if err != nil {
+		t.Fatalf("EventFromCalendar failed: %s", err)
+	}
+	if event.Uid != "meeting-1@example.com" || event.Location != "Room 1" || !event.Recurring || event.AllDay {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	calendar.Components = append(calendar.Components, &Component{Name: "VTODO"})
+	if _, err := EventFromCalendar(calendar); err == nil {
+		t.Error("Calendar with VTODO is accepted")
+	}
+}
+
+func TestReply(t *testing.T) {
+	request, err := Parse(strings.NewReader(testInvitation))
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+
+	reply := Reply(request, "user@example.org", common.PartStatAccepted)
+	if reply.Value("METHOD") != common.InvitationReply || len(reply.Children("VTIMEZONE")) != 1 {
+		t.Errorf("Unexpected reply %s", reply)
+	}
+
+	events := reply.Children("VEVENT")
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event in reply, got %d", len(events))
+	}
+
+	attendees := events[0].GetAll("ATTENDEE")
+	if len(attendees) != 1 || partStat(attendees[0]) != common.PartStatAccepted || attendees[0].Params["RSVP"] != nil {
+		t.Errorf("Unexpected reply attendees %+v", attendees)
+	}
+	if events[0].Get("RRULE") != nil {
+		t.Error("Reply contains recurrence rule")
+	}
+
+	parsed, err := ParseInvitation(reply.String())
+	if err != nil || parsed.Status != common.PartStatAccepted {
+		t.Errorf("Unable to parse reply %+v: %v", parsed, err)
+	}
+
+	if !ApplyReply(request, reply) {
+		t.Fatal("Reply is not applied")
+	}
+	if status := partStat(MainEvent(request).Get("ATTENDEE")); status != common.PartStatAccepted {
+		t.Errorf("Unexpected attendee status %s", status)
+	}
+}
+
+func TestApplyCancel(t *testing.T) {
+	calendar, err := Parse(strings.NewReader(testInvitation))
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+
+	cancel := &Component{Name: "VCALENDAR"}
+	event := &Component{Name: "VEVENT"}
+	event.Add("UID", "meeting-1@example.com")
+	event.Properties = append(event.Properties, &Property{Name: "RECURRENCE-ID", Params: map[string][]string{"TZID": {"Europe/Berlin"}}, Value: "20201012T100000"})
+	cancel.Components = append(cancel.Components, event)
+
+	if !ApplyCancel(calendar, cancel) {
+		t.Fatal("Cancelled occurrence removes whole event")
+	}
+	if exdate := MainEvent(calendar).Get("EXDATE"); exdate == nil || exdate.Value != "20201012T100000" {
+		t.Errorf("Unexpected excluded date %+v", exdate)
+	}
+
+	event.Remove("RECURRENCE-ID")
+	if ApplyCancel(calendar, cancel) {
+		t.Error("Cancelled event is kept")
+	}
+}
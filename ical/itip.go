@@ -0,0 +1,253 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package ical
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+)
+
+const productId = "-//gostfix//calendar//EN"
+
+// ParseInvitation parses iTIP message with REQUEST, REPLY or CANCEL method.
+// Main event of the message describes the invitation.
+func ParseInvitation(data string) (*common.Invitation, error) {
+	calendar, err := Parse(strings.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	method := strings.ToUpper(strings.TrimSpace(calendar.Value("METHOD")))
+	if method != common.InvitationRequest && method != common.InvitationReply && method != common.InvitationCancel {
+		return nil, errors.New("Unsupported iTIP method " + method)
+	}
+
+	main := MainEvent(calendar)
+	if main == nil {
+		return nil, errors.New("Invitation contains no events")
+	}
+
+	start, end, allDay, err := eventTime(main)
+	if err != nil {
+		return nil, err
+	}
+
+	sequence, _ := strconv.ParseInt(strings.TrimSpace(main.Value("SEQUENCE")), 10, 64)
+	invitation := &common.Invitation{
+		Method:      method,
+		Uid:         strings.TrimSpace(main.Value("UID")),
+		Summary:     main.Value("SUMMARY"),
+		Location:    main.Value("LOCATION"),
+		Description: main.Value("DESCRIPTION"),
+		Start:       start.Unix(),
+		End:         end.Unix(),
+		AllDay:      allDay,
+		Organizer:   Address(main.Get("ORGANIZER")),
+		Attendees:   []string{},
+		Sequence:    sequence,
+		Calendar:    calendar.String(),
+	}
+
+	for _, attendee := range main.GetAll("ATTENDEE") {
+		invitation.Attendees = append(invitation.Attendees, Address(attendee))
+	}
+
+	//Reply contains the only attendee that responds to invitation
+	if attendee := main.Get("ATTENDEE"); method == common.InvitationReply && attendee != nil {
+		invitation.Status = partStat(attendee)
+	}
+
+	if invitation.Uid == "" {
+		return nil, errors.New("Invitation UID is not set")
+	}
+	return invitation, nil
+}
+
+// Reply creates iTIP REPLY of the attendee to the invitation
+func Reply(request *Component, attendee, status string) *Component {
+	reply := &Component{Name: "VCALENDAR"}
+	reply.Add("VERSION", "2.0")
+	reply.Add("PRODID", productId)
+	reply.Add("METHOD", common.InvitationReply)
+	reply.Components = append(reply.Components, request.Children("VTIMEZONE")...)
+
+	for _, event := range request.Children("VEVENT") {
+		replyEvent := &Component{Name: "VEVENT"}
+		for _, name := range []string{"UID", "RECURRENCE-ID", "SEQUENCE", "DTSTART", "DTEND", "DURATION", "SUMMARY", "ORGANIZER"} {
+			if property := event.Get(name); property != nil {
+				replyEvent.Properties = append(replyEvent.Properties, property)
+			}
+		}
+		replyEvent.Add("DTSTAMP", FormatTime(time.Now()))
+
+		replyAttendee := &Property{Name: "ATTENDEE", Value: "mailto:" + attendee}
+		for _, property := range event.GetAll("ATTENDEE") {
+			if Address(property) == attendee {
+				replyAttendee = &Property{Name: "ATTENDEE", Params: copyParams(property.Params), Value: property.Value}
+				break
+			}
+		}
+		setPartStat(replyAttendee, status)
+		delete(replyAttendee.Params, "RSVP")
+		replyEvent.Properties = append(replyEvent.Properties, replyAttendee)
+
+		reply.Components = append(reply.Components, replyEvent)
+	}
+	return reply
+}
+
+// SetPartStat sets participation status of the attendee in all events of
+// the calendar, returns false if attendee is not invited
+func SetPartStat(calendar *Component, attendee, status string) bool {
+	found := false
+	for _, event := range calendar.Children("VEVENT") {
+		for _, property := range event.GetAll("ATTENDEE") {
+			if Address(property) == attendee {
+				setPartStat(property, status)
+				delete(property.Params, "RSVP")
+				found = true
+			}
+		}
+	}
+	return found
+}
+
+// ApplyReply updates participation status of attendees in calendar object
+// of the organizer, returns false if reply doesn't match any attendee
+func ApplyReply(calendar *Component, reply *Component) bool {
+	applied := false
+	for _, replyEvent := range reply.Children("VEVENT") {
+		event := findOccurrence(calendar, replyEvent.Get("RECURRENCE-ID"))
+		if event == nil {
+			event = MainEvent(calendar)
+		}
+
+		for _, attendee := range replyEvent.GetAll("ATTENDEE") {
+			for _, property := range event.GetAll("ATTENDEE") {
+				if Address(property) == Address(attendee) {
+					setPartStat(property, partStat(attendee))
+					applied = true
+				}
+			}
+		}
+	}
+	return applied
+}
+
+// ApplyCancel removes cancelled occurrences from calendar object, returns
+// false if the whole event is cancelled. Cancelled occurrences of recurring
+// event are excluded from recurrence set.
+func ApplyCancel(calendar *Component, cancel *Component) bool {
+	main := MainEvent(calendar)
+	for _, cancelEvent := range cancel.Children("VEVENT") {
+		recurrenceId := cancelEvent.Get("RECURRENCE-ID")
+		if recurrenceId == nil || main == nil || main.Get("RECURRENCE-ID") != nil {
+			return false
+		}
+
+		if occurrence := findOccurrence(calendar, recurrenceId); occurrence != nil {
+			components := calendar.Components[:0]
+			for _, component := range calendar.Components {
+				if component != occurrence {
+					components = append(components, component)
+				}
+			}
+			calendar.Components = components
+		}
+		main.Properties = append(main.Properties, &Property{Name: "EXDATE", Params: copyParams(recurrenceId.Params), Value: recurrenceId.Value})
+	}
+	return true
+}
+
+// findOccurrence returns overridden occurrence of recurring event with
+// RECURRENCE-ID or nil
+func findOccurrence(calendar *Component, recurrenceId *Property) *Component {
+	if recurrenceId == nil {
+		return nil
+	}
+
+	id, _, err := ParseTime(recurrenceId)
+	if err != nil {
+		return nil
+	}
+
+	for _, event := range calendar.Children("VEVENT") {
+		if property := event.Get("RECURRENCE-ID"); property != nil {
+			if eventId, _, err := ParseTime(property); err == nil && eventId.Equal(id) {
+				return event
+			}
+		}
+	}
+	return nil
+}
+
+// MergeEvent replaces occurrence of the event in calendar object with the
+// same occurrence from update, calendar is replaced if update contains main
+// event. Returns merged calendar object.
+func MergeEvent(calendar *Component, update *Component) *Component {
+	main := MainEvent(update)
+	if calendar == nil || main == nil || main.Get("RECURRENCE-ID") == nil {
+		return update
+	}
+
+	for _, event := range update.Children("VEVENT") {
+		if occurrence := findOccurrence(calendar, event.Get("RECURRENCE-ID")); occurrence != nil {
+			for i, component := range calendar.Components {
+				if component == occurrence {
+					calendar.Components[i] = event
+				}
+			}
+		} else {
+			calendar.Components = append(calendar.Components, event)
+		}
+	}
+	return calendar
+}
+
+func partStat(attendee *Property) string {
+	if values := attendee.Params["PARTSTAT"]; len(values) > 0 {
+		return strings.ToUpper(values[0])
+	}
+	return "NEEDS-ACTION"
+}
+
+func setPartStat(attendee *Property, status string) {
+	if attendee.Params == nil {
+		attendee.Params = make(map[string][]string)
+	}
+	attendee.Params["PARTSTAT"] = []string{status}
+}
+
+func copyParams(params map[string][]string) map[string][]string {
+	result := make(map[string][]string, len(params))
+	for name, values := range params {
+		result[name] = append([]string{}, values...)
+	}
+	return result
+}
@@ -27,10 +27,16 @@ package main
 
 import (
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
+	policy "git.semlanik.org/semlanik/gostfix/policy"
 	sasl "git.semlanik.org/semlanik/gostfix/sasl"
 	scanner "git.semlanik.org/semlanik/gostfix/scanner"
 	web "git.semlanik.org/semlanik/gostfix/web"
+	webhook "git.semlanik.org/semlanik/gostfix/webhook"
+	webpush "git.semlanik.org/semlanik/gostfix/webpush"
 	"github.com/pkg/profile"
 )
 
@@ -38,6 +44,9 @@ type GofixEngine struct {
 	scanner *scanner.MailScanner
 	web     *web.Server
 	sasl    *sasl.SaslServer
+	policy  *policy.PolicyServer
+	webhook *webhook.WebhookNotifier
+	push    *webpush.PushNotifier
 }
 
 func NewGofixEngine() (e *GofixEngine) {
@@ -47,19 +56,42 @@ func NewGofixEngine() (e *GofixEngine) {
 	if err != nil {
 		log.Fatalf("Unable to intialize sasl server %s\n", err)
 	}
+	policyService, err := policy.NewPolicyServer()
+	if err != nil {
+		log.Fatalf("Unable to intialize policy server %s\n", err)
+	}
+	webhookNotifier, err := webhook.NewWebhookNotifier()
+	if err != nil {
+		log.Fatalf("Unable to intialize webhook notifier %s\n", err)
+	}
+	pushNotifier, err := webpush.NewPushNotifier()
+	if err != nil {
+		log.Fatalf("Unable to intialize push notifier %s\n", err)
+	}
 	e = &GofixEngine{
 		scanner: mailScanner,
 		web:     webServer,
 		sasl:    saslService,
+		policy:  policyService,
+		webhook: webhookNotifier,
+		push:    pushNotifier,
 	}
 	return
 }
 
 func (e *GofixEngine) Run() {
 	defer e.scanner.Stop()
+	defer e.sasl.Stop()
 	e.sasl.Run()
+	e.policy.Run()
+	e.webhook.Run()
+	e.push.Run()
 	e.scanner.Run()
-	e.web.Run()
+	go e.web.Run()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %s, shutting down\n", <-signals)
 }
 
 func main() {
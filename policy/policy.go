@@ -0,0 +1,249 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.semlanik.org/semlanik/gostfix/config"
+	"git.semlanik.org/semlanik/gostfix/db"
+)
+
+const (
+	ActionDunno          = "DUNNO"
+	ActionDeferIfPermit  = "DEFER_IF_PERMIT"
+	ActionDefer          = "DEFER"
+	ActionReject         = "REJECT"
+	StateRcpt            = "RCPT"
+	RequestAccessPolicy  = "smtpd_access_policy"
+	MailboxFullReason    = "4.2.2 Mailbox full"
+	MailboxFullRejection = "552 5.2.2 Mailbox full"
+	GreylistedReason     = "4.7.1 Greylisted, please try again later"
+	RateLimitReason      = "4.7.1 Sending rate limit exceeded, please try again later"
+	UnknownUserReason    = "5.1.1 Recipient address rejected: User unknown"
+	SenderMismatchReason = "5.7.1 Sender address rejected: not owned by authenticated user"
+)
+
+// policySession keeps state of the single postfix smtpd process connection.
+// Postfix sends request for every recipient of the message, so message based
+// checks are only performed once per message instance.
+type policySession struct {
+	instance string
+	action   string
+}
+
+// PolicyServer implements Postfix SMTP access policy delegation protocol
+// http://www.postfix.org/SMTPD_POLICY_README.html
+type PolicyServer struct {
+	storage *db.Storage
+}
+
+func NewPolicyServer() (*PolicyServer, error) {
+	storage, err := db.NewStorage()
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyServer{
+		storage: storage,
+	}, nil
+}
+
+func (s *PolicyServer) Run() {
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:"+config.ConfigInstance().PolicyPort)
+		if err != nil {
+			log.Fatalf("Could not start policy server: %s\n", err)
+			return
+		}
+		defer l.Close()
+
+		log.Printf("Listen policy on: %s\n", l.Addr().String())
+
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Println("Error accepting: ", err.Error())
+				continue
+			}
+			go s.handleRequest(conn)
+		}
+	}()
+}
+
+func (s *PolicyServer) handleRequest(conn net.Conn) {
+	conn.SetReadDeadline(time.Time{})
+	defer conn.Close()
+
+	connectionReader := bufio.NewReader(conn)
+	session := &policySession{}
+	attributes := map[string]string{}
+	for {
+		line, err := connectionReader.ReadString('\n')
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			log.Printf("Read error %s\n", err)
+			break
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			if separator := strings.Index(line, "="); separator > 0 {
+				attributes[line[:separator]] = line[separator+1:]
+			}
+			continue
+		}
+
+		//Empty line terminates request, postfix reuses connection for next requests
+		fmt.Fprintf(conn, "action=%s\n\n", s.check(session, attributes))
+		attributes = map[string]string{}
+	}
+}
+
+func (s *PolicyServer) check(session *policySession, attributes map[string]string) string {
+	if attributes["request"] != RequestAccessPolicy || attributes["protocol_state"] != StateRcpt {
+		return ActionDunno
+	}
+
+	if action := s.checkRecipient(attributes); action != ActionDunno {
+		return action
+	}
+
+	if attributes["sasl_username"] != "" {
+		if attributes["instance"] == "" || attributes["instance"] != session.instance {
+			session.instance = attributes["instance"]
+			session.action = s.checkSubmission(attributes)
+		}
+		return session.action
+	}
+
+	//Only incoming mail from external servers is greylisted
+	recipient := strings.ToLower(attributes["recipient"])
+	if !db.IsLocalDomain(recipient[strings.LastIndex(recipient, "@")+1:]) {
+		return ActionDunno
+	}
+
+	if ip := net.ParseIP(attributes["client_address"]); ip != nil && ip.IsLoopback() {
+		return ActionDunno
+	}
+
+	return s.checkGreylist(attributes)
+}
+
+// checkSubmission verifies that authenticated user only sends mail from own
+// addresses and doesn't exceed sending rate limit
+func (s *PolicyServer) checkSubmission(attributes map[string]string) string {
+	user := attributes["sasl_username"]
+	sender := attributes["sender"]
+	if sender != "" && !s.storage.CheckSenderLogin(user, sender) {
+		log.Printf("User %s is not allowed to send mail from %s\n", user, sender)
+		return ActionReject + " " + SenderMismatchReason
+	}
+
+	limit := config.ConfigInstance().PolicyRateLimit
+	if limit > 0 && !s.storage.CheckSendRate(user, limit) {
+		log.Printf("User %s exceeded sending rate limit\n", user)
+		return ActionDefer + " " + RateLimitReason
+	}
+
+	return ActionDunno
+}
+
+// checkRecipient rejects mail to addresses that don't exist in served
+// domains and mail that doesn't fit to recipient's quota
+func (s *PolicyServer) checkRecipient(attributes map[string]string) string {
+	recipient := strings.ToLower(attributes["recipient"])
+	if !db.IsLocalDomain(recipient[strings.LastIndex(recipient, "@")+1:]) {
+		return ActionDunno
+	}
+
+	email, err := s.storage.ResolveRecipient(recipient)
+	if err != nil {
+		return ActionReject + " " + UnknownUserReason
+	}
+
+	size, _ := strconv.ParseInt(attributes["size"], 10, 64)
+	return s.checkQuota(email, size)
+}
+
+func (s *PolicyServer) checkGreylist(attributes map[string]string) string {
+	delay := config.ConfigInstance().PolicyGreylistDelay
+	if delay <= 0 {
+		return ActionDunno
+	}
+
+	if !s.storage.CheckGreylist(clientNetwork(attributes["client_address"]), strings.ToLower(attributes["sender"]), strings.ToLower(attributes["recipient"]), delay) {
+		return ActionDeferIfPermit + " " + GreylistedReason
+	}
+
+	return ActionDunno
+}
+
+// clientNetwork returns network of the client address, since big mail
+// providers usually retry delivery from other hosts of the same network
+func clientNetwork(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+func (s *PolicyServer) checkQuota(email string, size int64) string {
+	user, err := s.storage.GetEmailOwner(email)
+	if err != nil {
+		return ActionDunno
+	}
+
+	quota, err := s.storage.GetQuota(user)
+	if err != nil {
+		return ActionDunno
+	}
+
+	if !quota.Exceeds(size) {
+		return ActionDunno
+	}
+
+	log.Printf("Mail to %s is refused, mailbox is over quota\n", email)
+	if config.ConfigInstance().QuotaHardAction == config.QuotaHardActionReject {
+		return MailboxFullRejection
+	}
+	return ActionDeferIfPermit + " " + MailboxFullReason
+}
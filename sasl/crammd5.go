@@ -0,0 +1,96 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// cramMD5Mechanism implements RFC 2195 challenge-response authentication
+type cramMD5Mechanism struct {
+	authenticator Authenticator
+	hostname      string
+	pid           int
+	challenge     []byte
+	user          string
+}
+
+func newCramMD5Mechanism(s *SaslServer, service string) Mechanism {
+	return &cramMD5Mechanism{
+		authenticator: s.authenticator,
+		hostname:      s.hostname,
+		pid:           s.pid,
+	}
+}
+
+func (m *cramMD5Mechanism) Next(response []byte) ([]byte, bool, error) {
+	if m.challenge == nil {
+		if len(response) > 0 {
+			return nil, false, errInvalidMessage
+		}
+
+		nonce := uuid.New()
+		m.challenge = []byte(fmt.Sprintf("<%s.%d.%d@%s>", hex.EncodeToString(nonce[:8]), m.pid, time.Now().Unix(), m.hostname))
+		return m.challenge, false, nil
+	}
+
+	separator := bytes.LastIndexByte(response, ' ')
+	if separator <= 0 {
+		return nil, false, errInvalidMessage
+	}
+
+	m.user = string(response[:separator])
+	digest, err := hex.DecodeString(string(response[separator+1:]))
+	if err != nil {
+		return nil, false, errInvalidMessage
+	}
+
+	credentials, err := m.authenticator.GetCredentials(m.user)
+	if err != nil {
+		return nil, false, credentialsError(err)
+	}
+
+	if credentials.CramMD5 == nil {
+		return nil, false, errInvalidCredentials
+	}
+
+	expected, err := credentials.CramMD5.Digest(m.challenge)
+	if err != nil || !hmac.Equal(digest, expected) {
+		return nil, false, errInvalidCredentials
+	}
+
+	return nil, true, nil
+}
+
+func (m *cramMD5Mechanism) User() string {
+	return m.user
+}
@@ -0,0 +1,102 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package sasl
+
+import (
+	"errors"
+	"strings"
+
+	"git.semlanik.org/semlanik/gostfix/auth"
+	"git.semlanik.org/semlanik/gostfix/common"
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid user or password")
+	errInvalidMessage     = errors.New("invalid authentication message")
+)
+
+// Authenticator verifies user credentials for SASL mechanisms and tracks
+// failed authentication attempts
+type Authenticator interface {
+	CheckUser(user, password, service string) error
+	Verify(user, token string) bool
+	GetCredentials(user string) (*common.Credentials, error)
+	ScramSalt(user string) []byte
+	CheckThrottle(user, address, service string) error
+	RegisterFailure(user, address, service string)
+	RegisterSuccess(user, address string)
+}
+
+// Mechanism implements server side of the single SASL authentication exchange
+type Mechanism interface {
+	// Next handles client response and returns next server challenge. done is
+	// true once user is authenticated. response is nil if client didn't send
+	// initial response.
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// User returns authenticated user
+	User() string
+}
+
+type mechanismInfo struct {
+	name   string
+	flags  []string
+	create func(s *SaslServer, service string) Mechanism
+}
+
+var mechanisms = []*mechanismInfo{
+	{"PLAIN", []string{"plaintext"}, newPlainMechanism},
+	{"LOGIN", []string{"plaintext"}, newLoginMechanism},
+	{"CRAM-MD5", []string{"dictionary", "active"}, newCramMD5Mechanism},
+	{"SCRAM-SHA-256", []string{"mutual-auth"}, newScramMechanism},
+	{"OAUTHBEARER", []string{}, newOAuthBearerMechanism},
+}
+
+func (m *mechanismInfo) isPlaintext() bool {
+	for _, flag := range m.flags {
+		if flag == "plaintext" {
+			return true
+		}
+	}
+	return false
+}
+
+func findMechanism(name string) *mechanismInfo {
+	for _, mechanism := range mechanisms {
+		if strings.EqualFold(mechanism.name, name) {
+			return mechanism
+		}
+	}
+	return nil
+}
+
+// credentialsError hides the reason of failed verification from the client,
+// unless it's temporary failure
+func credentialsError(err error) error {
+	if err == auth.ErrTemporaryFailure {
+		return err
+	}
+	return errInvalidCredentials
+}
@@ -0,0 +1,95 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package sasl
+
+import (
+	"strings"
+)
+
+const oauthBearerError = `{"status":"invalid_token","schemes":"bearer"}`
+
+// oauthBearerMechanism implements RFC 7628 and accepts gostfix session tokens
+// as bearer tokens
+type oauthBearerMechanism struct {
+	authenticator Authenticator
+	failed        bool
+	user          string
+}
+
+func newOAuthBearerMechanism(s *SaslServer, service string) Mechanism {
+	return &oauthBearerMechanism{
+		authenticator: s.authenticator,
+	}
+}
+
+func (m *oauthBearerMechanism) Next(response []byte) ([]byte, bool, error) {
+	if m.failed {
+		//Client should finish failed exchange with dummy %x01 response
+		return nil, false, errInvalidCredentials
+	}
+
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	message := string(response)
+	separator := strings.Index(message, "\x01")
+	if separator < 0 {
+		return nil, false, errInvalidMessage
+	}
+
+	gs2Header := strings.Split(message[:separator], ",")
+	if len(gs2Header) < 2 || gs2Header[0] != "n" && gs2Header[0] != "y" {
+		return nil, false, errInvalidMessage
+	}
+
+	user := ""
+	if strings.HasPrefix(gs2Header[1], "a=") {
+		user = decodeSaslName(gs2Header[1][2:])
+	}
+
+	token := ""
+	for _, pair := range strings.Split(message[separator+1:], "\x01") {
+		if strings.HasPrefix(pair, "auth=") {
+			authValue := strings.SplitN(pair[5:], " ", 2)
+			if len(authValue) == 2 && strings.EqualFold(authValue[0], "Bearer") {
+				token = authValue[1]
+			}
+		}
+	}
+
+	m.user = user
+	if user == "" || token == "" || !m.authenticator.Verify(user, token) {
+		m.failed = true
+		return []byte(oauthBearerError), false, nil
+	}
+
+	return nil, true, nil
+}
+
+func (m *oauthBearerMechanism) User() string {
+	return m.user
+}
@@ -0,0 +1,129 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package sasl
+
+import (
+	"bytes"
+)
+
+type plainMechanism struct {
+	authenticator Authenticator
+	service       string
+	user          string
+}
+
+func newPlainMechanism(s *SaslServer, service string) Mechanism {
+	return &plainMechanism{
+		authenticator: s.authenticator,
+		service:       service,
+	}
+}
+
+func (m *plainMechanism) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	credentialList := bytes.Split(response, []byte{0})
+	if len(credentialList) != 3 {
+		return nil, false, errInvalidMessage
+	}
+
+	identity := string(credentialList[0])
+	login := string(credentialList[1])
+	password := string(credentialList[2])
+	m.user = login
+
+	//Identity "token" is used by gostfix services to authenticate with
+	//session token instead of password
+	if identity == "token" {
+		if !m.authenticator.Verify(login, password) {
+			return nil, false, errInvalidCredentials
+		}
+		return nil, true, nil
+	}
+
+	if identity != "" && identity != login {
+		return nil, false, errInvalidCredentials
+	}
+
+	if err := m.authenticator.CheckUser(login, password, m.service); err != nil {
+		return nil, false, credentialsError(err)
+	}
+	return nil, true, nil
+}
+
+func (m *plainMechanism) User() string {
+	return m.user
+}
+
+const (
+	loginStateUser = iota
+	loginStatePassword
+)
+
+type loginMechanism struct {
+	authenticator Authenticator
+	service       string
+	state         int
+	user          string
+}
+
+func newLoginMechanism(s *SaslServer, service string) Mechanism {
+	return &loginMechanism{
+		authenticator: s.authenticator,
+		service:       service,
+		state:         loginStateUser,
+	}
+}
+
+func (m *loginMechanism) Next(response []byte) ([]byte, bool, error) {
+	switch m.state {
+	case loginStateUser:
+		//Initial response contains user name if present
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+
+		if len(response) == 0 {
+			return nil, false, errInvalidMessage
+		}
+
+		m.user = string(response)
+		m.state = loginStatePassword
+		return []byte("Password:"), false, nil
+	case loginStatePassword:
+		if err := m.authenticator.CheckUser(m.user, string(response), m.service); err != nil {
+			return nil, false, credentialsError(err)
+		}
+		return nil, true, nil
+	}
+	return nil, false, errInvalidMessage
+}
+
+func (m *loginMechanism) User() string {
+	return m.user
+}
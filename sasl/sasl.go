@@ -27,17 +27,17 @@ package sasl
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/base64"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"os/user"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"git.semlanik.org/semlanik/gostfix/auth"
@@ -46,9 +46,16 @@ import (
 )
 
 type SaslServer struct {
-	pid           int
-	cuid          int
-	authenticator *auth.Authenticator
+	pid            int
+	cuid           int
+	hostname       string
+	requireSecured bool
+	authenticator  Authenticator
+	listeners      []net.Listener
+	connections    map[net.Conn]bool
+	stopped        bool
+	lock           sync.Mutex
+	wg             sync.WaitGroup
 }
 
 const (
@@ -66,51 +73,216 @@ const (
 )
 
 const (
-	ContinueStateNone = iota
-	ContinueStateCredentials
+	ProtocolMajorVersion = 1
+	ProtocolMinorVersion = 2
 )
 
+const (
+	ParamResponse        = "resp"
+	ParamService         = "service"
+	ParamLocalIp         = "lip"
+	ParamRemoteIp        = "rip"
+	ParamSecured         = "secured"
+	ParamValidClientCert = "valid-client-cert"
+	ParamUser            = "user"
+	ParamReason          = "reason"
+	ParamCode            = "code"
+	ParamTemp            = "temp"
+)
+
+const (
+	FailCodeTempFail = "temp_fail"
+)
+
+// authRequest keeps state of the single authentication request, several
+// requests with different ids may be processed on the same connection
+type authRequest struct {
+	mechanism       Mechanism
+	service         string
+	localIp         string
+	remoteIp        string
+	secured         bool
+	validClientCert bool
+}
+
 func NewSaslServer() (*SaslServer, error) {
 	authenticator, err := auth.NewAuthenticator()
 	if err != nil {
 		return nil, err
 	}
 	return &SaslServer{
-		pid:           os.Getpid(),
-		cuid:          0,
-		authenticator: authenticator,
+		pid:            os.Getpid(),
+		cuid:           0,
+		hostname:       config.ConfigInstance().MyDomain,
+		requireSecured: config.ConfigInstance().SASLRequireSecured,
+		authenticator:  authenticator,
+		connections:    map[net.Conn]bool{},
 	}, nil
 }
 
+// Run starts TCP and unix socket listeners according to configuration
 func (s *SaslServer) Run() {
-	go func() {
-		l, err := net.Listen("tcp", "127.0.0.1:"+config.ConfigInstance().SASLPort)
+	if port := config.ConfigInstance().SASLPort; port != "0" {
+		l, err := net.Listen("tcp", "127.0.0.1:"+port)
 		if err != nil {
-			log.Fatalf("Coulf not start SASL server: %s\n", err)
+			log.Fatalf("Could not start SASL server: %s\n", err)
 			return
 		}
-		defer l.Close()
+		s.serve(l)
+	}
 
-		log.Printf("Listen sasl on: %s\n", l.Addr().String())
+	if socket := config.ConfigInstance().SASLSocket; socket != "" {
+		l, err := listenUnix(socket)
+		if err != nil {
+			log.Fatalf("Could not start SASL server on unix socket: %s\n", err)
+			return
+		}
+		s.serve(l)
+	}
+}
+
+// Stop closes listeners and active connections and waits until all
+// connection handlers are finished
+func (s *SaslServer) Stop() {
+	s.lock.Lock()
+	s.stopped = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.connections {
+		conn.Close()
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+	log.Println("SASL server stopped")
+}
+
+func (s *SaslServer) serve(l net.Listener) {
+	s.lock.Lock()
+	s.listeners = append(s.listeners, l)
+	s.lock.Unlock()
+
+	log.Printf("Listen sasl on: %s\n", l.Addr().String())
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer l.Close()
 
 		for {
 			conn, err := l.Accept()
-			s.cuid++
 			if err != nil {
+				s.lock.Lock()
+				stopped := s.stopped
+				s.lock.Unlock()
+				if stopped {
+					return
+				}
 				log.Println("Error accepting: ", err.Error())
 				continue
 			}
-			go s.handleRequest(conn)
+
+			s.lock.Lock()
+			if s.stopped {
+				s.lock.Unlock()
+				conn.Close()
+				return
+			}
+			s.cuid++
+			cuid := s.cuid
+			s.connections[conn] = true
+			s.wg.Add(1)
+			s.lock.Unlock()
+
+			go func() {
+				defer s.wg.Done()
+				s.handleRequest(conn, cuid)
+
+				s.lock.Lock()
+				delete(s.connections, conn)
+				s.lock.Unlock()
+			}()
 		}
 	}()
 }
 
-func (s *SaslServer) handleRequest(conn net.Conn) {
+// listenUnix creates unix socket with configured owner and permissions.
+// Stale socket left by previous run is removed.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	//Socket file is removed once listener is closed
+	l.(*net.UnixListener).SetUnlinkOnClose(true)
+
+	uid, gid := -1, -1
+	if owner := config.ConfigInstance().SASLSocketOwner; owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	if group := config.ConfigInstance().SASLSocketGroup; group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if uid >= 0 || gid >= 0 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	if err := os.Chmod(path, config.ConfigInstance().SASLSocketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// handleRequest implements server side of Dovecot authentication protocol
+// https://doc.dovecot.org/developer_manual/design/auth_protocol/
+func (s *SaslServer) handleRequest(conn net.Conn, cuid int) {
 	conn.SetReadDeadline(time.Time{})
 	defer conn.Close()
 
+	//Server handshake is sent without waiting for the client one
+	cookieUuid := uuid.New()
+	handshake := &strings.Builder{}
+	fmt.Fprintf(handshake, "%s\t%d\t%d\n", Version, ProtocolMajorVersion, ProtocolMinorVersion)
+	for _, mechanism := range mechanisms {
+		fmt.Fprintf(handshake, "%s\n", strings.Join(append([]string{Mech, mechanism.name}, mechanism.flags...), "\t"))
+	}
+	fmt.Fprintf(handshake, "%s\t%d\n", SPid, s.pid)
+	fmt.Fprintf(handshake, "%s\t%d\n", Cuid, cuid)
+	fmt.Fprintf(handshake, "%s\t%s\n", Cookie, hex.EncodeToString(cookieUuid[:]))
+	fmt.Fprintf(handshake, "%s\n", Done)
+	if _, err := io.WriteString(conn, handshake.String()); err != nil {
+		return
+	}
+
 	connectionReader := bufio.NewReader(conn)
-	continueState := ContinueStateNone
+	versionReceived := false
+	requests := map[string]*authRequest{}
 	for {
 		fullbuf, err := connectionReader.ReadString('\n')
 
@@ -123,97 +295,196 @@ func (s *SaslServer) handleRequest(conn net.Conn) {
 			break
 		}
 
-		currentMessage := fullbuf
+		ids := strings.Split(strings.TrimRight(fullbuf, "\r\n"), "\t")
+		if !versionReceived {
+			if ids[0] != Version || len(ids) < 3 {
+				log.Printf("Invalid SASL handshake, VERSION expected\n")
+				return
+			}
 
-		ids := strings.Split(currentMessage, "\t")
-		if len(ids) < 2 {
-			break
+			if major, err := strconv.Atoi(ids[1]); err != nil || major != ProtocolMajorVersion {
+				log.Printf("Unsupported SASL protocol version %s\n", ids[1])
+				return
+			}
+			versionReceived = true
+			continue
 		}
 
 		switch ids[0] {
-		case Version:
-			if len(ids) < 3 {
-				break
+		case CPid:
+			if len(ids) < 2 {
+				return
+			}
+			log.Printf("SASL client connected, pid %s\n", ids[1])
+		case Auth:
+			if len(ids) < 3 || !checkRequestId(ids[1]) {
+				return
+			}
+			s.handleAuth(conn, requests, ids[1], ids[2], ids[3:])
+		case Cont:
+			if len(ids) < 2 || !checkRequestId(ids[1]) {
+				return
 			}
 
-			if major, err := strconv.Atoi(ids[1]); err != nil || major != 1 {
-				break
+			data := ""
+			if len(ids) > 2 {
+				data = ids[2]
 			}
+			s.handleCont(conn, requests, ids[1], data)
+		default:
+			log.Printf("Unknown SASL command %s is ignored\n", ids[0])
+		}
+	}
+}
 
-			cookieUuid := uuid.New()
-			fmt.Fprintf(conn, "%s\t%d\t%d\n", Version, 1, 2)
-			fmt.Fprintf(conn, "%s\t%s\t%s\n", Mech, "PLAIN", "plaintext")
-			fmt.Fprintf(conn, "%s\t%s\t%s\n", Mech, "LOGIN", "plaintext")
+func (s *SaslServer) handleAuth(conn net.Conn, requests map[string]*authRequest, id, mechanismName string, params []string) {
+	if _, ok := requests[id]; ok {
+		s.fail(conn, id, "", "", "duplicate request id")
+		return
+	}
 
-			fmt.Fprintf(conn, "%s\t%d\n", SPid, s.pid)
-			fmt.Fprintf(conn, "%s\t%d\n", Cuid, s.cuid)
+	mechanismInfo := findMechanism(mechanismName)
+	if mechanismInfo == nil {
+		s.fail(conn, id, "", "", "unsupported authentication mechanism")
+		return
+	}
 
-			fmt.Fprintf(conn, "%s\t%s\n", Cookie, hex.EncodeToString(cookieUuid[:]))
-			fmt.Fprintf(conn, "%s\n", Done)
-		case Auth:
-			for _, authId := range ids {
-				if strings.Index(authId, "resp=") == 0 {
-					login, err := s.checkCredentials(authId[5:])
-					if err != nil {
-						fmt.Fprintf(conn, "%s\t%s\treason=%s\n", Fail, ids[1], err.Error())
-					} else {
-						fmt.Fprintf(conn, "%s\t%s\tuser=%s\n", Ok, ids[1], login)
-					}
-					continueState = ContinueStateNone
-					continue
-				}
-			}
+	request := &authRequest{}
+	var response []byte
+	for _, param := range params {
+		key := param
+		value := ""
+		if separator := strings.Index(param, "="); separator >= 0 {
+			key = param[:separator]
+			value = unescape(param[separator+1:])
+		}
 
-			fmt.Fprintf(conn, "%s\t%s\t%s\n", Cont, ids[1], base64.StdEncoding.EncodeToString([]byte("Username:")))
-			continueState = ContinueStateCredentials
-		case Cont:
-			if len(ids) < 2 {
-				break
+		switch key {
+		case ParamService:
+			request.service = value
+		case ParamLocalIp:
+			request.localIp = value
+		case ParamRemoteIp:
+			request.remoteIp = value
+		case ParamSecured:
+			request.secured = true
+		case ParamValidClientCert:
+			request.validClientCert = true
+		case ParamResponse:
+			var err error
+			response, err = base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				s.fail(conn, id, "", "", "invalid base64 data")
+				return
 			}
+		}
+	}
 
-			if continueState == ContinueStateCredentials {
-				if len(ids) < 3 {
-					fmt.Fprintf(conn, "%s\t%s\treason=%s\n", Fail, ids[1], "invalid base64 data")
-					return
-				}
+	if s.requireSecured && mechanismInfo.isPlaintext() && !request.secured && !isLocalAddress(request.remoteIp) {
+		s.fail(conn, id, "", "", "plaintext authentication disallowed on non-secure connections")
+		return
+	}
 
-				login, err := s.checkCredentials(ids[2])
-				if err != nil {
-					fmt.Fprintf(conn, "%s\t%s\treason=%s\n", Fail, ids[1], err.Error())
-				} else {
-					fmt.Fprintf(conn, "%s\t%s\tuser=%s\n", Ok, ids[1], login)
-				}
-				continueState = ContinueStateNone
-			} else {
-				fmt.Fprintf(conn, "%s\t%s\treason=%s\n", Fail, ids[1], "invalid user or password")
-			}
-		}
+	if err := s.authenticator.CheckThrottle("", request.remoteIp, request.service); err != nil {
+		s.fail(conn, id, "", FailCodeTempFail, err.Error())
+		return
 	}
+
+	request.mechanism = mechanismInfo.create(s, request.service)
+	requests[id] = request
+	s.step(conn, requests, id, response)
 }
 
-func (s *SaslServer) checkCredentials(credentialsBase64 string) (string, error) {
-	credentials, err := base64.StdEncoding.DecodeString(credentialsBase64)
+func (s *SaslServer) handleCont(conn net.Conn, requests map[string]*authRequest, id, data string) {
+	if _, ok := requests[id]; !ok {
+		s.fail(conn, id, "", "", "unknown request id")
+		return
+	}
+
+	response, err := base64.StdEncoding.DecodeString(data)
 	if err != nil {
-		return "", errors.New("invalid base64 data")
+		delete(requests, id)
+		s.fail(conn, id, "", "", "invalid base64 data")
+		return
 	}
 
-	credentialList := bytes.Split(credentials, []byte{0})
-	if len(credentialList) < 3 {
-		return "", errors.New("invalid user or password")
+	s.step(conn, requests, id, response)
+}
+
+// step passes client response to the mechanism of the request id and sends
+// mechanism result back to the client
+func (s *SaslServer) step(conn net.Conn, requests map[string]*authRequest, id string, response []byte) {
+	request := requests[id]
+	challenge, done, err := request.mechanism.Next(response)
+	user := request.mechanism.User()
+	if done {
+		//User is known only after mechanism is done for some mechanisms
+		err = s.authenticator.CheckThrottle(user, request.remoteIp, request.service)
 	}
 
-	identity := string(credentialList[0])
-	login := string(credentialList[1])
-	password := string(credentialList[2])
-	if identity == "token" {
-		if s.authenticator.Verify(login, password) {
-			return login, nil
+	if err != nil {
+		delete(requests, id)
+		log.Printf("SASL authentication of %s failed for %s service %s: %s\n", user, request.remoteIp, request.service, err)
+		code := ""
+		switch err {
+		case auth.ErrTemporaryFailure, auth.ErrThrottled:
+			code = FailCodeTempFail
+		case errInvalidCredentials:
+			s.authenticator.RegisterFailure(user, request.remoteIp, request.service)
 		}
-	} else {
-		if err := s.authenticator.CheckUser(login, password); err == nil {
-			return login, nil
+		s.fail(conn, id, user, code, err.Error())
+		return
+	}
+
+	if done {
+		delete(requests, id)
+		s.authenticator.RegisterSuccess(user, request.remoteIp)
+		fmt.Fprintf(conn, "%s\t%s\t%s=%s\n", Ok, id, ParamUser, escape(request.mechanism.User()))
+		return
+	}
+
+	fmt.Fprintf(conn, "%s\t%s\t%s\n", Cont, id, base64.StdEncoding.EncodeToString(challenge))
+}
+
+func (s *SaslServer) fail(conn net.Conn, id, user, code, reason string) {
+	params := []string{Fail, id}
+	if user != "" {
+		params = append(params, ParamUser+"="+escape(user))
+	}
+
+	if code != "" {
+		params = append(params, ParamCode+"="+code)
+		if code == FailCodeTempFail {
+			params = append(params, ParamTemp)
 		}
 	}
 
-	return "", errors.New("invalid user or password")
+	params = append(params, ParamReason+"="+escape(reason))
+	fmt.Fprintf(conn, "%s\n", strings.Join(params, "\t"))
+}
+
+// checkRequestId verifies that request id is unsigned 32 bit number
+func checkRequestId(id string) bool {
+	_, err := strconv.ParseUint(id, 10, 32)
+	return err == nil
+}
+
+func isLocalAddress(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && ip.IsLoopback()
+}
+
+var (
+	escaper   = strings.NewReplacer("\x01", "\x011", "\t", "\x01t", "\n", "\x01n")
+	unescaper = strings.NewReplacer("\x011", "\x01", "\x01t", "\t", "\x01n", "\n")
+)
+
+// escape encodes value according to Dovecot protocol, so it doesn't contain
+// tabs and line feeds
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+func unescape(value string) string {
+	return unescaper.Replace(value)
 }
@@ -0,0 +1,535 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package sasl
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"git.semlanik.org/semlanik/gostfix/auth"
+	"git.semlanik.org/semlanik/gostfix/common"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	testUser        = "user@example.com"
+	testPassword    = "secret"
+	testAppPassword = "imappassword"
+	testToken       = "0a1b2c3d"
+	testTempUser    = "temp@example.com"
+	testSaslCuid    = 7
+	testSaslPid     = 1234
+)
+
+type testAuthenticator struct {
+	credentials *common.Credentials
+	failures    map[string]int
+}
+
+func (a *testAuthenticator) CheckUser(user, password, service string) error {
+	if user == testTempUser {
+		return auth.ErrTemporaryFailure
+	}
+
+	if user == testUser && password == testAppPassword && service == "imap" {
+		return nil
+	}
+
+	if user != testUser || password != testPassword {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+func (a *testAuthenticator) Verify(user, token string) bool {
+	return user == testUser && token == testToken
+}
+
+func (a *testAuthenticator) GetCredentials(user string) (*common.Credentials, error) {
+	if user == testTempUser {
+		return nil, auth.ErrTemporaryFailure
+	}
+
+	if user != testUser {
+		return nil, errInvalidCredentials
+	}
+	return a.credentials, nil
+}
+
+func (a *testAuthenticator) ScramSalt(user string) []byte {
+	return common.HmacSha256([]byte("test-key"), []byte(user))[:common.ScramSaltLength]
+}
+
+func (a *testAuthenticator) CheckThrottle(user, address, service string) error {
+	if a.failures[address] >= 2 {
+		return auth.ErrThrottled
+	}
+	return nil
+}
+
+func (a *testAuthenticator) RegisterFailure(user, address, service string) {
+	a.failures[address]++
+}
+
+func (a *testAuthenticator) RegisterSuccess(user, address string) {
+}
+
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newTestServer(t *testing.T) *SaslServer {
+	credentials, err := common.NewCredentials(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &SaslServer{
+		pid:           testSaslPid,
+		hostname:      "example.com",
+		authenticator: &testAuthenticator{credentials, map[string]int{}},
+	}
+}
+
+// connect starts server connection handler and reads server handshake
+func connect(t *testing.T, s *SaslServer) (*testClient, []string) {
+	clientConn, serverConn := net.Pipe()
+	go s.handleRequest(serverConn, testSaslCuid)
+
+	c := &testClient{
+		t:      t,
+		conn:   clientConn,
+		reader: bufio.NewReader(clientConn),
+	}
+
+	handshake := []string{}
+	for {
+		line := c.read()
+		handshake = append(handshake, line)
+		if line == Done {
+			break
+		}
+	}
+	return c, handshake
+}
+
+func connectAndHandshake(t *testing.T, s *SaslServer) *testClient {
+	c, _ := connect(t, s)
+	c.write("VERSION\t1\t2")
+	c.write("CPID\t42")
+	return c
+}
+
+func (c *testClient) read() string {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("Unable to read server response: %s", err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func (c *testClient) write(line string) {
+	if _, err := fmt.Fprintf(c.conn, "%s\n", line); err != nil {
+		c.t.Fatalf("Unable to write client request: %s", err)
+	}
+}
+
+func (c *testClient) expect(expected string) {
+	if line := c.read(); line != expected {
+		c.t.Fatalf("Unexpected server response %q, expected %q", line, expected)
+	}
+}
+
+// challenge reads CONT response for the request id and returns decoded data
+func (c *testClient) challenge(id string) []byte {
+	line := c.read()
+	parts := strings.Split(line, "\t")
+	if len(parts) != 3 || parts[0] != Cont || parts[1] != id {
+		c.t.Fatalf("CONT expected for %s, but %q received", id, line)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		c.t.Fatalf("Invalid challenge data %q", parts[2])
+	}
+	return data
+}
+
+func encode(data string) string {
+	return base64.StdEncoding.EncodeToString([]byte(data))
+}
+
+func TestHandshake(t *testing.T) {
+	c, handshake := connect(t, newTestServer(t))
+	defer c.conn.Close()
+
+	expected := []string{"VERSION\t1\t2"}
+	for _, mechanism := range mechanisms {
+		expected = append(expected, strings.Join(append([]string{Mech, mechanism.name}, mechanism.flags...), "\t"))
+	}
+	expected = append(expected, fmt.Sprintf("SPID\t%d", testSaslPid), fmt.Sprintf("CUID\t%d", testSaslCuid))
+
+	if len(handshake) != len(expected)+2 {
+		t.Fatalf("Unexpected handshake %q", handshake)
+	}
+
+	for i, line := range expected {
+		if handshake[i] != line {
+			t.Errorf("Unexpected handshake line %q, expected %q", handshake[i], line)
+		}
+	}
+
+	cookie := strings.Split(handshake[len(expected)], "\t")
+	if len(cookie) != 2 || cookie[0] != Cookie || len(cookie[1]) != 32 {
+		t.Errorf("Invalid cookie %q", handshake[len(expected)])
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	c, _ := connect(t, newTestServer(t))
+	defer c.conn.Close()
+
+	c.write("VERSION\t2\t0")
+	if _, err := c.reader.ReadString('\n'); err == nil {
+		t.Fatal("Connection should be closed for unsupported protocol version")
+	}
+}
+
+func TestPlain(t *testing.T) {
+	c := connectAndHandshake(t, newTestServer(t))
+	defer c.conn.Close()
+
+	c.write("AUTH\t1\tPLAIN\tservice=smtp\tnologin\tlip=127.0.0.1\trip=192.0.2.1\tresp=" + encode("\x00"+testUser+"\x00"+testPassword))
+	c.expect("OK\t1\tuser=" + testUser)
+
+	c.write("AUTH\t2\tPLAIN\tservice=smtp\tresp=" + encode(testUser+"\x00"+testUser+"\x00"+testPassword))
+	c.expect("OK\t2\tuser=" + testUser)
+
+	c.write("AUTH\t3\tPLAIN\tservice=smtp\tresp=" + encode("\x00"+testUser+"\x00wrong"))
+	c.expect("FAIL\t3\tuser=" + testUser + "\treason=invalid user or password")
+
+	c.write("AUTH\t4\tPLAIN\tservice=smtp\tresp=" + encode("token\x00"+testUser+"\x00"+testToken))
+	c.expect("OK\t4\tuser=" + testUser)
+
+	c.write("AUTH\t5\tPLAIN\tservice=smtp\tresp=" + encode("other@example.com\x00"+testUser+"\x00"+testPassword))
+	c.expect("FAIL\t5\tuser=" + testUser + "\treason=invalid user or password")
+}
+
+func TestServiceScope(t *testing.T) {
+	c := connectAndHandshake(t, newTestServer(t))
+	defer c.conn.Close()
+
+	c.write("AUTH\t1\tPLAIN\tservice=imap\tresp=" + encode("\x00"+testUser+"\x00"+testAppPassword))
+	c.expect("OK\t1\tuser=" + testUser)
+
+	c.write("AUTH\t2\tPLAIN\tservice=smtp\tresp=" + encode("\x00"+testUser+"\x00"+testAppPassword))
+	c.expect("FAIL\t2\tuser=" + testUser + "\treason=invalid user or password")
+
+	c.write("AUTH\t3\tLOGIN\tservice=imap\tresp=" + encode(testUser))
+	c.challenge("3")
+	c.write("CONT\t3\t" + encode(testAppPassword))
+	c.expect("OK\t3\tuser=" + testUser)
+}
+
+func TestPlainWithoutInitialResponse(t *testing.T) {
+	c := connectAndHandshake(t, newTestServer(t))
+	defer c.conn.Close()
+
+	c.write("AUTH\t1\tPLAIN\tservice=smtp")
+	if challenge := c.challenge("1"); len(challenge) != 0 {
+		t.Fatalf("Empty challenge expected, but %q received", challenge)
+	}
+
+	c.write("CONT\t1\t" + encode("\x00"+testUser+"\x00"+testPassword))
+	c.expect("OK\t1\tuser=" + testUser)
+}
+
+func TestLogin(t *testing.T) {
+	c := connectAndHandshake(t, newTestServer(t))
+	defer c.conn.Close()
+
+	c.write("AUTH\t1\tLOGIN\tservice=smtp")
+	if challenge := string(c.challenge("1")); challenge != "Username:" {
+		t.Fatalf("Username challenge expected, but %q received", challenge)
+	}
+
+	c.write("CONT\t1\t" + encode(testUser))
+	if challenge := string(c.challenge("1")); challenge != "Password:" {
+		t.Fatalf("Password challenge expected, but %q received", challenge)
+	}
+
+	c.write("CONT\t1\t" + encode(testPassword))
+	c.expect("OK\t1\tuser=" + testUser)
+}
+
+func TestLoginWithInitialResponse(t *testing.T) {
+	c := connectAndHandshake(t, newTestServer(t))
+	defer c.conn.Close()
+
+	c.write("AUTH\t1\tLOGIN\tservice=smtp\tresp=" + encode(testUser))
+	if challenge := string(c.challenge("1")); challenge != "Password:" {
+		t.Fatalf("Password challenge expected, but %q received", challenge)
+	}
+
+	c.write("CONT\t1\t" + encode("wrong"))
+	c.expect("FAIL\t1\tuser=" + testUser + "\treason=invalid user or password")
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	c := connectAndHandshake(t, newTestServer(t))
+	defer c.conn.Close()
+
+	c.write("AUTH\t1\tLOGIN\tservice=smtp")
+	c.challenge("1")
+	c.write("AUTH\t2\tLOGIN\tservice=smtp")
+	c.challenge("2")
+
+	c.write("CONT\t2\t" + encode(testUser))
+	c.challenge("2")
+	c.write("CONT\t1\t" + encode(testUser))
+	c.challenge("1")
+
+	c.write("CONT\t1\t" + encode("wrong"))
+	c.expect("FAIL\t1\tuser=" + testUser + "\treason=invalid user or password")
+	c.write("CONT\t2\t" + encode(testPassword))
+	c.expect("OK\t2\tuser=" + testUser)
+
+	//Finished request ids are not valid anymore
+	c.write("CONT\t2\t" + encode(testPassword))
+	c.expect("FAIL\t2\treason=unknown request id")
+}
+
+func TestInvalidRequests(t *testing.T) {
+	c := connectAndHandshake(t, newTestServer(t))
+	defer c.conn.Close()
+
+	c.write("AUTH\t1\tGSSAPI\tservice=smtp")
+	c.expect("FAIL\t1\treason=unsupported authentication mechanism")
+
+	c.write("AUTH\t2\tPLAIN\tservice=smtp\tresp=invalid!")
+	c.expect("FAIL\t2\treason=invalid base64 data")
+
+	c.write("AUTH\t3\tLOGIN\tservice=smtp")
+	c.challenge("3")
+	c.write("AUTH\t3\tLOGIN\tservice=smtp")
+	c.expect("FAIL\t3\treason=duplicate request id")
+
+	c.write("CONT\t4\t" + encode(testUser))
+	c.expect("FAIL\t4\treason=unknown request id")
+
+	//Unknown commands are ignored
+	c.write("UNKNOWN\tcommand")
+	c.write("AUTH\t5\tPLAIN\tservice=smtp\tresp=" + encode("\x00"+testUser+"\x00"+testPassword))
+	c.expect("OK\t5\tuser=" + testUser)
+
+	//Invalid request id terminates connection
+	c.write("AUTH\tid\tPLAIN\tservice=smtp")
+	if _, err := c.reader.ReadString('\n'); err == nil {
+		t.Fatal("Connection should be closed for invalid request id")
+	}
+}
+
+func TestTemporaryFailure(t *testing.T) {
+	c := connectAndHandshake(t, newTestServer(t))
+	defer c.conn.Close()
+
+	c.write("AUTH\t1\tPLAIN\tservice=smtp\tresp=" + encode("\x00"+testTempUser+"\x00"+testPassword))
+	c.expect("FAIL\t1\tuser=" + testTempUser + "\tcode=temp_fail\ttemp\treason=" + auth.ErrTemporaryFailure.Error())
+}
+
+func TestRequireSecured(t *testing.T) {
+	s := newTestServer(t)
+	s.requireSecured = true
+	c := connectAndHandshake(t, s)
+	defer c.conn.Close()
+
+	resp := "\tresp=" + encode("\x00"+testUser+"\x00"+testPassword)
+	c.write("AUTH\t1\tPLAIN\tservice=smtp\trip=192.0.2.1" + resp)
+	c.expect("FAIL\t1\treason=plaintext authentication disallowed on non-secure connections")
+
+	c.write("AUTH\t2\tPLAIN\tservice=smtp\trip=192.0.2.1\tsecured" + resp)
+	c.expect("OK\t2\tuser=" + testUser)
+
+	c.write("AUTH\t3\tPLAIN\tservice=smtp\trip=127.0.0.1" + resp)
+	c.expect("OK\t3\tuser=" + testUser)
+
+	//Challenge-response mechanisms are allowed on non-secure connections
+	c.write("AUTH\t4\tCRAM-MD5\tservice=smtp\trip=192.0.2.1")
+	c.challenge("4")
+}
+
+func TestThrottling(t *testing.T) {
+	c := connectAndHandshake(t, newTestServer(t))
+	defer c.conn.Close()
+
+	c.write("AUTH\t1\tPLAIN\tservice=smtp\trip=192.0.2.1\tresp=" + encode("\x00"+testUser+"\x00wrong"))
+	c.expect("FAIL\t1\tuser=" + testUser + "\treason=invalid user or password")
+	c.write("AUTH\t2\tLOGIN\tservice=smtp\trip=192.0.2.1\tresp=" + encode(testUser))
+	c.challenge("2")
+	c.write("CONT\t2\t" + encode("wrong"))
+	c.expect("FAIL\t2\tuser=" + testUser + "\treason=invalid user or password")
+
+	c.write("AUTH\t3\tPLAIN\tservice=smtp\trip=192.0.2.1\tresp=" + encode("\x00"+testUser+"\x00"+testPassword))
+	c.expect("FAIL\t3\tcode=temp_fail\ttemp\treason=" + auth.ErrThrottled.Error())
+
+	c.write("AUTH\t4\tPLAIN\tservice=smtp\trip=192.0.2.2\tresp=" + encode("\x00"+testUser+"\x00"+testPassword))
+	c.expect("OK\t4\tuser=" + testUser)
+}
+
+func TestCramMD5(t *testing.T) {
+	c := connectAndHandshake(t, newTestServer(t))
+	defer c.conn.Close()
+
+	for i, password := range []string{testPassword, "wrong"} {
+		id := fmt.Sprint(i + 1)
+		c.write("AUTH\t" + id + "\tCRAM-MD5\tservice=smtp")
+		challenge := c.challenge(id)
+		if !strings.HasPrefix(string(challenge), "<") || !strings.HasSuffix(string(challenge), "@example.com>") {
+			t.Fatalf("Invalid CRAM-MD5 challenge %q", challenge)
+		}
+
+		mac := hmac.New(md5.New, []byte(password))
+		mac.Write(challenge)
+		c.write("CONT\t" + id + "\t" + encode(testUser+" "+hex.EncodeToString(mac.Sum(nil))))
+		if password == testPassword {
+			c.expect("OK\t" + id + "\tuser=" + testUser)
+		} else {
+			c.expect("FAIL\t" + id + "\tuser=" + testUser + "\treason=invalid user or password")
+		}
+	}
+}
+
+func TestScramSha256(t *testing.T) {
+	s := newTestServer(t)
+	c := connectAndHandshake(t, s)
+	defer c.conn.Close()
+
+	for i, password := range []string{testPassword, "wrong"} {
+		id := fmt.Sprint(i + 1)
+		clientFirstBare := "n=" + testUser + ",r=rOprNGfwEbeRWgbNEkqO"
+		c.write("AUTH\t" + id + "\tSCRAM-SHA-256\tservice=smtp\tresp=" + encode("n,,"+clientFirstBare))
+
+		serverFirst := string(c.challenge(id))
+		attributes := parseScramAttributes(serverFirst)
+		if !strings.HasPrefix(attributes["r"], "rOprNGfwEbeRWgbNEkqO") || attributes["s"] == "" || attributes["i"] != "4096" {
+			t.Fatalf("Invalid server first message %q", serverFirst)
+		}
+
+		salt, _ := base64.StdEncoding.DecodeString(attributes["s"])
+		saltedPassword := pbkdf2.Key([]byte(password), salt, 4096, sha256.Size, sha256.New)
+		clientKey := common.HmacSha256(saltedPassword, []byte("Client Key"))
+		storedKey := sha256.Sum256(clientKey)
+
+		clientFinalWithoutProof := "c=" + encode("n,,") + ",r=" + attributes["r"]
+		authMessage := []byte(clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+		clientSignature := common.HmacSha256(storedKey[:], authMessage)
+		proof := make([]byte, len(clientKey))
+		for i := range clientKey {
+			proof[i] = clientKey[i] ^ clientSignature[i]
+		}
+
+		c.write("CONT\t" + id + "\t" + encode(clientFinalWithoutProof+",p="+base64.StdEncoding.EncodeToString(proof)))
+		if password != testPassword {
+			c.expect("FAIL\t" + id + "\tuser=" + testUser + "\treason=invalid user or password")
+			continue
+		}
+
+		serverSignature := common.HmacSha256(common.HmacSha256(saltedPassword, []byte("Server Key")), authMessage)
+		if serverFinal := string(c.challenge(id)); serverFinal != "v="+base64.StdEncoding.EncodeToString(serverSignature) {
+			t.Fatalf("Invalid server signature %q", serverFinal)
+		}
+
+		c.write("CONT\t" + id + "\t")
+		c.expect("OK\t" + id + "\tuser=" + testUser)
+	}
+
+	c.write("AUTH\t3\tSCRAM-SHA-256\tservice=smtp\tresp=" + encode("p=tls-unique,,n="+testUser+",r=abc"))
+	c.expect("FAIL\t3\treason=channel binding is not supported")
+
+	//Unknown user gets server-first message and fails at client-final only
+	unknownUser := "unknown@example.com"
+	salts := []string{}
+	for i := 0; i < 2; i++ {
+		//Separate servers, so failed attempts are not throttled
+		c := connectAndHandshake(t, newTestServer(t))
+		defer c.conn.Close()
+
+		id := fmt.Sprint(i + 4)
+		c.write("AUTH\t" + id + "\tSCRAM-SHA-256\tservice=smtp\tresp=" + encode("n,,n="+unknownUser+",r=rOprNGfwEbeRWgbNEkqO"))
+		serverFirst := string(c.challenge(id))
+		attributes := parseScramAttributes(serverFirst)
+		salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+		if !strings.HasPrefix(attributes["r"], "rOprNGfwEbeRWgbNEkqO") || err != nil || len(salt) != common.ScramSaltLength || attributes["i"] != "4096" {
+			t.Fatalf("Invalid server first message %q", serverFirst)
+		}
+		salts = append(salts, attributes["s"])
+
+		proof := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+		c.write("CONT\t" + id + "\t" + encode("c="+encode("n,,")+",r="+attributes["r"]+",p="+proof))
+		c.expect("FAIL\t" + id + "\tuser=" + unknownUser + "\treason=invalid user or password")
+	}
+
+	if salts[0] != salts[1] {
+		t.Errorf("Salt of unknown user changes between attempts %v", salts)
+	}
+}
+
+func TestOAuthBearer(t *testing.T) {
+	c := connectAndHandshake(t, newTestServer(t))
+	defer c.conn.Close()
+
+	c.write("AUTH\t1\tOAUTHBEARER\tservice=smtp\tresp=" + encode("n,a="+testUser+",\x01host=example.com\x01port=587\x01auth=Bearer "+testToken+"\x01\x01"))
+	c.expect("OK\t1\tuser=" + testUser)
+
+	c.write("AUTH\t2\tOAUTHBEARER\tservice=smtp\tresp=" + encode("n,a="+testUser+",\x01auth=Bearer invalid\x01\x01"))
+	if challenge := string(c.challenge("2")); challenge != oauthBearerError {
+		t.Fatalf("Error challenge expected, but %q received", challenge)
+	}
+
+	c.write("CONT\t2\t" + encode("\x01"))
+	c.expect("FAIL\t2\tuser=" + testUser + "\treason=invalid user or password")
+}
+
+func TestEscape(t *testing.T) {
+	value := "a\tb\nc\x01d"
+	if escape(value) != "a\x01tb\x01nc\x011d" {
+		t.Errorf("Invalid escaped value %q", escape(value))
+	}
+
+	if unescape(escape(value)) != value {
+		t.Errorf("Invalid unescaped value %q", unescape(escape(value)))
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"git.semlanik.org/semlanik/gostfix/auth"
+	"git.semlanik.org/semlanik/gostfix/common"
+	"github.com/google/uuid"
+)
+
+const (
+	scramStateClientFirst = iota
+	scramStateClientFinal
+	scramStateServerFinal
+)
+
+// scramMechanism implements SCRAM-SHA-256 as described in RFC 5802 and
+// RFC 7677. Channel binding is not supported.
+type scramMechanism struct {
+	authenticator   Authenticator
+	state           int
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	credentials     *common.ScramCredentials
+	unknownUser     bool
+	user            string
+}
+
+func newScramMechanism(s *SaslServer, service string) Mechanism {
+	return &scramMechanism{
+		authenticator: s.authenticator,
+		state:         scramStateClientFirst,
+	}
+}
+
+func (m *scramMechanism) Next(response []byte) ([]byte, bool, error) {
+	switch m.state {
+	case scramStateClientFirst:
+		if response == nil {
+			return []byte{}, false, nil
+		}
+		return m.handleClientFirst(string(response))
+	case scramStateClientFinal:
+		return m.handleClientFinal(string(response))
+	case scramStateServerFinal:
+		//Client acknowledges server signature with empty response
+		if len(response) != 0 {
+			return nil, false, errInvalidMessage
+		}
+		return nil, true, nil
+	}
+	return nil, false, errInvalidMessage
+}
+
+func (m *scramMechanism) User() string {
+	return m.user
+}
+
+func (m *scramMechanism) handleClientFirst(clientFirst string) ([]byte, bool, error) {
+	parts := strings.SplitN(clientFirst, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, errInvalidMessage
+	}
+
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return nil, false, errors.New("channel binding is not supported")
+	default:
+		return nil, false, errInvalidMessage
+	}
+
+	m.gs2Header = parts[0] + "," + parts[1] + ","
+	m.clientFirstBare = parts[2]
+
+	attributes := parseScramAttributes(m.clientFirstBare)
+	user := decodeSaslName(attributes["n"])
+	clientNonce := attributes["r"]
+	if user == "" || clientNonce == "" {
+		return nil, false, errInvalidMessage
+	}
+
+	if parts[1] != "" && decodeSaslName(strings.TrimPrefix(parts[1], "a=")) != user {
+		return nil, false, errors.New("authorization identity is not supported")
+	}
+
+	m.user = user
+	credentials, err := m.authenticator.GetCredentials(user)
+	if err == auth.ErrTemporaryFailure {
+		return nil, false, err
+	}
+
+	if err == nil && credentials.Scram != nil {
+		m.credentials = credentials.Scram
+	} else {
+		//Exchange continues with the salt derived from the user name, so
+		//client doesn't know if user exists until client-final, RFC 5802 5.1
+		m.unknownUser = true
+		m.credentials = &common.ScramCredentials{
+			Salt:       m.authenticator.ScramSalt(user),
+			Iterations: common.ScramIterations,
+			StoredKey:  make([]byte, sha256.Size),
+		}
+	}
+
+	serverNonce := uuid.New()
+	m.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce[:])
+	m.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", m.nonce, base64.StdEncoding.EncodeToString(m.credentials.Salt), m.credentials.Iterations)
+	m.state = scramStateClientFinal
+	return []byte(m.serverFirst), false, nil
+}
+
+func (m *scramMechanism) handleClientFinal(clientFinal string) ([]byte, bool, error) {
+	proofIndex := strings.LastIndex(clientFinal, ",p=")
+	if proofIndex < 0 {
+		return nil, false, errInvalidMessage
+	}
+
+	clientFinalWithoutProof := clientFinal[:proofIndex]
+	attributes := parseScramAttributes(clientFinal)
+	if attributes["c"] != base64.StdEncoding.EncodeToString([]byte(m.gs2Header)) || attributes["r"] != m.nonce {
+		return nil, false, errInvalidMessage
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(attributes["p"])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, false, errInvalidCredentials
+	}
+
+	authMessage := []byte(m.clientFirstBare + "," + m.serverFirst + "," + clientFinalWithoutProof)
+	clientSignature := common.HmacSha256(m.credentials.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], m.credentials.StoredKey) || m.unknownUser {
+		return nil, false, errInvalidCredentials
+	}
+
+	serverSignature := common.HmacSha256(m.credentials.ServerKey, authMessage)
+	m.state = scramStateServerFinal
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), false, nil
+}
+
+func parseScramAttributes(message string) map[string]string {
+	attributes := map[string]string{}
+	for _, attribute := range strings.Split(message, ",") {
+		if len(attribute) >= 2 && attribute[1] == '=' {
+			attributes[attribute[:1]] = attribute[2:]
+		}
+	}
+	return attributes
+}
+
+func decodeSaslName(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
@@ -0,0 +1,188 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package scanner
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	config "git.semlanik.org/semlanik/gostfix/config"
+	db "git.semlanik.org/semlanik/gostfix/db"
+	sender "git.semlanik.org/semlanik/gostfix/sender"
+	"github.com/google/uuid"
+)
+
+type autoResponder struct {
+	storage *db.Storage
+	sender  *sender.Sender
+}
+
+func newAutoResponder(storage *db.Storage, sender *sender.Sender) *autoResponder {
+	return &autoResponder{
+		storage: storage,
+		sender:  sender,
+	}
+}
+
+func (ar *autoResponder) process(email string, m *common.Mail) {
+	//Mail with null reverse-path is never replied, RFC 3834 section 2
+	if m.Header.NullSender {
+		return
+	}
+
+	vacation, err := ar.storage.GetVacation(email)
+	if err != nil || !vacation.IsActive(time.Now().Unix()) {
+		return
+	}
+
+	recipient := replyAddress(m)
+	if recipient == "" || strings.EqualFold(recipient, email) {
+		return
+	}
+
+	localPart := strings.ToLower(strings.Split(recipient, "@")[0])
+	if isSystemAddress(recipient) {
+		return
+	}
+
+	autoSubmitted := strings.ToLower(strings.Trim(m.Header.AutoSubmitted, " \t"))
+	if autoSubmitted != "" && autoSubmitted != "no" {
+		//Never reply to other auto-replies to avoid mail loops
+		if vacation.ExcludeAuto || strings.HasPrefix(autoSubmitted, "auto-replied") {
+			return
+		}
+	}
+
+	if vacation.ExcludeLists {
+		precedence := strings.ToLower(strings.Trim(m.Header.Precedence, " \t"))
+		if m.Header.ListId != "" || precedence == "bulk" || precedence == "list" || precedence == "junk" ||
+			strings.HasPrefix(localPart, "owner-") || strings.HasSuffix(localPart, "-request") ||
+			!isAddressedTo(m, email) {
+			return
+		}
+	}
+
+	user, err := ar.storage.GetEmailOwner(email)
+	if err != nil {
+		log.Printf("Unable to find owner of %s: %s\n", email, err)
+		return
+	}
+
+	if !ar.storage.CheckVacationReply(vacation, recipient) {
+		return
+	}
+
+	data := composeAutoReply(vacation, m, recipient)
+	go func() {
+		err := ar.sender.Send(user, "", []string{recipient}, data)
+		if err != nil {
+			log.Printf("Unable to send auto-reply from %s to %s: %s\n", email, recipient, err)
+		}
+	}()
+}
+
+// replyAddress returns address of the mail sender that automatic responses
+// are sent to. From header is used only if Return-Path is missing, mail
+// with null reverse-path has no reply address.
+func replyAddress(m *common.Mail) string {
+	if m.Header.NullSender {
+		return ""
+	}
+
+	if m.Header.ReturnPath != "" {
+		return m.Header.ReturnPath
+	}
+
+	address, err := mail.ParseAddress(m.Header.From)
+	if err != nil {
+		return ""
+	}
+	return address.Address
+}
+
+// isSystemAddress checks if address belongs to mail system or automated
+// sender that should never receive automatic responses
+func isSystemAddress(address string) bool {
+	localPart := strings.ToLower(strings.Split(address, "@")[0])
+	return localPart == "mailer-daemon" || localPart == "postmaster" || localPart == "noreply" || localPart == "no-reply"
+}
+
+func isAddressedTo(m *common.Mail, email string) bool {
+	for _, header := range []string{m.Header.To, m.Header.Cc} {
+		addresses, err := mail.ParseAddressList(header)
+		if err != nil {
+			if strings.Contains(strings.ToLower(header), strings.ToLower(email)) {
+				return true
+			}
+			continue
+		}
+
+		for _, address := range addresses {
+			if strings.EqualFold(address.Address, email) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func composeAutoReply(vacation *common.Vacation, m *common.Mail, recipient string) []byte {
+	subject := vacation.Subject
+	if subject == "" {
+		subject = "Auto: " + m.Header.Subject
+	}
+
+	return composeMail(vacation.Email, recipient, subject, "auto-replied", m.Header.MessageId, vacation.Body)
+}
+
+// composeMail creates plain text message generated by the server in response
+// to the message with inReplyTo id
+func composeMail(from, to, subject, autoSubmitted, inReplyTo, body string) []byte {
+	messageId := uuid.New()
+	builder := &strings.Builder{}
+	fmt.Fprintf(builder, "From: %s\r\n", from)
+	fmt.Fprintf(builder, "To: %s\r\n", to)
+	fmt.Fprintf(builder, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(builder, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(builder, "Message-ID: <%s@%s>\r\n", messageId.String(), config.ConfigInstance().MyDomain)
+	if inReplyTo != "" {
+		fmt.Fprintf(builder, "In-Reply-To: %s\r\n", inReplyTo)
+		fmt.Fprintf(builder, "References: %s\r\n", inReplyTo)
+	}
+	fmt.Fprintf(builder, "Auto-Submitted: %s\r\n", autoSubmitted)
+	fmt.Fprintf(builder, "X-Auto-Response-Suppress: All\r\n")
+	fmt.Fprintf(builder, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(builder, "Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	fmt.Fprintf(builder, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+	builder.WriteString(body)
+
+	return []byte(builder.String())
+}
@@ -29,10 +29,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
+	auth "git.semlanik.org/semlanik/gostfix/auth"
 	"git.semlanik.org/semlanik/gostfix/common"
 	config "git.semlanik.org/semlanik/gostfix/config"
 	db "git.semlanik.org/semlanik/gostfix/db"
+	sender "git.semlanik.org/semlanik/gostfix/sender"
 	utils "git.semlanik.org/semlanik/gostfix/utils"
 	fsnotify "github.com/fsnotify/fsnotify"
 )
@@ -45,6 +48,8 @@ type MailScanner struct {
 	watcher       *fsnotify.Watcher
 	emailMaps     map[string]string
 	storage       *db.Storage
+	sender        *sender.Sender
+	autoResponder *autoResponder
 	signalChannel chan int
 }
 
@@ -60,6 +65,12 @@ func NewMailScanner() (ms *MailScanner) {
 		return
 	}
 
+	authenticator, err := auth.NewAuthenticator()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
 	if !utils.DirectoryExists(config.ConfigInstance().AttachmentsPath) {
 		err = os.Mkdir(config.ConfigInstance().AttachmentsPath, 0755)
 		if err != nil {
@@ -68,9 +79,12 @@ func NewMailScanner() (ms *MailScanner) {
 		}
 	}
 
+	mailSender := sender.NewSender(authenticator)
 	ms = &MailScanner{
 		watcher:       watcher,
 		storage:       storage,
+		sender:        mailSender,
+		autoResponder: newAutoResponder(storage, mailSender),
 		signalChannel: make(chan int),
 	}
 
@@ -114,11 +128,7 @@ func (ms *MailScanner) reconfigure() {
 			file.Close()
 		}
 
-		mails := ms.readMailFile(mailPath)
-		for _, mail := range mails {
-			ms.storage.SaveMail(mailbox, common.Inbox, mail, false)
-		}
-		log.Printf("New email for %s, emails read %d", mailPath, len(mails))
+		ms.processMailFile(mailbox, mailPath)
 
 		err := ms.watcher.Add(mailPath)
 		if err != nil {
@@ -156,11 +166,7 @@ func (ms *MailScanner) Run() {
 					}
 
 					if mailbox != "" {
-						mails := ms.readMailFile(mailPath)
-						for _, mail := range mails {
-							ms.storage.SaveMail(mailbox, common.Inbox, mail, false)
-						}
-						log.Printf("New email for %s, emails read %d", mailPath, len(mails))
+						ms.processMailFile(mailbox, mailPath)
 					} else {
 						log.Printf("Invalid path update triggered: %s", mailPath)
 					}
@@ -180,6 +186,58 @@ func (ms *MailScanner) Stop() {
 	defer ms.watcher.Close()
 }
 
+func (ms *MailScanner) processMailFile(mailbox, mailPath string) {
+	mails := ms.readMailFile(mailPath)
+	for _, mail := range mails {
+		if !ms.checkQuota(mailbox, mail) {
+			continue
+		}
+
+		err := ms.storage.SaveMail(mailbox, ms.targetFolder(mailbox, mail), mail, false)
+		if err != nil {
+			log.Printf("Unable to save mail for %s: %s\n", mailbox, err)
+			continue
+		}
+		ms.checkQuotaWarning(mailbox)
+		ms.autoResponder.process(mailbox, mail)
+	}
+	log.Printf("New email for %s, emails read %d", mailPath, len(mails))
+}
+
+// targetFolder selects folder for the incoming mail addressed to
+// user+tag@domain subaddress in case if mailbox files such mail by tag
+func (ms *MailScanner) targetFolder(mailbox string, mail *common.Mail) string {
+	delimiter := config.ConfigInstance().RecipientDelimiter
+	originalTo := strings.ToLower(mail.Header.OriginalTo)
+	atIndex := strings.LastIndex(originalTo, "@")
+	if delimiter == "" || atIndex < 0 {
+		return common.Inbox
+	}
+
+	localPart := originalTo[:atIndex]
+	delimiterIndex := strings.IndexAny(localPart, delimiter)
+	if delimiterIndex <= 0 || localPart[:delimiterIndex]+originalTo[atIndex:] != strings.ToLower(mailbox) {
+		return common.Inbox
+	}
+
+	tag := localPart[delimiterIndex+1:]
+	if !utils.RegExpUtilsInstance().FolderNameChecker.MatchString(tag) {
+		return common.Inbox
+	}
+
+	mailboxOptions, err := ms.storage.GetMailboxOptions(mailbox)
+	if err != nil || !mailboxOptions.FileByTag {
+		return common.Inbox
+	}
+
+	for _, folder := range []string{common.Inbox, common.Sent, common.Trash, common.Spam} {
+		if strings.EqualFold(folder, tag) {
+			return folder
+		}
+	}
+	return tag
+}
+
 func (ms *MailScanner) readMailFile(mailPath string) (mails []*common.Mail) {
 	log.Println("Read mail file")
 	defer log.Println("Exit read mail file")
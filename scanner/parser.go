@@ -41,6 +41,7 @@ import (
 
 	"git.semlanik.org/semlanik/gostfix/common"
 	"git.semlanik.org/semlanik/gostfix/config"
+	ical "git.semlanik.org/semlanik/gostfix/ical"
 	utils "git.semlanik.org/semlanik/gostfix/utils"
 	"github.com/google/uuid"
 	enmime "github.com/jhillyerd/enmime"
@@ -126,6 +127,12 @@ func parseFile(file *utils.LockedFile) []*common.Mail {
 					} else {
 						fmt.Printf("Unable to parse from email: %s", err)
 					}
+					//Null reverse-path is kept separately from missing Return-Path
+					pd.email.Header.NullSender = strings.Trim(pd.email.Header.ReturnPath, " \t") == "<>"
+					pd.email.Header.ReturnPath = strings.Trim(pd.email.Header.ReturnPath, "<> \t")
+					if pd.email.Header.To == "" {
+						pd.email.Header.To = pd.email.Header.OriginalTo
+					}
 				}
 			} else {
 				pd.parseHeader(currentText)
@@ -166,10 +173,8 @@ func (pd *parseData) parseHeader(headerRaw string) {
 			pd.previousHeader = &pd.email.Header.To
 			pd.mandatoryHeaders |= ToHeaderMask
 		case "x-original-to":
-			if pd.email.Header.To == "" {
-				pd.previousHeader = &pd.email.Header.To
-				pd.mandatoryHeaders |= ToHeaderMask
-			}
+			pd.previousHeader = &pd.email.Header.OriginalTo
+			pd.mandatoryHeaders |= ToHeaderMask
 		case "cc":
 			pd.previousHeader = &pd.email.Header.Cc
 		case "bcc":
@@ -188,6 +193,16 @@ func (pd *parseData) parseHeader(headerRaw string) {
 			} else {
 				log.Printf("Unable to parse message: %s\n", err)
 			}
+		case "message-id":
+			pd.previousHeader = &pd.email.Header.MessageId
+		case "return-path":
+			pd.previousHeader = &pd.email.Header.ReturnPath
+		case "auto-submitted":
+			pd.previousHeader = &pd.email.Header.AutoSubmitted
+		case "list-id":
+			pd.previousHeader = &pd.email.Header.ListId
+		case "precedence":
+			pd.previousHeader = &pd.email.Header.Precedence
 		case "content-transfer-encoding":
 			pd.previousHeader = &pd.contentTransferEncoding
 		case "content-type":
@@ -224,6 +239,7 @@ func (pd *parseData) parseBody() {
 
 	pd.email.Body.PlainText = en.Text
 	pd.email.Body.RichText = en.HTML
+	pd.email.Size = int64(len(en.Text) + len(en.HTML))
 
 	for _, attachment := range en.Attachments {
 		uuid := uuid.New()
@@ -238,8 +254,36 @@ func (pd *parseData) parseBody() {
 			Id:          fileName,
 			FileName:    attachment.FileName,
 			ContentType: attachment.ContentType,
+			Size:        int64(len(attachment.Content)),
 		})
+		pd.email.Size += int64(len(attachment.Content))
 		attachmentFile.Write(attachment.Content)
+		attachmentFile.Close()
+	}
+
+	pd.parseInvitation(en)
+}
+
+// parseInvitation looks for iTIP calendar part of the mail and attaches
+// meeting invitation found in it to the mail body
+func (pd *parseData) parseInvitation(en *enmime.Envelope) {
+	parts := append(append(append([]*enmime.Part{}, en.Inlines...), en.OtherParts...), en.Attachments...)
+	if en.Root != nil && en.Root.FirstChild == nil {
+		parts = append(parts, en.Root)
+	}
+
+	for _, part := range parts {
+		if strings.ToLower(part.ContentType) != "text/calendar" {
+			continue
+		}
+
+		invitation, err := ical.ParseInvitation(string(part.Content))
+		if err != nil {
+			log.Printf("Unable to parse calendar part: %s\n", err)
+			continue
+		}
+		pd.email.Body.Invitation = invitation
+		return
 	}
 }
 
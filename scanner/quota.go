@@ -0,0 +1,115 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package scanner
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	utils "git.semlanik.org/semlanik/gostfix/utils"
+)
+
+// checkQuota verifies if mail fits to the mailbox owner quota. Mail that
+// exceeds hard quota is bounced to the sender and discarded, mail with null
+// sender is discarded silently, RFC 5321 section 4.5.5
+func (ms *MailScanner) checkQuota(mailbox string, mail *common.Mail) bool {
+	user, err := ms.storage.GetEmailOwner(mailbox)
+	if err != nil {
+		return true
+	}
+
+	quota, err := ms.storage.GetQuota(user)
+	if err != nil || !quota.Exceeds(mail.Size) {
+		return true
+	}
+
+	log.Printf("Mailbox %s is over quota, mail is discarded\n", mailbox)
+	ms.storage.RemoveAttachments(mail)
+
+	if mail.Header.NullSender {
+		return false
+	}
+
+	recipient := replyAddress(mail)
+	autoSubmitted := strings.ToLower(strings.Trim(mail.Header.AutoSubmitted, " \t"))
+	if recipient == "" || isSystemAddress(recipient) || (autoSubmitted != "" && autoSubmitted != "no") {
+		return false
+	}
+
+	body := fmt.Sprintf("Your message to %s could not be delivered.\n\n"+
+		"The recipient's mailbox is full: %s of %s used.\n\n"+
+		"Original subject: %s\n", mailbox, utils.FormatSize(quota.Usage), utils.FormatSize(quota.Hard), mail.Header.Subject)
+	data := composeMail(postmasterAddress(mailbox), recipient, "Undelivered Mail Returned to Sender", "auto-replied", mail.Header.MessageId, body)
+	go func() {
+		err := ms.sender.Send(user, "", []string{recipient}, data)
+		if err != nil {
+			log.Printf("Unable to send bounce for %s to %s: %s\n", mailbox, recipient, err)
+		}
+	}()
+	return false
+}
+
+// checkQuotaWarning puts warning mail to the mailbox once soft quota is exceeded
+func (ms *MailScanner) checkQuotaWarning(mailbox string) {
+	user, err := ms.storage.GetEmailOwner(mailbox)
+	if err != nil || !ms.storage.CheckQuotaWarning(user) {
+		return
+	}
+
+	quota, err := ms.storage.GetQuota(user)
+	if err != nil {
+		return
+	}
+
+	text := fmt.Sprintf("Your mailbox is almost full: %s of %s used.\n\n"+
+		"New mail will be rejected once the mailbox is full. "+
+		"Please remove messages that you don't need anymore.\n", utils.FormatSize(quota.Usage), utils.FormatSize(quota.Hard))
+	warning := &common.Mail{
+		Header: &common.MailHeader{
+			From:          postmasterAddress(mailbox),
+			To:            mailbox,
+			Subject:       "Mailbox quota warning",
+			Date:          time.Now().Unix(),
+			AutoSubmitted: "auto-generated",
+		},
+		Body: &common.MailBody{
+			PlainText: text,
+		},
+		Size: int64(len(text)),
+	}
+
+	err = ms.storage.SaveMail(mailbox, common.Inbox, warning, false)
+	if err != nil {
+		log.Printf("Unable to save quota warning for %s: %s\n", mailbox, err)
+	}
+}
+
+func postmasterAddress(mailbox string) string {
+	return "MAILER-DAEMON" + mailbox[strings.LastIndex(mailbox, "@"):]
+}
@@ -0,0 +1,131 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+
+package sender
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/smtp"
+
+	auth "git.semlanik.org/semlanik/gostfix/auth"
+	config "git.semlanik.org/semlanik/gostfix/config"
+	utils "git.semlanik.org/semlanik/gostfix/utils"
+)
+
+type Sender struct {
+	authenticator *auth.Authenticator
+}
+
+func NewSender(authenticator *auth.Authenticator) *Sender {
+	return &Sender{
+		authenticator: authenticator,
+	}
+}
+
+// Send submits mail data to postfix on behalf of the user using temporary
+// session token
+func (s *Sender) Send(user, from string, to []string, data []byte) error {
+	token := s.authenticator.IssueToken(user)
+	defer s.authenticator.Logout(user, token)
+	return SendWithToken(user, token, from, to, data)
+}
+
+// SendWithToken submits mail data to postfix using user session token for
+// SASL authentication. Empty from is used as null envelope sender.
+func SendWithToken(user, token, from string, to []string, data []byte) error {
+	host := config.ConfigInstance().MyDomain
+	server := host + ":25"
+	auth := smtp.PlainAuth("token", user, token, host)
+
+	tlsconfig := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         host,
+	}
+
+	client, err := smtp.Dial(server)
+	if err != nil {
+		log.Printf("Dial %s \n", err)
+		return err
+	}
+	defer client.Close()
+
+	err = client.StartTLS(tlsconfig)
+	if err != nil {
+		log.Printf("StartTLS %s \n", err)
+		return err
+	}
+
+	err = client.Auth(auth)
+	if err != nil {
+		log.Printf("Auth %s \n", err)
+		return err
+	}
+
+	err = client.Mail(from)
+	if err != nil {
+		log.Printf("Mail %s \n", err)
+		return err
+	}
+
+	recipients := 0
+	for _, rcpt := range to {
+		if !utils.RegExpUtilsInstance().EmailChecker.MatchString(rcpt) {
+			log.Println("Skip email " + rcpt)
+			continue
+		}
+		err = client.Rcpt(rcpt)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		recipients++
+	}
+
+	if recipients == 0 {
+		return errors.New("No valid recipients")
+	}
+
+	mailWriter, err := client.Data()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = mailWriter.Write(data)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	err = mailWriter.Close()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return client.Quit()
+}
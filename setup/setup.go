@@ -26,16 +26,36 @@
 package setup
 
 import (
+	"log"
+	"net/http"
+	"strings"
+
 	config "git.semlanik.org/semlanik/gostfix/config"
+	utils "git.semlanik.org/semlanik/gostfix/utils"
+	sessions "github.com/gorilla/sessions"
 )
 
 type Setup struct {
-	sessionStore      *sessions.CookieStore
+	sessionStore      *utils.SessionStore
 }
 
 func NewSetup() *Setup {
+	//Setup shares session keys with web interface, setup cookies live one
+	//hour and are never sent over insecure connection if configured
+	sessionStore, err := utils.NewSessionStore(config.ConfigInstance().WebSessionKeys, config.ConfigInstance().WebSessionKeyRotation, sessions.Options{
+		Path:     "/",
+		MaxAge:   3600,
+		Secure:   config.ConfigInstance().WebSecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	if err != nil {
+		log.Fatalf("Unable to intialize session store %s", err)
+		return nil
+	}
+
 	s := &Setup{
-		sessionStore:      sessions.NewCookieStore(make([]byte, 32)),
+		sessionStore:      sessionStore,
 	}
 	return s
 }
@@ -40,6 +40,7 @@ const (
 	BoundaryRegExp      = "boundary=\"(.*)\""
 	FullNameRegExp      = "^[\\w]+[\\w ]*$"
 	EncodedStringRegExp = "=\\?.+\\?="
+	FolderNameRegExp    = "^[\\w-]{1,64}$"
 )
 
 const (
@@ -74,6 +75,7 @@ type regExpUtils struct {
 	BoundaryFinder      *regexp.Regexp
 	FullNameChecker     *regexp.Regexp
 	EncodedStringFinder *regexp.Regexp
+	FolderNameChecker   *regexp.Regexp
 }
 
 func newRegExpUtils() (*regExpUtils, error) {
@@ -137,6 +139,12 @@ func newRegExpUtils() (*regExpUtils, error) {
 		return nil, err
 	}
 
+	folderNameChecker, err := regexp.Compile(FolderNameRegExp)
+	if err != nil {
+		log.Fatalf("Invalid regexp %s\n", err)
+		return nil, err
+	}
+
 	ru := &regExpUtils{
 		MailIndicator:       mailIndicator,
 		EmailChecker:        emailChecker,
@@ -148,6 +156,7 @@ func newRegExpUtils() (*regExpUtils, error) {
 		DomainChecker:       domainChecker,
 		FullNameChecker:     fullNameChecker,
 		EncodedStringFinder: encodedString,
+		FolderNameChecker:   folderNameChecker,
 	}
 
 	return ru, nil
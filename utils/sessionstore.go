@@ -0,0 +1,254 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package utils
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sessions "github.com/gorilla/sessions"
+)
+
+const (
+	SessionAuthKeyLength       = 64
+	SessionEncryptionKeyLength = 32
+	//Number of key pairs that are kept to verify cookies signed before
+	//rotation, including the current one
+	SessionKeysToKeep = 2
+)
+
+type sessionKey struct {
+	created       int64
+	authKey       []byte
+	encryptionKey []byte
+}
+
+// SessionStore is cookie session store with signing and encryption keys
+// persisted in the file. Keys are rotated periodically, cookies signed with
+// previous keys are still accepted.
+type SessionStore struct {
+	path     string
+	rotation time.Duration
+	options  sessions.Options
+	keys     []*sessionKey
+	store    *sessions.CookieStore
+	lock     sync.RWMutex
+}
+
+// NewSessionStore loads session keys from the file at path or generates new
+// keys if the file doesn't exist. Keys are rotated every rotation interval,
+// 0 disables rotation.
+func NewSessionStore(path string, rotation time.Duration, options sessions.Options) (*SessionStore, error) {
+	s := &SessionStore{
+		path:     path,
+		rotation: rotation,
+		options:  options,
+	}
+
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s.keys) == 0 {
+		log.Printf("Session keys not found, generating new keys in %s\n", path)
+		return s, s.Rotate()
+	}
+
+	s.updateStore()
+	return s, s.rotateIfNeeded()
+}
+
+// Get returns session from the request registry, so session is decoded once
+// per request
+func (s *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *SessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.store.New(r, name)
+}
+
+func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.store.Save(r, w, session)
+}
+
+// Rotate generates new key pair that is used to sign new cookies and drops
+// the oldest key pair
+func (s *SessionStore) Rotate() error {
+	key := &sessionKey{
+		created:       time.Now().Unix(),
+		authKey:       make([]byte, SessionAuthKeyLength),
+		encryptionKey: make([]byte, SessionEncryptionKeyLength),
+	}
+
+	if _, err := rand.Read(key.authKey); err != nil {
+		return err
+	}
+
+	if _, err := rand.Read(key.encryptionKey); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := append([]*sessionKey{key}, s.keys...)
+	if len(keys) > SessionKeysToKeep {
+		keys = keys[:SessionKeysToKeep]
+	}
+
+	if err := s.save(keys); err != nil {
+		return err
+	}
+
+	s.keys = keys
+	s.updateStore()
+	return nil
+}
+
+// Run checks periodically if keys should be rotated
+func (s *SessionStore) Run() {
+	if s.rotation <= 0 {
+		return
+	}
+
+	for range time.Tick(time.Hour) {
+		if err := s.rotateIfNeeded(); err != nil {
+			log.Printf("Unable to rotate session keys: %s\n", err)
+		}
+	}
+}
+
+func (s *SessionStore) rotateIfNeeded() error {
+	s.lock.RLock()
+	created := s.keys[0].created
+	s.lock.RUnlock()
+
+	if s.rotation <= 0 || time.Since(time.Unix(created, 0)) < s.rotation {
+		return nil
+	}
+
+	log.Printf("Rotating session keys\n")
+	return s.Rotate()
+}
+
+// updateStore recreates cookie store with actual keys, must be called with
+// lock held or before store is used
+func (s *SessionStore) updateStore() {
+	keyPairs := [][]byte{}
+	for _, key := range s.keys {
+		keyPairs = append(keyPairs, key.authKey, key.encryptionKey)
+	}
+
+	store := sessions.NewCookieStore(keyPairs...)
+	options := s.options
+	store.Options = &options
+	store.MaxAge(options.MaxAge)
+	s.store = store
+}
+
+// load reads keys from the file, each line contains creation time,
+// authentication and encryption keys of single key pair, newest first
+func (s *SessionStore) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+
+		key := &sessionKey{}
+		key.created, err = strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return errors.New("Invalid session keys file " + s.path)
+		}
+
+		key.authKey, err = hex.DecodeString(fields[1])
+		if err != nil || len(key.authKey) != SessionAuthKeyLength {
+			return errors.New("Invalid session keys file " + s.path)
+		}
+
+		key.encryptionKey, err = hex.DecodeString(fields[2])
+		if err != nil || len(key.encryptionKey) != SessionEncryptionKeyLength {
+			return errors.New("Invalid session keys file " + s.path)
+		}
+		s.keys = append(s.keys, key)
+	}
+	return scanner.Err()
+}
+
+// save writes keys to the temporary file readable by owner only and
+// replaces keys file with it
+func (s *SessionStore) save(keys []*sessionKey) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		_, err = fmt.Fprintf(file, "%d %s %s\n", key.created, hex.EncodeToString(key.authKey), hex.EncodeToString(key.encryptionKey))
+		if err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
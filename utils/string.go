@@ -26,6 +26,7 @@
 package utils
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
 )
@@ -54,3 +55,18 @@ func SanitizeTags(text *string) {
 	RemoveSubString(text, "<head", "/head>")
 	RemoveSubString(text, "<style", "/style>")
 }
+
+// FormatSize returns human readable representation of size in bytes
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
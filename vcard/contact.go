@@ -0,0 +1,165 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package vcard
+
+import (
+	"strings"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	utils "git.semlanik.org/semlanik/gostfix/utils"
+)
+
+// ContactFromCard converts vCard to contact, properties that are not
+// supported by contacts and invalid emails are ignored. Contact id is taken
+// from UID.
+func ContactFromCard(card *Card) *common.Contact {
+	contact := &common.Contact{
+		Id:     strings.TrimSpace(card.Value("UID")),
+		Name:   strings.TrimSpace(card.Value("FN")),
+		Emails: []string{},
+		Notes:  card.Value("NOTE"),
+		Groups: []string{},
+	}
+
+	if contact.Name == "" {
+		if n := card.Get("N"); n != nil {
+			//N is family;given;additional;prefix;suffix
+			components := n.Components()
+			names := []string{}
+			for _, i := range []int{3, 1, 2, 0, 4} {
+				if i < len(components) && strings.TrimSpace(components[i]) != "" {
+					names = append(names, strings.TrimSpace(components[i]))
+				}
+			}
+			contact.Name = strings.Join(names, " ")
+		}
+	}
+
+	for _, email := range card.GetAll("EMAIL") {
+		address := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(email.Text(), "mailto:")))
+		if utils.RegExpUtilsInstance().EmailChecker.MatchString(address) {
+			contact.Emails = append(contact.Emails, address)
+		}
+	}
+
+	for _, categories := range card.GetAll("CATEGORIES") {
+		contact.Groups = append(contact.Groups, categories.List()...)
+	}
+	return contact
+}
+
+// CardFromContact creates version 3.0 vCard of the contact
+func CardFromContact(contact *common.Contact) *Card {
+	card := &Card{}
+	card.Add("VERSION", "3.0")
+	card.Add("PRODID", "-//gostfix//contacts//EN")
+	UpdateCard(card, contact)
+	return card
+}
+
+// CardForContact returns original vCard of the contact updated with
+// contact fields, new vCard is created if contact has no valid original
+func CardForContact(contact *common.Contact) *Card {
+	if contact.VCard != "" {
+		cards, err := Parse(strings.NewReader(contact.VCard))
+		if err == nil && len(cards) == 1 {
+			UpdateCard(cards[0], contact)
+			return cards[0]
+		}
+	}
+	return CardFromContact(contact)
+}
+
+// UpdateCard replaces properties of the card that differ from contact
+// fields, properties that are not changed keep their parameters
+func UpdateCard(card *Card, contact *common.Contact) {
+	current := ContactFromCard(card)
+	if card.Get("UID") == nil {
+		card.Add("UID", Escape(contact.Id))
+	}
+
+	if current.Name == contact.Name {
+		//FN is required, name of the contact may be derived from N
+		if card.Get("FN") == nil {
+			card.Add("FN", Escape(contact.Name))
+		}
+	} else {
+		card.Remove("FN")
+		card.Remove("N")
+		card.Add("FN", Escape(contact.Name))
+
+		//Last word of the name is used as family name
+		given := ""
+		family := strings.TrimSpace(contact.Name)
+		if space := strings.LastIndex(family, " "); space > 0 {
+			given = strings.TrimSpace(family[:space])
+			family = family[space+1:]
+		}
+		card.Add("N", Escape(family)+";"+Escape(given)+";;;")
+	}
+
+	if !equalStrings(current.Emails, contact.Emails) {
+		card.Remove("EMAIL")
+		for _, email := range contact.Emails {
+			card.Add("EMAIL", Escape(email)).Params = map[string][]string{"TYPE": {"INTERNET"}}
+		}
+	}
+
+	if current.Notes != contact.Notes {
+		card.Remove("NOTE")
+		if contact.Notes != "" {
+			card.Add("NOTE", Escape(contact.Notes))
+		}
+	}
+
+	if !equalStrings(current.Groups, contact.Groups) {
+		card.Remove("CATEGORIES")
+		if len(contact.Groups) > 0 {
+			groups := make([]string, len(contact.Groups))
+			for i, group := range contact.Groups {
+				groups[i] = Escape(group)
+			}
+			card.Add("CATEGORIES", strings.Join(groups, ","))
+		}
+	}
+
+	if contact.Updated > 0 {
+		card.Remove("REV")
+		card.Add("REV", time.Unix(contact.Updated, 0).UTC().Format("20060102T150405Z"))
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,366 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package vcard
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	maxLineLength = 75
+	maxCardSize   = 1024 * 1024
+)
+
+// Property is single content line of the vCard. Value is kept escaped as it
+// appears in vCard, so properties that are not interpreted survive round
+// trip without changes.
+type Property struct {
+	Group  string
+	Name   string
+	Params map[string][]string
+	Value  string
+}
+
+// Card is vCard object as described in RFC 6350, version 3.0 cards of
+// RFC 2426 are handled the same way
+type Card struct {
+	Properties []*Property
+}
+
+// Parse reads all vCards from r
+func Parse(r io.Reader) ([]*Card, error) {
+	lines, err := ReadLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cards []*Card
+	var card *Card
+	for _, line := range lines {
+		property, err := ParseProperty(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case property.Name == "BEGIN" && strings.EqualFold(property.Value, "VCARD"):
+			if card != nil {
+				return nil, errors.New("Nested vCard")
+			}
+			card = &Card{}
+		case property.Name == "END" && strings.EqualFold(property.Value, "VCARD"):
+			if card == nil {
+				return nil, errors.New("Unexpected end of vCard")
+			}
+			cards = append(cards, card)
+			card = nil
+		case card == nil:
+			return nil, errors.New("Property outside of vCard")
+		default:
+			card.Properties = append(card.Properties, property)
+		}
+	}
+
+	if card != nil {
+		return nil, errors.New("Unterminated vCard")
+	}
+	return cards, nil
+}
+
+// ReadLines reads unfolded content lines, empty lines are skipped. Content
+// lines of vCard and iCalendar have the same syntax.
+func ReadLines(r io.Reader) ([]string, error) {
+	reader := bufio.NewReader(io.LimitReader(r, maxCardSize))
+	lines := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			//Folded line continues previous one
+			lines[len(lines)-1] += line[1:]
+		} else if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
+
+// ParseProperty parses content line [group.]name[;param=value]:value
+func ParseProperty(line string) (*Property, error) {
+	quoted := false
+	valueStart := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			valueStart = i
+			break
+		}
+	}
+
+	if valueStart < 0 {
+		return nil, errors.New("Invalid content line " + line)
+	}
+
+	property := &Property{
+		Value: line[valueStart+1:],
+	}
+
+	params := splitQuoted(line[:valueStart], ';')
+	name := params[0]
+	if dot := strings.Index(name, "."); dot >= 0 {
+		property.Group = name[:dot]
+		name = name[dot+1:]
+	}
+	property.Name = strings.ToUpper(name)
+	if property.Name == "" {
+		return nil, errors.New("Invalid content line " + line)
+	}
+
+	for _, param := range params[1:] {
+		if property.Params == nil {
+			property.Params = make(map[string][]string)
+		}
+
+		eq := strings.Index(param, "=")
+		if eq < 0 {
+			//vCard 2.1 style parameter without name
+			property.Params["TYPE"] = append(property.Params["TYPE"], param)
+			continue
+		}
+
+		paramName := strings.ToUpper(param[:eq])
+		for _, value := range splitQuoted(param[eq+1:], ',') {
+			property.Params[paramName] = append(property.Params[paramName], strings.Trim(value, "\""))
+		}
+	}
+	return property, nil
+}
+
+func splitQuoted(s string, separator rune) []string {
+	result := []string{}
+	quoted := false
+	start := 0
+	for i, c := range s {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == separator && !quoted {
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, s[start:])
+}
+
+// Encode writes cards to w in vCard format
+func Encode(w io.Writer, cards ...*Card) error {
+	for _, card := range cards {
+		if _, err := io.WriteString(w, "BEGIN:VCARD\r\n"); err != nil {
+			return err
+		}
+		for _, property := range card.Properties {
+			if _, err := io.WriteString(w, Fold(property.String())); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, "END:VCARD\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns card in vCard format
+func (c *Card) String() string {
+	var result strings.Builder
+	Encode(&result, c)
+	return result.String()
+}
+
+// String returns content line of the property without folding
+func (p *Property) String() string {
+	var line strings.Builder
+	if p.Group != "" {
+		line.WriteString(p.Group + ".")
+	}
+	line.WriteString(p.Name)
+
+	names := make([]string, 0, len(p.Params))
+	for name := range p.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values := make([]string, len(p.Params[name]))
+		for i, value := range p.Params[name] {
+			if strings.ContainsAny(value, ":;,") {
+				value = "\"" + value + "\""
+			}
+			values[i] = value
+		}
+		line.WriteString(";" + name + "=" + strings.Join(values, ","))
+	}
+	line.WriteString(":" + p.Value)
+	return line.String()
+}
+
+// Fold splits line to lines of 75 octets, multi-byte characters are not
+// split
+func Fold(line string) string {
+	var result strings.Builder
+	length := 0
+	for _, c := range line {
+		size := len(string(c))
+		if length+size > maxLineLength {
+			result.WriteString("\r\n ")
+			length = 1
+		}
+		result.WriteRune(c)
+		length += size
+	}
+	result.WriteString("\r\n")
+	return result.String()
+}
+
+// Text returns unescaped text value of the property
+func (p *Property) Text() string {
+	return Unescape(p.Value)
+}
+
+// List returns unescaped values of comma separated property like CATEGORIES
+func (p *Property) List() []string {
+	values := []string{}
+	for _, value := range splitEscaped(p.Value, ',') {
+		if value = strings.TrimSpace(Unescape(value)); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Components returns unescaped components of structured property like N
+func (p *Property) Components() []string {
+	components := splitEscaped(p.Value, ';')
+	for i := range components {
+		components[i] = Unescape(components[i])
+	}
+	return components
+}
+
+func splitEscaped(s string, separator byte) []string {
+	result := []string{}
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == separator {
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, s[start:])
+}
+
+// Escape escapes text value
+func Escape(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "", ",", "\\,", ";", "\\;").Replace(s)
+}
+
+// Unescape unescapes text value
+func Unescape(s string) string {
+	var result strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' || s[i] == 'N' {
+				result.WriteByte('\n')
+			} else {
+				result.WriteByte(s[i])
+			}
+			continue
+		}
+		result.WriteByte(s[i])
+	}
+	return result.String()
+}
+
+// Get returns first property with name or nil
+func (c *Card) Get(name string) *Property {
+	for _, property := range c.Properties {
+		if property.Name == name {
+			return property
+		}
+	}
+	return nil
+}
+
+// GetAll returns all properties with name
+func (c *Card) GetAll(name string) []*Property {
+	properties := []*Property{}
+	for _, property := range c.Properties {
+		if property.Name == name {
+			properties = append(properties, property)
+		}
+	}
+	return properties
+}
+
+// Value returns unescaped text value of the first property with name
+func (c *Card) Value(name string) string {
+	if property := c.Get(name); property != nil {
+		return property.Text()
+	}
+	return ""
+}
+
+// Add appends property with raw value
+func (c *Card) Add(name, value string) *Property {
+	property := &Property{Name: name, Value: value}
+	c.Properties = append(c.Properties, property)
+	return property
+}
+
+// Remove removes all properties with name
+func (c *Card) Remove(name string) {
+	properties := c.Properties[:0]
+	for _, property := range c.Properties {
+		if property.Name != name {
+			properties = append(properties, property)
+		}
+	}
+	c.Properties = properties
+}
@@ -0,0 +1,153 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package vcard
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"git.semlanik.org/semlanik/gostfix/common"
+)
+
+const testCard = "BEGIN:VCARD\r\n" +
+	"VERSION:4.0\r\n" +
+	"UID:urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b1\r\n" +
+	"N:Doe;John;;Dr.;\r\n" +
+	"item1.EMAIL;TYPE=work,pref:john@example.com\r\n" +
+	"EMAIL:mailto:JOHN.DOE@example.org\r\n" +
+	"NOTE:First line\\nsecond line\\, with comma and a long text that is fold\r\n" +
+	" ed over several lines\r\n" +
+	"CATEGORIES:Friends,Work\\, colleagues\r\n" +
+	"X-CUSTOM;X-PARAM=1:unknown\r\n" +
+	"END:VCARD\r\n"
+
+func TestParse(t *testing.T) {
+	cards, err := Parse(strings.NewReader(testCard))
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+	if len(cards) != 1 {
+		t.Fatalf("Expected 1 card, got %d", len(cards))
+	}
+
+	card := cards[0]
+	email := card.Get("EMAIL")
+	if email.Group != "item1" || email.Value != "john@example.com" {
+		t.Errorf("Unexpected email property %+v", email)
+	}
+	if types := email.Params["TYPE"]; len(types) != 2 || types[0] != "work" || types[1] != "pref" {
+		t.Errorf("Unexpected email types %v", types)
+	}
+	if note := card.Value("NOTE"); note != "First line\nsecond line, with comma and a long text that is folded over several lines" {
+		t.Errorf("Unexpected note %q", note)
+	}
+
+	contact := ContactFromCard(card)
+	if contact.Id != "urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b1" {
+		t.Errorf("Unexpected id %q", contact.Id)
+	}
+	if contact.Name != "Dr. John Doe" {
+		t.Errorf("Unexpected name %q", contact.Name)
+	}
+	if len(contact.Emails) != 2 || contact.Emails[1] != "john.doe@example.org" {
+		t.Errorf("Unexpected emails %v", contact.Emails)
+	}
+	if len(contact.Groups) != 2 || contact.Groups[1] != "Work, colleagues" {
+		t.Errorf("Unexpected groups %v", contact.Groups)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, data := range []string{
+		"BEGIN:VCARD\r\nFN:John\r\n",
+		"FN:John\r\n",
+		"BEGIN:VCARD\r\nFN John\r\nEND:VCARD\r\n",
+		"BEGIN:VCARD\r\nBEGIN:VCARD\r\nEND:VCARD\r\n",
+	} {
+		if _, err := Parse(strings.NewReader(data)); err == nil {
+			t.Errorf("Expected error for %q", data)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	contact := &common.Contact{
+		Id:     "1234",
+		Name:   "John Doe; Jr.",
+		Emails: []string{"john@example.com"},
+		Notes:  strings.Repeat("Long note ", 20),
+		Groups: []string{"Friends"},
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := Encode(buffer, CardFromContact(contact)); err != nil {
+		t.Fatalf("Encode failed: %s", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(buffer.String(), "\r\n"), "\r\n") {
+		if len(line) > maxLineLength {
+			t.Errorf("Line is not folded: %q", line)
+		}
+	}
+
+	cards, err := Parse(buffer)
+	if err != nil {
+		t.Fatalf("Parse of encoded card failed: %s", err)
+	}
+	if len(cards) != 1 {
+		t.Fatalf("Expected 1 card, got %d", len(cards))
+	}
+
+	result := ContactFromCard(cards[0])
+	if result.Id != contact.Id || result.Name != contact.Name || result.Notes != contact.Notes ||
+		len(result.Emails) != 1 || result.Emails[0] != contact.Emails[0] ||
+		len(result.Groups) != 1 || result.Groups[0] != contact.Groups[0] {
+		t.Errorf("Contact changed after round trip %+v", result)
+	}
+}
+
+func TestCardForContact(t *testing.T) {
+	cards, err := Parse(strings.NewReader(testCard))
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+
+	contact := ContactFromCard(cards[0])
+	contact.VCard = cards[0].String()
+	card := CardForContact(contact)
+	if card.Get("N").Value != "Doe;John;;Dr.;" || card.Get("EMAIL").Group != "item1" || card.Value("FN") != "Dr. John Doe" {
+		t.Errorf("Unchanged contact changes vCard:\n%s", card.String())
+	}
+
+	contact.Emails = []string{"john@example.com"}
+	card = CardForContact(contact)
+	if card.Get("X-CUSTOM") == nil || card.Get("N").Value != "Doe;John;;Dr.;" {
+		t.Errorf("Unchanged properties are lost:\n%s", card.String())
+	}
+	if emails := card.GetAll("EMAIL"); len(emails) != 1 || emails[0].Value != "john@example.com" {
+		t.Errorf("Emails are not updated:\n%s", card.String())
+	}
+}
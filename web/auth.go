@@ -30,7 +30,9 @@ import (
 	template "html/template"
 	"log"
 	"net/http"
+	"time"
 
+	"git.semlanik.org/semlanik/gostfix/auth"
 	"git.semlanik.org/semlanik/gostfix/common"
 	"git.semlanik.org/semlanik/gostfix/config"
 	"git.semlanik.org/semlanik/gostfix/utils"
@@ -48,19 +50,25 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	domains := s.storage.GetRegistrationDomains()
+	if len(domains) == 0 {
+		s.error(http.StatusNotImplemented, "Registration is disabled on this server", w)
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		fmt.Fprint(w, s.templater.ExecuteRegister(&struct {
 			Version string
-			Domain  string
-		}{common.Version, config.ConfigInstance().MyDomain}))
+			Domains []string
+		}{common.Version, domains}))
 		return
 	case "POST":
 		user := r.FormValue("user")
 		password := r.FormValue("password")
 		fullName := r.FormValue("fullName")
 		if user != "" && password != "" && fullName != "" {
-			ok, email := s.checkEmail(user)
+			ok, email := s.checkEmail(user, r.FormValue("domain"))
 			if ok && len(password) < 128 && len(fullName) < 128 && utils.RegExpUtilsInstance().FullNameChecker.MatchString(fullName) {
 				err := s.storage.AddUser(email, password, fullName)
 				if err != nil {
@@ -70,7 +78,7 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 				}
 
 				s.scanner.Reconfigure()
-				token, _ := s.authenticator.Login(email, password)
+				token, _ := s.authenticator.Login(email, password, s.clientAddress(r), r.UserAgent())
 				s.login(email, token, w, r)
 				return
 			}
@@ -81,6 +89,8 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	totpStep := false
+	errorText := ""
 	switch r.Method {
 	case "GET":
 		//Check if user already logged in and entered login page accidently
@@ -89,14 +99,43 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	case "POST":
+		if code := r.FormValue("code"); code != "" {
+			//Second login step, password is already verified
+			user := s.extractTotpUser(r)
+			if user == "" {
+				errorText = "Login session expired, please enter your password again"
+				break
+			}
+
+			if err := s.authenticator.CheckTotpFrom(user, code, s.clientAddress(r)); err != nil {
+				errorText = "Invalid authentication code"
+				totpStep = true
+				break
+			}
+
+			s.setTotpUser(w, r, "")
+			s.login(user, s.authenticator.IssueWebToken(user, s.clientAddress(r), r.UserAgent()), w, r)
+			return
+		}
+
 		//Check passed in form login/password pair first
 		user := r.FormValue("user")
 		password := r.FormValue("password")
-		token, ok := s.authenticator.Login(user, password)
-		if ok {
-			s.login(user, token, w, r)
+		if err := s.authenticator.CheckUserFrom(user, password, s.clientAddress(r), auth.ServiceWeb); err != nil {
+			if err == auth.ErrThrottled {
+				errorText = err.Error()
+			}
+			break
+		}
+
+		if !s.authenticator.IsTotpEnabled(user) {
+			s.login(user, s.authenticator.IssueWebToken(user, s.clientAddress(r), r.UserAgent()), w, r)
 			return
 		}
+
+		s.logout(w, r)
+		s.setTotpUser(w, r, user)
+		totpStep = true
 	}
 
 	var signupTemplate template.HTML
@@ -107,11 +146,39 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//Otherwise make sure user logged out and show login page
-	s.logout(w, r)
+	if !totpStep {
+		s.logout(w, r)
+	}
+
 	fmt.Fprint(w, s.templater.ExecuteLogin(&struct {
 		Version string
 		Signup  template.HTML
-	}{common.Version, signupTemplate}))
+		Totp    bool
+		Error   string
+	}{common.Version, signupTemplate, totpStep, errorText}))
+}
+
+// setTotpUser remembers user that passed password verification and waits
+// for the second factor code
+func (s *Server) setTotpUser(w http.ResponseWriter, r *http.Request, user string) {
+	session, _ := s.sessionStore.Get(r, CookieSessionToken)
+	session.Values["totpUser"] = user
+	session.Values["totpTime"] = time.Now().Unix()
+	session.Save(r, w)
+}
+
+func (s *Server) extractTotpUser(r *http.Request) string {
+	session, err := s.sessionStore.Get(r, CookieSessionToken)
+	if err != nil {
+		return ""
+	}
+
+	user, _ := session.Values["totpUser"].(string)
+	totpTime, _ := session.Values["totpTime"].(int64)
+	if time.Now().Unix()-totpTime > TotpLoginTimeout {
+		return ""
+	}
+	return user
 }
 
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
@@ -121,7 +188,7 @@ func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleCheckEmail(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err == nil {
-		if ok, _ := s.checkEmail(r.FormValue("user")); ok {
+		if ok, _ := s.checkEmail(r.FormValue("user"), r.FormValue("domain")); ok {
 			w.Write([]byte{0})
 			return
 		}
@@ -132,9 +199,17 @@ func (s *Server) handleCheckEmail(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func (s *Server) checkEmail(user string) (bool, string) {
-	email := user + "@" + config.ConfigInstance().MyDomain
-	return utils.RegExpUtilsInstance().EmailChecker.MatchString(email) && !s.storage.CheckEmailExists(email), email
+func (s *Server) checkEmail(user, domain string) (bool, string) {
+	registrationAllowed := false
+	for _, registrationDomain := range s.storage.GetRegistrationDomains() {
+		if registrationDomain == domain {
+			registrationAllowed = true
+			break
+		}
+	}
+
+	email := user + "@" + domain
+	return registrationAllowed && utils.RegExpUtilsInstance().EmailChecker.MatchString(email) && !s.storage.CheckEmailExists(email), email
 }
 
 func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
@@ -150,9 +225,16 @@ func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) login(user, token string, w http.ResponseWriter, r *http.Request) {
+	//New CSRF token is issued for every login
+	session, _ := s.sessionStore.Get(r, CookieSessionToken)
+	delete(session.Values, "csrf")
+	s.saveSession(user, token, w, r)
+	http.Redirect(w, r, "/m/0", http.StatusTemporaryRedirect)
+}
+
+func (s *Server) saveSession(user, token string, w http.ResponseWriter, r *http.Request) {
 	session, _ := s.sessionStore.Get(r, CookieSessionToken)
 	session.Values["user"] = user
 	session.Values["token"] = token
 	session.Save(r, w)
-	http.Redirect(w, r, "/m/0", http.StatusTemporaryRedirect)
 }
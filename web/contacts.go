@@ -0,0 +1,193 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"git.semlanik.org/semlanik/gostfix/common"
+	"git.semlanik.org/semlanik/gostfix/vcard"
+)
+
+const (
+	autocompleteLimit = 10
+	maxContactsImport = 1024 * 1024
+)
+
+func (s *Server) handleContacts(w http.ResponseWriter, r *http.Request, user string, urlParts []string) {
+	if user == "" {
+		log.Printf("User could not be empty. Invalid usage of handleContacts")
+		panic(nil)
+	}
+
+	if len(urlParts) > 1 {
+		switch urlParts[1] {
+		case "autocomplete":
+			s.handleContactsAutocomplete(w, r, user)
+		case "export":
+			s.handleContactsExport(w, r, user)
+		case "import":
+			s.handleContactsImport(w, r, user)
+		default:
+			s.error(http.StatusNotFound, "Unknown contacts request", w)
+		}
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case "GET":
+		contacts, err := s.storage.GetContacts(user)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read contacts", w)
+			return
+		}
+
+		out, err := json.Marshal(contacts)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read contacts", w)
+			return
+		}
+		w.Write(out)
+		return
+	case "POST":
+		err = s.storage.AddContact(user, contactFromForm(r))
+	case "PATCH":
+		contact := contactFromForm(r)
+		contact.Id = r.FormValue("id")
+		err = s.storage.UpdateContact(user, contact)
+	case "DELETE":
+		err = s.storage.RemoveContact(user, r.FormValue("id"))
+	default:
+		s.error(http.StatusNotImplemented, "Invalid contacts request", w)
+		return
+	}
+
+	if err != nil {
+		log.Println(err.Error())
+		s.error(http.StatusBadRequest, "Unable to update contacts: "+err.Error(), w)
+		return
+	}
+	w.Write([]byte{0})
+}
+
+func contactFromForm(r *http.Request) *common.Contact {
+	return &common.Contact{
+		Name:   r.FormValue("name"),
+		Emails: strings.Split(r.FormValue("emails"), ","),
+		Notes:  r.FormValue("notes"),
+		Groups: strings.Split(r.FormValue("groups"), ","),
+	}
+}
+
+func (s *Server) handleContactsAutocomplete(w http.ResponseWriter, r *http.Request, user string) {
+	if r.Method != "GET" {
+		s.error(http.StatusNotImplemented, "Invalid autocomplete request", w)
+		return
+	}
+
+	addresses, err := s.storage.SearchContacts(user, r.FormValue("q"), autocompleteLimit)
+	if err != nil {
+		s.error(http.StatusInternalServerError, "Unable to search contacts", w)
+		return
+	}
+
+	out, err := json.Marshal(addresses)
+	if err != nil {
+		s.error(http.StatusInternalServerError, "Unable to search contacts", w)
+		return
+	}
+	w.Write(out)
+}
+
+func (s *Server) handleContactsExport(w http.ResponseWriter, r *http.Request, user string) {
+	if r.Method != "GET" {
+		s.error(http.StatusNotImplemented, "Invalid export request", w)
+		return
+	}
+
+	contacts, err := s.storage.GetContacts(user)
+	if err != nil {
+		s.error(http.StatusInternalServerError, "Unable to read contacts", w)
+		return
+	}
+
+	cards := make([]*vcard.Card, len(contacts))
+	for i, contact := range contacts {
+		cards[i] = vcard.CardForContact(contact)
+	}
+
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"contacts.vcf\"")
+	if err := vcard.Encode(w, cards...); err != nil {
+		log.Printf("Unable to export contacts: %s\n", err)
+	}
+}
+
+func (s *Server) handleContactsImport(w http.ResponseWriter, r *http.Request, user string) {
+	if r.Method != "POST" {
+		s.error(http.StatusNotImplemented, "Invalid import request", w)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxContactsImport)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		s.error(http.StatusBadRequest, "vCard file is not specified", w)
+		return
+	}
+	defer file.Close()
+
+	cards, err := vcard.Parse(file)
+	if err != nil {
+		log.Println(err.Error())
+		s.error(http.StatusBadRequest, "Invalid vCard file: "+err.Error(), w)
+		return
+	}
+
+	contacts := make([]*common.Contact, len(cards))
+	for i, card := range cards {
+		contacts[i] = vcard.ContactFromCard(card)
+		contacts[i].VCard = card.String()
+	}
+
+	imported, err := s.storage.ImportContacts(user, contacts)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	out, err := json.Marshal(&struct {
+		Imported int `json:"imported"`
+		Total    int `json:"total"`
+	}{imported, len(cards)})
+	if err != nil {
+		s.error(http.StatusInternalServerError, "Unable to import contacts", w)
+		return
+	}
+	w.Write(out)
+}
@@ -0,0 +1,85 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package web
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+const (
+	CsrfHeader      = "X-CSRF-Token"
+	CsrfField       = "csrfToken"
+	CsrfTokenLength = 32
+)
+
+// csrfToken returns CSRF token of the session, token is generated once per
+// session and is issued into page templates
+func (s *Server) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	session, err := s.sessionStore.Get(r, CookieSessionToken)
+	if err != nil {
+		return ""
+	}
+
+	if token, ok := session.Values["csrf"].(string); ok && token != "" {
+		return token
+	}
+
+	random := make([]byte, CsrfTokenLength)
+	if _, err := rand.Read(random); err != nil {
+		log.Printf("Unable to generate CSRF token: %s\n", err)
+		return ""
+	}
+
+	token := hex.EncodeToString(random)
+	session.Values["csrf"] = token
+	session.Save(r, w)
+	return token
+}
+
+// checkCsrf verifies that request carries CSRF token of the session in
+// header or in form field
+func (s *Server) checkCsrf(r *http.Request) bool {
+	session, err := s.sessionStore.Get(r, CookieSessionToken)
+	if err != nil {
+		return false
+	}
+
+	expected, _ := session.Values["csrf"].(string)
+	token := r.Header.Get(CsrfHeader)
+	if token == "" {
+		token = r.FormValue(CsrfField)
+	}
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// isSafeMethod checks if request method doesn't change the state, so CSRF
+// token is not required
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
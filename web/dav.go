@@ -0,0 +1,57 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package web
+
+import (
+	"net/http"
+
+	auth "git.semlanik.org/semlanik/gostfix/auth"
+)
+
+// handleDav authenticates WebDAV clients with basic authentication, users
+// with two-factor authentication enabled should use application passwords
+func (s *Server) handleDav(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		s.requestDavAuth(w)
+		return
+	}
+
+	switch err := s.authenticator.CheckUserFrom(user, password, s.clientAddress(r), auth.ServiceDav); err {
+	case nil:
+		s.dav.Handle(w, r, user)
+	case auth.ErrTemporaryFailure:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case auth.ErrThrottled:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	default:
+		s.requestDavAuth(w)
+	}
+}
+
+func (s *Server) requestDavAuth(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Basic realm=\"gostfix\", charset=\"UTF-8\"")
+	http.Error(w, "Invalid user or password", http.StatusUnauthorized)
+}
@@ -0,0 +1,264 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	template "html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	ical "git.semlanik.org/semlanik/gostfix/ical"
+	sender "git.semlanik.org/semlanik/gostfix/sender"
+	utils "git.semlanik.org/semlanik/gostfix/utils"
+	uuid "github.com/google/uuid"
+	mongo "go.mongodb.org/mongo-driver/mongo"
+)
+
+var invitationResponses = map[string]string{
+	"accept":    common.PartStatAccepted,
+	"tentative": common.PartStatTentative,
+	"decline":   common.PartStatDeclined,
+}
+
+var replySubjects = map[string]string{
+	common.PartStatAccepted:  "Accepted",
+	common.PartStatTentative: "Tentative",
+	common.PartStatDeclined:  "Declined",
+}
+
+// handleInvitation processes user's action on meeting invitation attached
+// to the mail. Invitation requests are answered with iTIP REPLY, replies
+// and cancellations update events in user's calendar.
+func (s *Server) handleInvitation(w http.ResponseWriter, r *http.Request, user, mailId string) {
+	if r.Method != "POST" {
+		s.error(http.StatusMethodNotAllowed, "Method not allowed", w)
+		return
+	}
+
+	mail, err := s.storage.GetMail(user, mailId)
+	if err != nil || mail.Mail.Body == nil || mail.Mail.Body.Invitation == nil {
+		s.error(http.StatusBadRequest, "Mail contains no invitation", w)
+		return
+	}
+
+	invitation := mail.Mail.Body.Invitation
+	calendar, err := ical.Parse(strings.NewReader(invitation.Calendar))
+	if err != nil {
+		s.error(http.StatusBadRequest, "Invalid invitation", w)
+		return
+	}
+
+	response := r.FormValue("response")
+	switch {
+	case invitation.Method == common.InvitationRequest && invitationResponses[response] != "":
+		s.handleInvitationRequest(w, r, user, mailId, mail, calendar, invitationResponses[response])
+	case invitation.Method == common.InvitationReply && response == "update":
+		s.handleInvitationUpdate(w, user, invitation, calendar)
+	case invitation.Method == common.InvitationCancel && response == "remove":
+		s.handleInvitationUpdate(w, user, invitation, calendar)
+	default:
+		s.error(http.StatusBadRequest, "Invalid invitation response", w)
+	}
+}
+
+func (s *Server) handleInvitationRequest(w http.ResponseWriter, r *http.Request, user, mailId string, mail *common.MailMetadata, calendar *ical.Component, status string) {
+	invitation := mail.Mail.Body.Invitation
+	attendee := s.invitedAttendee(user, invitation)
+	if attendee == "" {
+		s.error(http.StatusForbidden, "You are not invited to this event", w)
+		return
+	}
+
+	//Organizer is used as recipient and To header of the reply, email
+	//checker is not anchored, so separators are rejected explicitly
+	if !utils.RegExpUtilsInstance().EmailChecker.MatchString(invitation.Organizer) ||
+		strings.ContainsAny(invitation.Organizer, " \t\r\n,;<>") {
+		s.error(http.StatusBadRequest, "Invalid invitation organizer", w)
+		return
+	}
+
+	reply := ical.Reply(calendar, attendee, status)
+
+	existing, err := s.storage.GetEventByUid(user, invitation.Uid)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Printf("Unable to read event %s: %s\n", invitation.Uid, err)
+		s.error(http.StatusInternalServerError, "Unable to update calendar", w)
+		return
+	}
+
+	var existingCalendar *ical.Component
+	if existing != nil {
+		existingCalendar, _ = ical.Parse(strings.NewReader(existing.Calendar))
+	}
+
+	occurrence := ical.MainEvent(calendar).Get("RECURRENCE-ID") != nil
+	switch {
+	case status != common.PartStatDeclined:
+		ical.SetPartStat(calendar, attendee, status)
+		calendar.Remove("METHOD")
+		err = s.saveEvent(user, existing, ical.MergeEvent(existingCalendar, calendar))
+	case existing != nil && occurrence && existingCalendar != nil && ical.ApplyCancel(existingCalendar, calendar):
+		err = s.saveEvent(user, existing, existingCalendar)
+	case existing != nil:
+		err = s.storage.RemoveEvent(user, existing.Id)
+	}
+
+	if err != nil {
+		log.Printf("Unable to save event %s: %s\n", invitation.Uid, err)
+		s.error(http.StatusInternalServerError, "Unable to update calendar", w)
+		return
+	}
+
+	summary := strings.NewReplacer("\r", " ", "\n", " ").Replace(invitation.Summary)
+	rawMail := &common.Mail{
+		Header: &common.MailHeader{
+			From:    attendee,
+			To:      invitation.Organizer,
+			Date:    time.Now().Unix(),
+			Subject: replySubjects[status] + ": " + summary,
+		},
+		Body: &common.MailBody{
+			PlainText: attendee + " " + strings.ToLower(replySubjects[status]) + " invitation: " + summary,
+		},
+	}
+	rawMail.Size = int64(len(rawMail.Body.PlainText))
+
+	resultEmail := s.templater.ExecuteInvitationReply(&struct {
+		From     string
+		To       string
+		Subject  template.HTML
+		Date     template.HTML
+		Boundary string
+		Body     string
+		Calendar template.HTML
+	}{
+		From:     rawMail.Header.From,
+		To:       rawMail.Header.To,
+		Subject:  template.HTML(rawMail.Header.Subject),
+		Date:     template.HTML(time.Unix(rawMail.Header.Date, 0).Format(time.RFC1123Z)),
+		Boundary: newBoundary(),
+		Body:     rawMail.Body.PlainText,
+		Calendar: template.HTML(reply.String()),
+	})
+
+	_, token := s.extractAuth(w, r)
+	err = sender.SendWithToken(user, token, attendee, []string{invitation.Organizer}, []byte(resultEmail))
+	if err != nil {
+		s.error(http.StatusInternalServerError, "Unable to send reply", w)
+		return
+	}
+
+	s.storage.SaveMail(attendee, common.Sent, rawMail, true)
+	s.storage.UpdateMail(user, mailId, map[string]interface{}{"mail.body.invitation.status": status})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte{0})
+}
+
+// handleInvitationUpdate applies attendee reply or organizer cancellation to
+// the event stored in calendar
+func (s *Server) handleInvitationUpdate(w http.ResponseWriter, user string, invitation *common.Invitation, calendar *ical.Component) {
+	existing, err := s.storage.GetEventByUid(user, invitation.Uid)
+	if err == mongo.ErrNoDocuments {
+		s.error(http.StatusNotFound, "Event not found in calendar", w)
+		return
+	}
+
+	var existingCalendar *ical.Component
+	if err == nil {
+		existingCalendar, err = ical.Parse(strings.NewReader(existing.Calendar))
+	}
+
+	if err != nil {
+		log.Printf("Unable to read event %s: %s\n", invitation.Uid, err)
+		s.error(http.StatusInternalServerError, "Unable to update calendar", w)
+		return
+	}
+
+	if invitation.Method == common.InvitationReply {
+		if !ical.ApplyReply(existingCalendar, calendar) {
+			s.error(http.StatusBadRequest, "Reply doesn't match event attendees", w)
+			return
+		}
+		err = s.saveEvent(user, existing, existingCalendar)
+	} else if ical.ApplyCancel(existingCalendar, calendar) {
+		err = s.saveEvent(user, existing, existingCalendar)
+	} else {
+		err = s.storage.RemoveEvent(user, existing.Id)
+	}
+
+	if err != nil {
+		log.Printf("Unable to save event %s: %s\n", invitation.Uid, err)
+		s.error(http.StatusInternalServerError, "Unable to update calendar", w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte{0})
+}
+
+// saveEvent stores calendar object in user's calendar, existing event keeps
+// its id
+func (s *Server) saveEvent(user string, existing *common.CalendarEvent, calendar *ical.Component) error {
+	event, err := ical.EventFromCalendar(calendar)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		event.Id = existing.Id
+	} else {
+		event.Id = uuid.New().String()
+	}
+
+	_, err = s.storage.PutEvent(user, event)
+	return err
+}
+
+// invitedAttendee returns user's email that is invited to the event
+func (s *Server) invitedAttendee(user string, invitation *common.Invitation) string {
+	emails, err := s.storage.GetEmails(user)
+	if err != nil {
+		return ""
+	}
+
+	for _, attendee := range invitation.Attendees {
+		for _, email := range emails {
+			if strings.ToLower(email) == attendee {
+				return email
+			}
+		}
+	}
+	return ""
+}
+
+func newBoundary() string {
+	random := make([]byte, 16)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}
@@ -1,6 +1,14 @@
 const passwordRegex = /[A-Z0-6!"\#$%&'()*+,\-./:;<=>?@\[\\\]^_‘{|}~]/;
 const fullNameRegex = /^[\w]+[\w ]*$/;
 
+//Sends CSRF token of the page with every state-changing request
+$.ajaxPrefilter(function(options, originalOptions, jqXHR) {
+    var token = $('meta[name="csrf-token"]').attr('content');
+    if (token && options.type.toUpperCase() != 'GET') {
+        jqXHR.setRequestHeader('X-CSRF-Token', token);
+    }
+});
+
 function initControls() {
     $('.inpt, .password').find('.icon').mousedown(function(e) {
         if ($(e.target).parent().hasClass('password')) {
@@ -84,7 +92,8 @@ function validateEmail(name, form) {
                 $.ajax({
                 url: '/checkEmail',
                 data: {
-                    user: element.val()
+                    user: element.val(),
+                    domain: $('#domainField').val()
                 },
                 success: function(result) {
                     fieldDiv.removeClass('bad');
@@ -32,11 +32,13 @@ const emailRegex = /^(([^<>()\[\]\\.,;:\s@"]+(\.[^<>()\[\]\\.,;:\s@"]+)*)|(".+")
 const emailEndRegex = /[;,\s]/g;
 
 var folders = new Array();
-var notifierSocket = null;
 
 var toEmailList = new Array();
 var toEmailIndex = 0;
 var toEmailPreviousSelectionPosition = 0;
+var contactSuggestions = new Array();
+var contactSuggestionIndex = -1;
+var contactSuggestionTimer = null;
 
 $(window).click(function(e){
     var target = $(e.target);
@@ -55,7 +57,8 @@ $(window).click(function(e){
 $(document).ready(function(){
     $.ajaxSetup({
         global: false,
-        type: 'POST'
+        type: 'POST',
+        headers: {'X-CSRF-Token': $('meta[name="csrf-token"]').attr('content')}
     });
 
     urlPaths = $(location).attr('pathname').split('/');
@@ -71,13 +74,23 @@ $(document).ready(function(){
     loadStatusLine();
 
     $('#mailNewButton').click(mailNew);
-    connectNotifier();
+    connectNotifier('/m/' + mailbox, onNotification);
 
     $('#toEmailField').on('input', toEmailFieldChanged);
     $('#toEmailField').keydown(function(e){
         var actualText = $('#toEmailField').val();
         const selectionPosition = e.target.selectionStart;
         switch(e.keyCode) {
+            case 38:
+            case 40:
+                if (contactSuggestions.length > 0) {
+                    e.preventDefault();
+                    moveContactSuggestion(e.keyCode == 40 ? 1 : -1);
+                }
+                break;
+            case 27:
+                hideContactSuggestions();
+                break;
             case 8:
                 if (toEmailPreviousSelectionPosition == 0 && e.target.selectionStart == 0
                     && toEmailList.length > 0 && $('#toEmailList').children().length > 1) {
@@ -86,6 +99,11 @@ $(document).ready(function(){
             break;
             case 13:
             case 9:
+                if (contactSuggestionIndex >= 0) {
+                    e.preventDefault();
+                    selectContactSuggestion(contactSuggestionIndex);
+                    break;
+                }
                 addToEmail(actualText.slice(0, selectionPosition));
                 $('#toEmailField').val(actualText.slice(selectionPosition + 1, actualText.length));
                 break;
@@ -108,10 +126,80 @@ function toEmailFieldChanged(e) {
     if (emailEndRegex.test(lastChar)) {
         addToEmail(actualText.slice(0, selectionPosition));
         $('#toEmailField').val(actualText.slice(selectionPosition + 1, actualText.length));
+        return;
+    }
+
+    requestContactSuggestions();
+}
+
+function requestContactSuggestions() {
+    clearTimeout(contactSuggestionTimer);
+    var query = $('#toEmailField').val().trim();
+    if (query.length < 2) {
+        hideContactSuggestions();
+        return;
+    }
+
+    contactSuggestionTimer = setTimeout(function() {
+        $.ajax({
+            url: '/contacts/autocomplete',
+            type: 'GET',
+            data: {q: query},
+            success: function(result) {
+                if ($('#toEmailField').val().trim() != query) {
+                    return;
+                }
+                showContactSuggestions(jQuery.parseJSON(result));
+            }
+        });
+    }, 200);
+}
+
+function showContactSuggestions(addresses) {
+    var list = $('#toEmailSuggestions');
+    list.empty();
+    contactSuggestions = addresses;
+    contactSuggestionIndex = addresses.length > 0 ? 0 : -1;
+    if (addresses.length == 0) {
+        list.hide();
+        return;
+    }
+
+    for (var i = 0; i < addresses.length; i++) {
+        var text = addresses[i].name ? addresses[i].name + ' <' + addresses[i].email + '>' : addresses[i].email;
+        list.append($('<a></a>').text(text).click(i, function(e) {
+            selectContactSuggestion(e.data);
+            $('#toEmailField').focus();
+        }));
+    }
+    list.children().first().addClass('selected');
+    list.show();
+}
+
+function moveContactSuggestion(step) {
+    contactSuggestionIndex = (contactSuggestionIndex + step + contactSuggestions.length) % contactSuggestions.length;
+    $('#toEmailSuggestions').children().removeClass('selected');
+    $($('#toEmailSuggestions').children()[contactSuggestionIndex]).addClass('selected');
+}
+
+function selectContactSuggestion(index) {
+    var address = contactSuggestions[index];
+    hideContactSuggestions();
+    if (address) {
+        addToEmail(address.email);
+        $('#toEmailField').val('');
     }
 }
 
+function hideContactSuggestions() {
+    clearTimeout(contactSuggestionTimer);
+    contactSuggestions = new Array();
+    contactSuggestionIndex = -1;
+    $('#toEmailSuggestions').empty().hide();
+}
+
 function addToEmail(toEmail) {
+    hideContactSuggestions();
     if (toEmail.length <= 0) {
         return;
     }
@@ -204,6 +292,7 @@ function requestMail(mailId) {
                 $('#mail'+mailId).removeClass('unread');
                 $('#mail'+mailId).addClass('read');
                 $('#mailDetails').html(result);
+                showInvitationTime();
                 setDetailsVisible(true);
                 checkMailUnread();
             },
@@ -216,6 +305,35 @@ function requestMail(mailId) {
     }
 }
 
+function showInvitationTime() {
+    $('.invitationTime').each(function() {
+        var start = new Date($(this).data('start') * 1000);
+        var end = new Date($(this).data('end') * 1000);
+        if ($(this).data('allday') === true) {
+            //All-day events end on the next day after the last one
+            end.setTime(end.getTime() - 1000);
+            $(this).text(start.toLocaleDateString() + (end.toDateString() != start.toDateString() ? ' - ' + end.toLocaleDateString() : ''));
+        } else {
+            $(this).text(start.toLocaleString() + ' - ' + (end.toDateString() != start.toDateString() ? end.toLocaleString() : end.toLocaleTimeString()));
+        }
+    });
+}
+
+function respondInvitation(mailId, response) {
+    $.ajax({
+        url: '/mail/' + mailId + '/invitation',
+        type: 'POST',
+        data: {response: response},
+        success: function() {
+            showToast(Severity.Normal, 'Calendar is updated');
+            requestMail(mailId);
+        },
+        error: function(jqXHR, textStatus, errorThrown) {
+            showToast(Severity.Critical, 'Unable to process invitation: ' + errorThrown + ' ' + textStatus);
+        }
+    });
+}
+
 function updateFolderStat(stat) {
     var folder = stat.folder
     if (stat.unread > 0) {
@@ -286,6 +404,8 @@ function loadStatusLine() {
         url: '/m/' + mailbox + '/statusLine',
         success: function(result) {
             $('#statusLine').html(result);
+            $('#newMailFrom').html($('#sendAsOptions').html());
+            $('#newMailFromRow').css('display', $('#sendAsOptions option').length > 1 ? 'flex' : 'none');
         },
         error: function(jqXHR, textStatus, errorThrown) {
             showToast(Severity.Critical, 'Unable to load status line: ' + errorThrown + ' ' + textStatus);
@@ -553,44 +673,34 @@ function settings() {
     window.location.href = '/settings';
 }
 
-function connectNotifier() {
-    if (notifierSocket != null) {
-        return;
-    }
-
-    var protocol = window.location.protocol  !== 'https:' ? 'ws://' : 'wss://';
-    notifierSocket = new WebSocket(protocol + window.location.host + '/m/' + mailbox + '/notifierSubscribe');
-    notifierSocket.onmessage = function (ev) {
-        jsonData = JSON.parse(ev.data);
-        switch (jsonData.type) {
-        case 'mail':
-            if (currentFolder == jsonData.data.folder) {
-                $('#mailList').prepend(jsonData.data.html);
-            }
-            break;
-        case 'stats':
-            for (var i = 0; i < jsonData.data.length; i++) {
-                var folder = jsonData.data[i].folder
-                var unread = jsonData.data[i].unread
-                if (unread > 0) {
-                    $('#folderStats'+folder).text(unread);
-                    $('#folder'+folder).addClass('unread');
-                } else {
-                    $('#folder'+folder).removeClass('unread');
-                    $('#folderStats'+folder).text("");
-                }
+function onNotification(jsonData) {
+    switch (jsonData.type) {
+    case 'mail':
+        if (currentFolder == jsonData.data.folder) {
+            $('#mailList').prepend(jsonData.data.html);
+        }
+        break;
+    case 'reload':
+        //Missed notifications are unknown, e.g. event stream is resumed on
+        //other server
+        updateMailList(currentFolder, currentPage);
+        loadFolders();
+        break;
+    case 'stats':
+        for (var i = 0; i < jsonData.data.length; i++) {
+            var folder = jsonData.data[i].folder
+            var unread = jsonData.data[i].unread
+            if (unread > 0) {
+                $('#folderStats'+folder).text(unread);
+                $('#folder'+folder).addClass('unread');
+            } else {
+                $('#folder'+folder).removeClass('unread');
+                $('#folderStats'+folder).text("");
             }
         }
     }
 }
 
-$(window).on('beforeunload', function(){
-    if (notifierSocket != null) {
-        notifierSocket.close();
-        notifierSocket = null;
-    }
-});
-
 function toggleMailSelection(id) {
     var currentState = $('#mailCheckbox'+id).prop('checked')
     if (currentState) {
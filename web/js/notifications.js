@@ -37,4 +37,74 @@ function showToast(severity, text) {
         toast.removeClass('visible');
         toast.addClass('hidden');
     }, 2000);
-}
\ No newline at end of file
+}
+
+var notifierSocket = null;
+var notifierEvents = null;
+var notifierReconnectDelay = 1000;
+
+//Subscribes to live mailbox updates. Websocket is used if possible, server-sent
+//events are used if websocket connection could not be established, e.g. it's
+//blocked by proxy. Event stream resumes from the last received event itself.
+function connectNotifier(path, handler) {
+    if (notifierSocket != null || notifierEvents != null) {
+        return;
+    }
+
+    if (!window.WebSocket) {
+        connectNotifierEvents(path, handler);
+        return;
+    }
+
+    var opened = false;
+    var protocol = window.location.protocol  !== 'https:' ? 'ws://' : 'wss://';
+    notifierSocket = new WebSocket(protocol + window.location.host + path + '/notifierSubscribe');
+    notifierSocket.onopen = function() {
+        opened = true;
+        notifierReconnectDelay = 1000;
+    }
+    notifierSocket.onclose = function() {
+        if (notifierSocket == null) {
+            return;
+        }
+
+        notifierSocket = null;
+        if (!opened) {
+            connectNotifierEvents(path, handler);
+            return;
+        }
+
+        //Reconnect with growing delay, server may be restarted or network lost
+        setTimeout(function() {
+            connectNotifier(path, handler);
+        }, notifierReconnectDelay);
+        notifierReconnectDelay = Math.min(notifierReconnectDelay * 2, 60000);
+    }
+    notifierSocket.onmessage = function(ev) {
+        handler(JSON.parse(ev.data));
+    }
+}
+
+function connectNotifierEvents(path, handler) {
+    if (!window.EventSource) {
+        return;
+    }
+
+    notifierEvents = new EventSource(path + '/notifierEvents');
+    notifierEvents.onmessage = function(ev) {
+        handler(JSON.parse(ev.data));
+    }
+}
+
+$(window).on('beforeunload', function() {
+    if (notifierSocket != null) {
+        var socket = notifierSocket;
+        notifierSocket = null;
+        socket.close();
+    }
+
+    if (notifierEvents != null) {
+        notifierEvents.close();
+        notifierEvents = null;
+    }
+});
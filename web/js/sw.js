@@ -0,0 +1,33 @@
+self.addEventListener('push', function(event) {
+    var data = {}
+    if (event.data) {
+        try {
+            data = event.data.json()
+        } catch (e) {
+            return
+        }
+    }
+
+    if (data.type != 'newMail') {
+        return
+    }
+
+    event.waitUntil(self.registration.showNotification(data.from ? data.from : 'New mail', {
+        body: data.subject ? data.subject : '(no subject)',
+        icon: '/assets/logo.png',
+        tag: data.id,
+        data: {url: '/m/0'}
+    }))
+})
+
+self.addEventListener('notificationclick', function(event) {
+    event.notification.close()
+    event.waitUntil(self.clients.matchAll({type: 'window', includeUncontrolled: true}).then(function(clients) {
+        for (var i = 0; i < clients.length; i++) {
+            if (new URL(clients[i].url).pathname.startsWith('/m/')) {
+                return clients[i].focus()
+            }
+        }
+        return self.clients.openWindow(event.notification.data.url)
+    }))
+})
@@ -81,6 +81,7 @@ func (s *Server) handleMailDetails(w http.ResponseWriter, user, mailId string) {
 		Read        bool
 		Trash       bool
 		Attachments []*common.AttachmentHeader
+		Invitation  *common.Invitation
 	}{
 		From:    mail.Mail.Header.From,
 		To:      mail.Mail.Header.To,
@@ -91,6 +92,7 @@ func (s *Server) handleMailDetails(w http.ResponseWriter, user, mailId string) {
 		Trash: mail.Trash ||
 			mail.Folder == common.Trash, //TODO: Legacy for old databases remove soon
 		Attachments: mail.Mail.Body.Attachments,
+		Invitation:  mail.Mail.Body.Invitation,
 	}))
 }
 
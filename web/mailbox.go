@@ -27,7 +27,6 @@ package web
 
 import (
 	"crypto/md5"
-	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -35,25 +34,26 @@ import (
 	template "html/template"
 	"log"
 	"net/http"
-	"net/smtp"
 	"strconv"
 	"strings"
 	"time"
 
 	common "git.semlanik.org/semlanik/gostfix/common"
-	"git.semlanik.org/semlanik/gostfix/config"
-	"git.semlanik.org/semlanik/gostfix/utils"
+	sender "git.semlanik.org/semlanik/gostfix/sender"
+	utils "git.semlanik.org/semlanik/gostfix/utils"
 )
 
-func (s *Server) handleMailbox(w http.ResponseWriter, user, email string) {
+func (s *Server) handleMailbox(w http.ResponseWriter, r *http.Request, user, email string) {
 	fmt.Fprint(w, s.templater.ExecuteIndex(&struct {
-		Folders template.HTML
-		MailNew template.HTML
-		Version template.HTML
+		Folders   template.HTML
+		MailNew   template.HTML
+		Version   template.HTML
+		CsrfToken string
 	}{
-		MailNew: template.HTML(s.templater.ExecuteNewMail("")),
-		Folders: "Folders",
-		Version: common.Version,
+		MailNew:   template.HTML(s.templater.ExecuteNewMail("")),
+		Folders:   "Folders",
+		Version:   common.Version,
+		CsrfToken: s.csrfToken(w, r),
 	}))
 }
 
@@ -82,7 +82,7 @@ func (s *Server) handleMailboxRequest(w http.ResponseWriter, r *http.Request, us
 	}
 
 	if len(urlParts) < 3 {
-		s.handleMailbox(w, user, emails[mailbox])
+		s.handleMailbox(w, r, user, emails[mailbox])
 		return
 	}
 
@@ -100,14 +100,16 @@ func (s *Server) handleMailboxRequest(w http.ResponseWriter, r *http.Request, us
 	case "sendNewMail":
 		s.handleNewMail(w, r, user, emails[mailbox])
 	case "notifierSubscribe":
-		s.notifier.handleNotifierRequest(w, r, emails[mailbox])
+		s.notifier.handleNotifierRequest(w, r, user, emails[mailbox])
+	case "notifierEvents":
+		s.notifier.handleEventsRequest(w, r, user, emails[mailbox])
 	default:
 		http.Redirect(w, r, "/m/0", http.StatusTemporaryRedirect)
 	}
 }
 
 func (s *Server) handleFolders(w http.ResponseWriter, user, email string) {
-	folders := s.storage.GetFolders(email)
+	folders := s.storage.GetFolders(user, email)
 
 	var stats []interface{}
 	for _, folder := range folders {
@@ -121,7 +123,7 @@ func (s *Server) handleFolders(w http.ResponseWriter, user, email string) {
 		Stats   []interface{}    `json:"stats"`
 	}{
 		Folders: folders,
-		Html:    s.templater.ExecuteFolders(s.storage.GetFolders(email)),
+		Html:    s.templater.ExecuteFolders(folders),
 		Stats:   stats,
 	})
 
@@ -133,7 +135,7 @@ func (s *Server) handleFolders(w http.ResponseWriter, user, email string) {
 }
 
 func (s *Server) handleFolderStat(w http.ResponseWriter, r *http.Request, user, email string) {
-	stat, err := s.storage.GetEmailStats(user, email, s.extractFolder(email, r))
+	stat, err := s.storage.GetEmailStats(user, email, s.extractFolder(user, email, r))
 	if err != nil {
 		s.error(http.StatusInternalServerError, "Couldn't read mailbox stat", w)
 		return
@@ -150,7 +152,7 @@ func (s *Server) handleFolderStat(w http.ResponseWriter, r *http.Request, user,
 }
 
 func (s *Server) handleMailList(w http.ResponseWriter, r *http.Request, user, email string) {
-	folder := s.extractFolder(email, r)
+	folder := s.extractFolder(user, email, r)
 	page, err := strconv.Atoi(r.FormValue("page"))
 
 	if err != nil {
@@ -213,23 +215,43 @@ func (s *Server) handleStatusLine(w http.ResponseWriter, user, email string) {
 		return
 	}
 
+	aliases, err := s.storage.GetAliases(email)
+	if err != nil {
+		log.Printf("Unable to read aliases of %s: %s\n", email, err)
+	}
+
+	usage := ""
+	quota, err := s.storage.GetQuota(user)
+	if err == nil {
+		usage = utils.FormatSize(quota.Usage)
+		if quota.Hard > 0 {
+			usage += " of " + utils.FormatSize(quota.Hard)
+		}
+	}
+
 	emailHash := md5.Sum([]byte(strings.Trim(email, "\t ")))
 	fmt.Fprint(w, s.templater.ExecuteStatusLine(&struct {
 		Name          string
 		Email         string
 		EmailHash     string
 		EmailsIndexes []EmailIndexes
+		Aliases       []string
+		Usage         string
+		QuotaWarning  bool
 	}{
 		Name:          info.FullName,
 		Email:         email,
 		EmailHash:     hex.EncodeToString(emailHash[:]),
 		EmailsIndexes: emailsIndexes,
+		Aliases:       aliases,
+		Usage:         usage,
+		QuotaWarning:  err == nil && quota.SoftExceeded(),
 	}))
 }
 
-func (s *Server) extractFolder(email string, r *http.Request) string {
+func (s *Server) extractFolder(user, email string, r *http.Request) string {
 	folder := r.FormValue("folder")
-	folders := s.storage.GetFolders(email)
+	folders := s.storage.GetFolders(user, email)
 	ok := false
 	for _, existFolder := range folders {
 		if folder == existFolder.Name {
@@ -246,9 +268,17 @@ func (s *Server) extractFolder(email string, r *http.Request) string {
 }
 
 func (s *Server) handleNewMail(w http.ResponseWriter, r *http.Request, user, email string) {
+	from := r.FormValue("from")
+	if from == "" {
+		from = email
+	} else if from != email && !s.storage.CheckAlias(email, from) {
+		s.error(http.StatusForbidden, "You are not allowed to send mail from this address", w)
+		return
+	}
+
 	rawMail := &common.Mail{
 		Header: &common.MailHeader{
-			From:    email,
+			From:    from,
 			To:      r.FormValue("to"),
 			Cc:      r.FormValue("cc"),
 			Bcc:     r.FormValue("bcc"),
@@ -259,6 +289,7 @@ func (s *Server) handleNewMail(w http.ResponseWriter, r *http.Request, user, ema
 			PlainText: html.EscapeString(r.FormValue("body")),
 		},
 	}
+	rawMail.Size = int64(len(rawMail.Body.PlainText))
 
 	resultEmail := s.templater.ExecuteMail(&struct {
 		From    string
@@ -274,81 +305,18 @@ func (s *Server) handleNewMail(w http.ResponseWriter, r *http.Request, user, ema
 		Body:    template.HTML(rawMail.Body.PlainText),
 	})
 
-	host := config.ConfigInstance().MyDomain
-	server := host + ":25"
 	_, token := s.extractAuth(w, r)
-	auth := smtp.PlainAuth("token", user, token, host)
-
-	tlsconfig := &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         host,
-	}
-
-	client, err := smtp.Dial(server)
-	if err != nil {
-		s.error(http.StatusInternalServerError, "Unable to send message", w)
-		log.Printf("Dial %s \n", err)
-		return
-	}
-
-	err = client.StartTLS(tlsconfig)
-	if err != nil {
-		s.error(http.StatusInternalServerError, "Unable to send message", w)
-		log.Printf("StartTLS %s \n", err)
-		return
-	}
-
-	err = client.Auth(auth)
-	if err != nil {
-		s.error(http.StatusInternalServerError, "Unable to send message", w)
-		log.Printf("Auth %s \n", err)
-		return
-	}
-
-	err = client.Mail(email)
-	if err != nil {
-		s.error(http.StatusInternalServerError, "Unable to send message", w)
-		log.Printf("Mail %s \n", err)
-		return
-	}
-
 	toList := strings.Split(rawMail.Header.To, ",")
-	for _, to := range toList {
-		if !utils.RegExpUtilsInstance().EmailChecker.MatchString(to) {
-			log.Println("Skip email " + to)
-			continue
-		}
-		err = client.Rcpt(to)
-		if err != nil {
-			// s.error(http.StatusInternalServerError, "Unable to send message", w)
-			log.Println(err)
-			continue
-		}
+	for i := range toList {
+		toList[i] = strings.Trim(toList[i], " \t")
 	}
 
-	mailWriter, err := client.Data()
+	err := sender.SendWithToken(user, token, from, toList, []byte(resultEmail))
 	if err != nil {
 		s.error(http.StatusInternalServerError, "Unable to send message", w)
-		log.Println(err)
 		return
 	}
 
-	_, err = mailWriter.Write([]byte(resultEmail))
-	if err != nil {
-		s.error(http.StatusInternalServerError, "Unable to send message", w)
-		log.Println(err)
-		return
-	}
-
-	err = mailWriter.Close()
-	if err != nil {
-		s.error(http.StatusInternalServerError, "Unable to send message", w)
-		log.Println(err)
-		return
-	}
-
-	client.Quit()
-
 	s.storage.SaveMail(email, common.Sent, rawMail, true)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte{0})
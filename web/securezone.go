@@ -26,27 +26,369 @@
 package web
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"git.semlanik.org/semlanik/gostfix/auth"
 	"git.semlanik.org/semlanik/gostfix/common"
+	"git.semlanik.org/semlanik/gostfix/config"
+	"git.semlanik.org/semlanik/gostfix/utils"
+	qrcode "github.com/skip2/go-qrcode"
 )
 
-func (s *Server) handleSecureZone(w http.ResponseWriter, r *http.Request, user string) {
+func (s *Server) handleSecureZone(w http.ResponseWriter, r *http.Request, user string, urlParts []string) {
 	if user == "" {
 		log.Printf("User could not be empty. Invalid usage of handleMailRequest")
 		panic(nil)
 	}
-	s.error(http.StatusNotImplemented, "Admin panel is not implemented", w)
+
+	if len(urlParts) < 2 {
+		s.error(http.StatusNotImplemented, "Admin panel is not implemented", w)
+		return
+	}
+
+	switch urlParts[1] {
+	case "domains":
+		s.handleDomains(w, r, user)
+	case "emails":
+		s.handleDomainEmails(w, r, user)
+	case "catchAll":
+		s.handleCatchAll(w, r, user)
+	case "quota":
+		s.handleQuota(w, r, user)
+	case "authEvents":
+		s.handleAuthEvents(w, r, user)
+	case "totp":
+		s.handleTotpReset(w, r, user)
+	default:
+		s.error(http.StatusNotFound, "Unknown admin function requested", w)
+	}
 }
 
-func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request, user string) {
+func (s *Server) handleDomains(w http.ResponseWriter, r *http.Request, user string) {
+	switch r.Method {
+	case "GET":
+		domains, err := s.storage.GetDomains()
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read domains", w)
+			return
+		}
+
+		ownedDomains := []*common.DomainSettings{}
+		isAdmin := s.authenticator.CheckPrivileges(user, auth.AdminPrivilege)
+		for _, domain := range domains {
+			if isAdmin || domain.IsOwner(user) {
+				ownedDomains = append(ownedDomains, domain)
+			}
+		}
+
+		out, err := json.Marshal(ownedDomains)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read domains", w)
+			return
+		}
+		w.Write(out)
+	case "PATCH":
+		domain := r.FormValue("domain")
+		if !s.checkDomainAdmin(user, domain) {
+			s.error(http.StatusForbidden, "You are not allowed to access this function", w)
+			return
+		}
+
+		settings, err := s.storage.GetDomainSettings(domain)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read domain settings", w)
+			return
+		}
+
+		if registrationEnabled := r.FormValue("registrationEnabled"); registrationEnabled != "" {
+			settings.RegistrationEnabled = registrationEnabled == "true"
+		}
+
+		if defaultQuota := r.FormValue("defaultQuota"); defaultQuota != "" {
+			settings.DefaultQuota, err = strconv.ParseInt(defaultQuota, 10, 64)
+			if err != nil {
+				s.error(http.StatusBadRequest, "Invalid default quota", w)
+				return
+			}
+		}
+
+		if quota := r.FormValue("quota"); quota != "" {
+			settings.Quota, err = strconv.ParseInt(quota, 10, 64)
+			if err != nil {
+				s.error(http.StatusBadRequest, "Invalid domain quota", w)
+				return
+			}
+		}
+
+		if _, ok := r.Form["owners"]; ok {
+			//Only server administrators may change domain owners
+			if !s.authenticator.CheckPrivileges(user, auth.AdminPrivilege) {
+				s.error(http.StatusForbidden, "You are not allowed to access this function", w)
+				return
+			}
+
+			settings.Owners = []string{}
+			for _, owner := range strings.Split(r.FormValue("owners"), ",") {
+				owner = strings.Trim(owner, " \t")
+				if owner != "" {
+					settings.Owners = append(settings.Owners, owner)
+				}
+			}
+		}
+
+		err = s.storage.SetDomainSettings(settings)
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusBadRequest, "Unable to update domain settings", w)
+			return
+		}
+		w.Write([]byte{0})
+	default:
+		s.error(http.StatusNotImplemented, "Invalid domains request", w)
+	}
+}
+
+func (s *Server) handleDomainEmails(w http.ResponseWriter, r *http.Request, user string) {
+	email := r.FormValue("email")
+	domain := r.FormValue("domain")
+	if email != "" {
+		domain = email[strings.LastIndex(email, "@")+1:]
+	}
+
+	if !s.checkDomainAdmin(user, domain) {
+		s.error(http.StatusForbidden, "You are not allowed to access this function", w)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case "GET":
+		emails, err := s.storage.GetDomainEmails(domain)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read domain emails", w)
+			return
+		}
+
+		out, err := json.Marshal(emails)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read domain emails", w)
+			return
+		}
+		w.Write(out)
+		return
+	case "POST":
+		err = s.storage.AddEmail(r.FormValue("user"), email)
+	case "DELETE":
+		err = s.storage.RemoveEmail(r.FormValue("user"), email)
+	default:
+		s.error(http.StatusNotImplemented, "Invalid emails request", w)
+		return
+	}
+
+	if err != nil {
+		log.Println(err.Error())
+		s.error(http.StatusBadRequest, "Unable to update domain emails", w)
+		return
+	}
+
+	s.scanner.Reconfigure()
+	w.Write([]byte{0})
+}
+
+func (s *Server) handleCatchAll(w http.ResponseWriter, r *http.Request, user string) {
+	domain := r.FormValue("domain")
+	if !s.checkDomainAdmin(user, domain) {
+		s.error(http.StatusForbidden, "You are not allowed to access this function", w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		email, err := s.storage.GetCatchAll(domain)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read catch-all settings", w)
+			return
+		}
+
+		out, err := json.Marshal(&common.Alias{
+			Alias: "@" + domain,
+			Email: email,
+		})
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read catch-all settings", w)
+			return
+		}
+		w.Write(out)
+	case "PATCH":
+		email := r.FormValue("email")
+		if email != "" && !strings.HasSuffix(email, "@"+domain) {
+			s.error(http.StatusBadRequest, "Catch-all email should belong to the domain", w)
+			return
+		}
+
+		err := s.storage.SetCatchAll(domain, email)
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusBadRequest, "Unable to update catch-all settings", w)
+			return
+		}
+		w.Write([]byte{0})
+	default:
+		s.error(http.StatusNotImplemented, "Invalid catch-all request", w)
+	}
+}
+
+func (s *Server) handleQuota(w http.ResponseWriter, r *http.Request, user string) {
+	quotaUser := r.FormValue("user")
+	if !s.checkDomainAdmin(user, quotaUser[strings.LastIndex(quotaUser, "@")+1:]) {
+		s.error(http.StatusForbidden, "You are not allowed to access this function", w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		quota, err := s.storage.GetQuota(quotaUser)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read quota", w)
+			return
+		}
+
+		out, err := json.Marshal(quota)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read quota", w)
+			return
+		}
+		w.Write(out)
+	case "PATCH":
+		hard, err := strconv.ParseInt(r.FormValue("quota"), 10, 64)
+		if err != nil {
+			s.error(http.StatusBadRequest, "Invalid quota", w)
+			return
+		}
+
+		err = s.storage.SetUserQuota(quotaUser, hard)
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusBadRequest, "Unable to update quota", w)
+			return
+		}
+		w.Write([]byte{0})
+	default:
+		s.error(http.StatusNotImplemented, "Invalid quota request", w)
+	}
+}
+
+func (s *Server) handleAuthEvents(w http.ResponseWriter, r *http.Request, user string) {
+	if !s.authenticator.CheckPrivileges(user, auth.AdminPrivilege) {
+		s.error(http.StatusForbidden, "You are not allowed to access this function", w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		limit, err := strconv.ParseInt(r.FormValue("limit"), 10, 64)
+		if err != nil || limit <= 0 || limit > 1000 {
+			limit = 100
+		}
+
+		events, err := s.authenticator.GetAuthEvents(r.FormValue("user"), r.FormValue("address"), limit)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read authentication events", w)
+			return
+		}
+
+		out, err := json.Marshal(events)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read authentication events", w)
+			return
+		}
+		w.Write(out)
+	case "DELETE":
+		//Unlocks the user or address that was locked because of failed logins
+		if r.FormValue("user") == "" && r.FormValue("address") == "" {
+			s.error(http.StatusBadRequest, "User or address should be specified", w)
+			return
+		}
+
+		err := s.authenticator.ResetFailures(r.FormValue("user"), r.FormValue("address"))
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusInternalServerError, "Unable to reset login failures", w)
+			return
+		}
+		w.Write([]byte{0})
+	default:
+		s.error(http.StatusNotImplemented, "Invalid authentication events request", w)
+	}
+}
+
+func (s *Server) handleTotpReset(w http.ResponseWriter, r *http.Request, user string) {
+	totpUser := r.FormValue("user")
+	if !s.checkDomainAdmin(user, totpUser[strings.LastIndex(totpUser, "@")+1:]) {
+		s.error(http.StatusForbidden, "You are not allowed to access this function", w)
+		return
+	}
+
+	if r.Method != "DELETE" {
+		s.error(http.StatusNotImplemented, "Invalid two-factor authentication request", w)
+		return
+	}
+
+	err := s.authenticator.ResetTotp(totpUser)
+	if err != nil {
+		log.Println(err.Error())
+		s.error(http.StatusInternalServerError, "Unable to reset two-factor authentication", w)
+		return
+	}
+	w.Write([]byte{0})
+}
+
+func (s *Server) checkDomainAdmin(user, domain string) bool {
+	if s.authenticator.CheckPrivileges(user, auth.AdminPrivilege) {
+		return true
+	}
+
+	settings, err := s.storage.GetDomainSettings(domain)
+	return err == nil && settings.IsOwner(user)
+}
+
+func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request, user string, urlParts []string) {
 	if user == "" {
 		log.Printf("User could not be empty. Invalid usage of handleMailRequest")
 		panic(nil)
 	}
 
+	if len(urlParts) > 1 {
+		switch urlParts[1] {
+		case "vacation":
+			s.handleVacationSettings(w, r, user)
+		case "forwarding":
+			s.handleForwardingSettings(w, r, user)
+		case "aliases":
+			s.handleAliasesSettings(w, r, user)
+		case "totp":
+			s.handleTotpSettings(w, r, user)
+		case "appPasswords":
+			s.handleAppPasswordsSettings(w, r, user)
+		case "sessions":
+			s.handleSessionsSettings(w, r, user)
+		case "webhooks":
+			s.handleWebhooksSettings(w, r, user)
+		case "push":
+			s.handlePushSettings(w, r, user)
+		default:
+			s.error(http.StatusNotFound, "Unknown settings requested", w)
+		}
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		info, err := s.storage.GetUserInfo(user)
@@ -54,10 +396,19 @@ func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request, user str
 			s.error(http.StatusInternalServerError, "Unable to obtain user information", w)
 			return
 		}
-		fmt.Fprintf(w, s.templater.ExecuteSettings(&struct {
-			Version  string
-			FullName string
-		}{common.Version, info.FullName}))
+
+		emails, err := s.storage.GetEmails(user)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to obtain user information", w)
+			return
+		}
+
+		fmt.Fprint(w, s.templater.ExecuteSettings(&struct {
+			Version   string
+			FullName  string
+			Emails    []string
+			CsrfToken string
+		}{common.Version, info.FullName, emails, s.csrfToken(w, r)}))
 	case "PATCH":
 		s.handleSettingsUpdate(w, r, user)
 	}
@@ -70,7 +421,7 @@ func (s *Server) handleSettingsUpdate(w http.ResponseWriter, r *http.Request, us
 	}
 
 	oldPassword := r.FormValue("oldPassword")
-	if err := s.authenticator.CheckUser(user, oldPassword); err != nil {
+	if err := s.authenticator.CheckUserFrom(user, oldPassword, s.clientAddress(r), auth.ServiceWeb); err != nil {
 		s.error(http.StatusUnauthorized, "Password entered is invalid", w)
 		return
 	}
@@ -84,5 +435,499 @@ func (s *Server) handleSettingsUpdate(w http.ResponseWriter, r *http.Request, us
 		s.error(http.StatusInternalServerError, "Unable to update user data", w)
 		return
 	}
+
+	//Password change logs out all sessions, current session gets new token
+	if password != "" {
+		if err := s.authenticator.RevokeAllSessions(user); err != nil {
+			log.Println(err.Error())
+		}
+		s.saveSession(user, s.authenticator.IssueWebToken(user, s.clientAddress(r), r.UserAgent()), w, r)
+	}
 	w.Write([]byte{0})
 }
+
+func (s *Server) handleVacationSettings(w http.ResponseWriter, r *http.Request, user string) {
+	email := r.FormValue("email")
+	if !utils.RegExpUtilsInstance().EmailChecker.MatchString(email) {
+		s.error(http.StatusBadRequest, "Invalid email", w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		vacation, err := s.storage.GetVacation(email)
+		if err != nil || !s.checkUserEmail(user, email) {
+			s.error(http.StatusInternalServerError, "Unable to read vacation settings", w)
+			return
+		}
+
+		out, err := json.Marshal(vacation)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read vacation settings", w)
+			return
+		}
+		w.Write(out)
+	case "PATCH":
+		interval, err := strconv.ParseInt(r.FormValue("interval"), 10, 64)
+		if err != nil || interval < 0 {
+			s.error(http.StatusBadRequest, "Invalid reply interval", w)
+			return
+		}
+
+		vacation := &common.Vacation{
+			Email:        email,
+			Enabled:      r.FormValue("enabled") == "true",
+			Subject:      r.FormValue("subject"),
+			Body:         r.FormValue("body"),
+			Interval:     interval,
+			ExcludeLists: r.FormValue("excludeLists") == "true",
+			ExcludeAuto:  r.FormValue("excludeAuto") == "true",
+		}
+
+		if start, err := time.Parse("2006-01-02", r.FormValue("start")); err == nil {
+			vacation.Start = start.Unix()
+		}
+
+		if end, err := time.Parse("2006-01-02", r.FormValue("end")); err == nil {
+			vacation.End = end.Add(24 * time.Hour).Unix() //End date is inclusive
+		}
+
+		if vacation.Enabled && vacation.Body == "" {
+			s.error(http.StatusBadRequest, "Auto-reply message could not be empty", w)
+			return
+		}
+
+		err = s.storage.SetVacation(user, vacation)
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusInternalServerError, "Unable to update vacation settings", w)
+			return
+		}
+		w.Write([]byte{0})
+	default:
+		s.error(http.StatusNotImplemented, "Invalid vacation settings request", w)
+	}
+}
+
+func (s *Server) handleForwardingSettings(w http.ResponseWriter, r *http.Request, user string) {
+	email := r.FormValue("email")
+	if !s.checkUserEmail(user, email) {
+		s.error(http.StatusBadRequest, "Invalid email", w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		forwarding, err := s.storage.GetForwarding(email)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read forwarding settings", w)
+			return
+		}
+
+		out, err := json.Marshal(forwarding)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read forwarding settings", w)
+			return
+		}
+		w.Write(out)
+	case "PATCH":
+		forwarding := &common.Forwarding{
+			Email:    email,
+			Targets:  []string{},
+			KeepCopy: r.FormValue("keepCopy") == "true",
+		}
+
+		for _, target := range strings.Split(r.FormValue("targets"), ",") {
+			target = strings.Trim(target, " \t")
+			if target != "" {
+				forwarding.Targets = append(forwarding.Targets, target)
+			}
+		}
+
+		err := s.storage.SetForwarding(user, forwarding)
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusBadRequest, "Unable to update forwarding settings", w)
+			return
+		}
+		w.Write([]byte{0})
+	default:
+		s.error(http.StatusNotImplemented, "Invalid forwarding settings request", w)
+	}
+}
+
+func (s *Server) handleAliasesSettings(w http.ResponseWriter, r *http.Request, user string) {
+	email := r.FormValue("email")
+	if !s.checkUserEmail(user, email) {
+		s.error(http.StatusBadRequest, "Invalid email", w)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case "GET":
+		aliases, err := s.storage.GetAliases(email)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read aliases", w)
+			return
+		}
+
+		mailboxOptions, err := s.storage.GetMailboxOptions(email)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read aliases", w)
+			return
+		}
+
+		out, err := json.Marshal(&struct {
+			Aliases   []string `json:"aliases"`
+			FileByTag bool     `json:"fileByTag"`
+			Delimiter string   `json:"delimiter"`
+		}{
+			Aliases:   aliases,
+			FileByTag: mailboxOptions.FileByTag,
+			Delimiter: config.ConfigInstance().RecipientDelimiter,
+		})
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read aliases", w)
+			return
+		}
+		w.Write(out)
+		return
+	case "POST":
+		err = s.storage.AddAlias(user, email, r.FormValue("alias"))
+	case "DELETE":
+		err = s.storage.RemoveAlias(user, r.FormValue("alias"))
+	case "PATCH":
+		err = s.storage.SetMailboxOptions(user, &common.MailboxOptions{
+			Email:     email,
+			FileByTag: r.FormValue("fileByTag") == "true",
+		})
+	default:
+		s.error(http.StatusNotImplemented, "Invalid aliases request", w)
+		return
+	}
+
+	if err != nil {
+		log.Println(err.Error())
+		s.error(http.StatusBadRequest, "Unable to update aliases", w)
+		return
+	}
+	w.Write([]byte{0})
+}
+
+func (s *Server) handleTotpSettings(w http.ResponseWriter, r *http.Request, user string) {
+	var out []byte
+	var err error
+	switch r.Method {
+	case "GET":
+		out, err = json.Marshal(&struct {
+			Enabled       bool `json:"enabled"`
+			RecoveryCodes int  `json:"recoveryCodes"`
+		}{
+			Enabled:       s.authenticator.IsTotpEnabled(user),
+			RecoveryCodes: s.authenticator.RecoveryCodesLeft(user),
+		})
+	case "POST":
+		//Enrollment is two-step: secret is generated first and enabled only
+		//after user confirms that authenticator app produces valid codes
+		if code := r.FormValue("code"); code != "" {
+			codes, confirmErr := s.authenticator.ConfirmTotpEnrollment(user, code)
+			if confirmErr != nil {
+				s.error(http.StatusBadRequest, "Authentication code is invalid", w)
+				return
+			}
+			out, err = json.Marshal(codes)
+			break
+		}
+
+		var secret, uri string
+		secret, uri, err = s.authenticator.BeginTotpEnrollment(user)
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusInternalServerError, "Unable to enable two-factor authentication", w)
+			return
+		}
+
+		var png []byte
+		png, err = qrcode.Encode(uri, qrcode.Medium, 256)
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusInternalServerError, "Unable to enable two-factor authentication", w)
+			return
+		}
+
+		out, err = json.Marshal(&struct {
+			Secret string `json:"secret"`
+			Uri    string `json:"uri"`
+			QrCode string `json:"qrCode"`
+		}{
+			Secret: secret,
+			Uri:    uri,
+			QrCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		})
+	case "PATCH":
+		//Regenerates recovery codes, invalidates old ones
+		if !s.authenticator.CheckTotp(user, r.FormValue("code")) {
+			s.error(http.StatusUnauthorized, "Authentication code is invalid", w)
+			return
+		}
+
+		var codes []string
+		codes, err = s.authenticator.RegenerateRecoveryCodes(user)
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusInternalServerError, "Unable to generate recovery codes", w)
+			return
+		}
+		out, err = json.Marshal(codes)
+	case "DELETE":
+		if err := s.authenticator.CheckUserFrom(user, r.FormValue("password"), s.clientAddress(r), auth.ServiceWeb); err != nil ||
+			!s.authenticator.CheckTotp(user, r.FormValue("code")) {
+			s.error(http.StatusUnauthorized, "Password or authentication code is invalid", w)
+			return
+		}
+
+		err = s.authenticator.ResetTotp(user)
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusInternalServerError, "Unable to disable two-factor authentication", w)
+			return
+		}
+		out = []byte{0}
+	default:
+		s.error(http.StatusNotImplemented, "Invalid two-factor authentication request", w)
+		return
+	}
+
+	if err != nil {
+		s.error(http.StatusInternalServerError, "Unable to read two-factor authentication settings", w)
+		return
+	}
+	w.Write(out)
+}
+
+func (s *Server) handleAppPasswordsSettings(w http.ResponseWriter, r *http.Request, user string) {
+	switch r.Method {
+	case "GET":
+		appPasswords, err := s.authenticator.GetAppPasswords(user)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read application passwords", w)
+			return
+		}
+
+		out, err := json.Marshal(appPasswords)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read application passwords", w)
+			return
+		}
+		w.Write(out)
+	case "POST":
+		scopes := []string{}
+		for _, scope := range strings.Split(r.FormValue("scopes"), ",") {
+			if scope != "" {
+				scopes = append(scopes, scope)
+			}
+		}
+
+		appPassword, password, err := s.authenticator.AddAppPassword(user, r.FormValue("name"), scopes)
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusBadRequest, "Unable to create application password", w)
+			return
+		}
+
+		out, err := json.Marshal(&struct {
+			*common.AppPassword
+			Password string `json:"password"`
+		}{appPassword, password})
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to create application password", w)
+			return
+		}
+		w.Write(out)
+	case "DELETE":
+		err := s.authenticator.RemoveAppPassword(user, r.FormValue("id"))
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusBadRequest, "Unable to revoke application password", w)
+			return
+		}
+		w.Write([]byte{0})
+	default:
+		s.error(http.StatusNotImplemented, "Invalid application passwords request", w)
+	}
+}
+
+func (s *Server) handleSessionsSettings(w http.ResponseWriter, r *http.Request, user string) {
+	_, token := s.extractAuth(w, r)
+	switch r.Method {
+	case "GET":
+		sessions, err := s.authenticator.GetSessions(user, token)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read sessions", w)
+			return
+		}
+
+		out, err := json.Marshal(sessions)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read sessions", w)
+			return
+		}
+		w.Write(out)
+	case "DELETE":
+		var err error
+		if r.FormValue("others") == "true" {
+			err = s.authenticator.RevokeOtherSessions(user, token)
+		} else {
+			err = s.authenticator.RevokeSession(user, r.FormValue("id"))
+		}
+
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusBadRequest, "Unable to log out session", w)
+			return
+		}
+		w.Write([]byte{0})
+	default:
+		s.error(http.StatusNotImplemented, "Invalid sessions request", w)
+	}
+}
+
+// handleWebhooksSettings manages webhooks of the email. Webhooks are available
+// to the email owner and to administrators of the email domain. Only webhooks
+// created by administrators may deliver events to private networks.
+func (s *Server) handleWebhooksSettings(w http.ResponseWriter, r *http.Request, user string) {
+	email := r.FormValue("email")
+	if id := r.FormValue("id"); id != "" {
+		webhook, err := s.storage.GetWebhook(id)
+		if err != nil {
+			s.error(http.StatusNotFound, "Webhook not found", w)
+			return
+		}
+		email = webhook.Email
+	}
+
+	if email == "" || (!s.checkUserEmail(user, email) && !s.checkDomainAdmin(user, email[strings.LastIndex(email, "@")+1:])) {
+		s.error(http.StatusBadRequest, "Invalid email", w)
+		return
+	}
+
+	var out []byte
+	var err error
+	switch r.Method {
+	case "GET":
+		if id := r.FormValue("id"); id != "" {
+			deliveries, getErr := s.storage.GetWebhookDeliveries(id, 50)
+			if getErr != nil {
+				s.error(http.StatusInternalServerError, "Unable to read webhook deliveries", w)
+				return
+			}
+			out, err = json.Marshal(deliveries)
+		} else {
+			webhooks, getErr := s.storage.GetWebhooks(email, "")
+			if getErr != nil {
+				s.error(http.StatusInternalServerError, "Unable to read webhooks", w)
+				return
+			}
+			out, err = json.Marshal(&struct {
+				Webhooks []*common.Webhook `json:"webhooks"`
+				Events   []string          `json:"events"`
+			}{webhooks, common.WebhookEvents})
+		}
+	case "POST":
+		events := []string{}
+		for _, event := range strings.Split(r.FormValue("events"), ",") {
+			if event != "" {
+				events = append(events, event)
+			}
+		}
+
+		allowPrivate := s.authenticator.CheckPrivileges(user, auth.AdminPrivilege)
+		webhook, addErr := s.storage.AddWebhook(user, email, r.FormValue("url"), events, allowPrivate)
+		if addErr != nil {
+			log.Println(addErr.Error())
+			s.error(http.StatusBadRequest, "Unable to create webhook: "+addErr.Error(), w)
+			return
+		}
+
+		out, err = json.Marshal(&struct {
+			*common.Webhook
+			Secret string `json:"secret"`
+		}{webhook, webhook.Secret})
+	case "DELETE":
+		if removeErr := s.storage.RemoveWebhook(r.FormValue("id")); removeErr != nil {
+			log.Println(removeErr.Error())
+			s.error(http.StatusBadRequest, "Unable to remove webhook", w)
+			return
+		}
+		out = []byte{0}
+	default:
+		s.error(http.StatusNotImplemented, "Invalid webhooks request", w)
+		return
+	}
+
+	if err != nil {
+		s.error(http.StatusInternalServerError, "Unable to process webhooks request", w)
+		return
+	}
+	w.Write(out)
+}
+
+func (s *Server) handlePushSettings(w http.ResponseWriter, r *http.Request, user string) {
+	switch r.Method {
+	case "GET":
+		subscriptions, err := s.storage.GetPushSubscriptions(user)
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read push subscriptions", w)
+			return
+		}
+
+		out, err := json.Marshal(&struct {
+			PublicKey     string                     `json:"publicKey"`
+			Subscriptions []*common.PushSubscription `json:"subscriptions"`
+		}{s.vapidPublicKey, subscriptions})
+		if err != nil {
+			s.error(http.StatusInternalServerError, "Unable to read push subscriptions", w)
+			return
+		}
+		w.Write(out)
+	case "POST":
+		err := s.storage.AddPushSubscription(&common.PushSubscription{
+			User:      user,
+			Endpoint:  r.FormValue("endpoint"),
+			P256dh:    r.FormValue("p256dh"),
+			Auth:      r.FormValue("auth"),
+			UserAgent: r.UserAgent(),
+		})
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusBadRequest, "Unable to subscribe for push notifications", w)
+			return
+		}
+		w.Write([]byte{0})
+	case "DELETE":
+		err := s.storage.RemovePushSubscription(user, r.FormValue("endpoint"))
+		if err != nil {
+			log.Println(err.Error())
+			s.error(http.StatusBadRequest, "Unable to unsubscribe from push notifications", w)
+			return
+		}
+		w.Write([]byte{0})
+	default:
+		s.error(http.StatusNotImplemented, "Invalid push notifications request", w)
+	}
+}
+
+func (s *Server) checkUserEmail(user, email string) bool {
+	emails, err := s.storage.GetEmails(user)
+	if err != nil {
+		return false
+	}
+
+	for _, existingEmail := range emails {
+		if existingEmail == email {
+			return true
+		}
+	}
+	return false
+}
@@ -28,13 +28,17 @@ package web
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 
 	auth "git.semlanik.org/semlanik/gostfix/auth"
 	common "git.semlanik.org/semlanik/gostfix/common"
 	"git.semlanik.org/semlanik/gostfix/config"
+	dav "git.semlanik.org/semlanik/gostfix/dav"
 	db "git.semlanik.org/semlanik/gostfix/db"
+	"git.semlanik.org/semlanik/gostfix/utils"
+	webpush "git.semlanik.org/semlanik/gostfix/webpush"
 
 	sessions "github.com/gorilla/sessions"
 )
@@ -57,15 +61,22 @@ const (
 	CookieSessionToken = "gostfix_session"
 )
 
+const (
+	//Time in seconds that user has to enter second factor code after password
+	TotpLoginTimeout = 300
+)
+
 type Server struct {
 	authenticator     *auth.Authenticator
 	fileServer        http.Handler
 	attachmentsServer http.Handler
 	templater         *Templater
-	sessionStore      *sessions.CookieStore
+	sessionStore      *utils.SessionStore
 	storage           *db.Storage
 	notifier          *webNotifier
 	scanner           common.Scanner
+	vapidPublicKey    string
+	dav               *dav.Server
 }
 
 func NewServer(scanner common.Scanner) *Server {
@@ -82,24 +93,53 @@ func NewServer(scanner common.Scanner) *Server {
 		log.Fatalf("Unable to intialize authenticator %s", err)
 		return nil
 	}
+
+	sessionStore, err := NewSessionStore()
+	if err != nil {
+		log.Fatalf("Unable to intialize session store %s", err)
+		return nil
+	}
+
+	vapidKey, err := webpush.LoadVapidKey(config.ConfigInstance().WebVapidKey)
+	if err != nil {
+		log.Fatalf("Unable to intialize VAPID key %s", err)
+		return nil
+	}
+
 	s := &Server{
 		authenticator:     authenticator,
 		templater:         NewTemplater("data/templates"),
 		fileServer:        http.FileServer(http.Dir("data")),
 		attachmentsServer: http.StripPrefix("/attachment/", http.FileServer(http.Dir(config.ConfigInstance().AttachmentsPath))),
-		sessionStore:      sessions.NewCookieStore(make([]byte, 32)),
+		sessionStore:      sessionStore,
 		storage:           storage,
 		notifier:          NewWebNotifier(),
 		scanner:           scanner,
+		vapidPublicKey:    webpush.PublicKey(vapidKey),
+		dav:               dav.NewServer(storage),
 	}
 
 	s.notifier.server = s
-	s.storage.RegisterNotifier(s.notifier)
+	s.storage.RegisterNotifier(s.notifier, webNotifierOptions)
 
 	return s
 }
 
+// NewSessionStore creates cookie store with persistent keys, cookies live
+// as long as web session
+func NewSessionStore() (*utils.SessionStore, error) {
+	return utils.NewSessionStore(config.ConfigInstance().WebSessionKeys, config.ConfigInstance().WebSessionKeyRotation, sessions.Options{
+		Path:     "/",
+		MaxAge:   int(config.ConfigInstance().WebSessionExpireTime.Seconds()),
+		Secure:   config.ConfigInstance().WebSecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
 func (s *Server) Run() {
+	go s.sessionStore.Run()
+	go s.authenticator.Run()
 	http.Handle("/", s)
 	log.Fatal(http.ListenAndServe(":"+config.ConfigInstance().WebPort, nil))
 }
@@ -119,6 +159,10 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fallthrough
 	case "js":
 		s.fileServer.ServeHTTP(w, r)
+	case "sw.js":
+		//Service worker is served from the root to control all pages
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, "data/js/sw.js")
 	case "login":
 		s.handleLogin(w, r)
 	case "logout":
@@ -127,6 +171,15 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.handleRegister(w, r)
 	case "checkEmail":
 		s.handleCheckEmail(w, r)
+	case ".well-known":
+		//Service discovery of CardDAV and CalDAV clients, RFC 6764
+		if len(urlParts) == 2 && (urlParts[1] == "carddav" || urlParts[1] == "caldav") {
+			http.Redirect(w, r, "/dav/", http.StatusMovedPermanently)
+		} else {
+			s.error(http.StatusNotFound, "Not found", w)
+		}
+	case "dav":
+		s.handleDav(w, r)
 	default:
 		s.handleSecure(w, r, urlParts)
 	}
@@ -143,6 +196,16 @@ func (s *Server) handleSecure(w http.ResponseWriter, r *http.Request, urlParts [
 		return
 	}
 
+	if !isSafeMethod(r.Method) && !s.checkCsrf(r) {
+		s.error(http.StatusForbidden, "Invalid CSRF token", w)
+		return
+	}
+
+	//Cookie lifetime is extended together with session token
+	if config.ConfigInstance().WebSessionExpireTime > 0 {
+		s.saveSession(user, token, w, r)
+	}
+
 	switch urlParts[0] {
 	case "m":
 		s.handleMailboxRequest(w, r, user, urlParts)
@@ -155,11 +218,17 @@ func (s *Server) handleSecure(w http.ResponseWriter, r *http.Request, urlParts [
 	case "mail":
 		if len(urlParts) == 2 {
 			s.handleMailRequest(w, r, user, urlParts[1])
+		} else if len(urlParts) == 3 && urlParts[2] == "invitation" {
+			s.handleInvitation(w, r, user, urlParts[1])
+		} else {
+			s.error(http.StatusBadRequest, "Invalid mail request", w)
 		}
 	case "settings":
-		s.handleSettings(w, r, user)
+		s.handleSettings(w, r, user, urlParts)
+	case "contacts":
+		s.handleContacts(w, r, user, urlParts)
 	case "admin":
-		s.handleSecureZone(w, r, user)
+		s.handleSecureZone(w, r, user, urlParts)
 	default:
 		http.Redirect(w, r, "/m/0", http.StatusTemporaryRedirect)
 	}
@@ -196,6 +265,29 @@ func (s *Server) extractAuth(w http.ResponseWriter, r *http.Request) (user, toke
 	return
 }
 
+// clientAddress returns address of the client. Headers set by the reverse
+// proxy are only trusted if request came from the local host.
+func (s *Server) clientAddress(r *http.Request) string {
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		address = r.RemoteAddr
+	}
+
+	if ip := net.ParseIP(address); ip == nil || !ip.IsLoopback() {
+		return address
+	}
+
+	if realIp := r.Header.Get("X-Real-IP"); realIp != "" {
+		return strings.Trim(realIp, " \t")
+	}
+
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		forwarded := strings.Split(forwardedFor, ",")
+		return strings.Trim(forwarded[len(forwarded)-1], " \t")
+	}
+	return address
+}
+
 func (s *Server) error(code int, text string, w http.ResponseWriter) {
 	w.WriteHeader(code)
 	fmt.Fprint(w, s.templater.ExecuteError(&struct {
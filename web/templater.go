@@ -45,6 +45,7 @@ const (
 	SignupTemplateName     = "signup.html"
 	RegisterTemplateName   = "register.html"
 	SettingsTemplateName   = "settings.html"
+	InvitationReplyName    = "mailInvitationReply.eml"
 )
 
 type Templater struct {
@@ -60,6 +61,7 @@ type Templater struct {
 	mailNewTemplate    *template.Template
 	mailTemplate       *template.Template
 	settingsTemplate   *template.Template
+	invitationReply    *template.Template
 }
 
 func NewTemplater(templatesPath string) (t *Templater) {
@@ -124,6 +126,11 @@ func NewTemplater(templatesPath string) (t *Templater) {
 		log.Fatal(err)
 	}
 
+	invitationReply, err := parseTemplate(templatesPath + "/" + InvitationReplyName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	t = &Templater{
 		indexTemplate:      index,
 		mailListTemplate:   maillist,
@@ -137,6 +144,7 @@ func NewTemplater(templatesPath string) (t *Templater) {
 		signupTemplate:     signup,
 		registerTemplate:   register,
 		settingsTemplate:   settings,
+		invitationReply:    invitationReply,
 	}
 	return
 }
@@ -198,6 +206,10 @@ func (t *Templater) ExecuteSettings(data interface{}) string {
 	return executeTemplateCommon(t.settingsTemplate, data)
 }
 
+func (t *Templater) ExecuteInvitationReply(data interface{}) string {
+	return executeTemplateCommon(t.invitationReply, data)
+}
+
 func executeTemplateCommon(t *template.Template, values interface{}) string {
 	buffer := &bytes.Buffer{}
 	err := t.Execute(buffer, values)
@@ -30,130 +30,400 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"git.semlanik.org/semlanik/gostfix/common"
+	"git.semlanik.org/semlanik/gostfix/config"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	//Time allowed to write a message to the client
+	websocketWriteWait = 10 * time.Second
+	//Time allowed to read the next pong message from the client
+	websocketPongWait = 60 * time.Second
+	//Ping period, must be less than pong wait
+	websocketPingPeriod = websocketPongWait * 9 / 10
+	//Client doesn't send anything except control messages
+	websocketMaxMessageSize = 512
+	subscriberChannelSize   = 10
+	//Number of latest events of every email kept to resume event streams
+	eventHistorySize = 50
+	//Interval of keepalive comments in event streams, proxies close idle
+	//connections
+	eventStreamPingPeriod = 30 * time.Second
+	eventStreamRetry      = 5000
+)
+
 type webNotification struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
 }
 
-type websocketChannel struct {
-	connection *websocket.Conn
-	channel    chan interface{}
+// webEvent is notification prepared to be sent to subscribers. Events that
+// are shared between instances keep id of the shared event, so event stream
+// clients may resume from the last received event on any instance.
+type webEvent struct {
+	id      string
+	payload []byte
+}
+
+// subscriber receives mailbox notifications over websocket or event stream,
+// every browser tab has own subscriber
+type subscriber struct {
+	channel   chan *webEvent
+	done      chan struct{}
+	closeOnce sync.Once
+	user      string
+	token     string
+}
+
+func (c *subscriber) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
 }
 
 type webNotifier struct {
 	server        *Server
-	notifiers     map[string]*websocketChannel
+	notifiers     map[string]map[*subscriber]bool
+	history       map[string][]*webEvent
+	localPrefix   string
+	lastEventId   uint64
 	notifiersLock sync.Mutex
 }
 
 func NewWebNotifier() *webNotifier {
 	return &webNotifier{
-		notifiers: make(map[string]*websocketChannel),
+		notifiers: make(map[string]map[*subscriber]bool),
+		history:   make(map[string][]*webEvent),
+		//Ids of events that are not shared are unique for the process, so
+		//they are never found after restart or on other instance
+		localPrefix: strconv.FormatInt(time.Now().UnixNano(), 36) + "-",
+	}
+}
+
+// webNotifierOptions subscribes web notifier to the events that are shown
+// in web interface. Web interface reloads the mail list on reconnect, so
+// events are dropped if notifier is too slow.
+var webNotifierOptions = &common.NotifierOptions{
+	Name:     "web",
+	Overflow: common.OverflowDrop,
+	Types: []string{
+		common.EventMailCreated,
+		common.EventFolderStats,
+		common.EventSessionRevoked,
+	},
+}
+
+func (wn *webNotifier) Notify(event *common.Event) {
+	switch event.Type {
+	case common.EventFolderStats:
+		wn.notify(event.Email, event.Id, &webNotification{
+			Type: "stats",
+			Data: event.Stats,
+		})
+	case common.EventMailCreated:
+		wn.notify(event.Email, event.Id, &webNotification{
+			Type: "mail",
+			Data: &struct {
+				Folder string `json:"folder"`
+				HTML   string `json:"html"`
+			}{
+				Folder: event.Mail.Folder,
+				HTML:   wn.server.templater.ExecuteMailList([]*common.MailMetadata{event.Mail}),
+			},
+		})
+		//TODO: this functionality needs JS support to create new mails from templates
+	case common.EventSessionRevoked:
+		wn.closeRevokedSessions(event.User)
 	}
 }
 
-func (wn *webNotifier) NotifyMaiboxUpdate(email string, stats []common.FolderStat) {
-	if channel, ok := wn.getNotifier(email); ok {
-		channel.channel <- stats
+// closeRevokedSessions disconnects subscribers of the user which tokens are
+// no longer valid
+func (wn *webNotifier) closeRevokedSessions(user string) {
+	wn.notifiersLock.Lock()
+	subscribers := []*subscriber{}
+	for _, emailSubscribers := range wn.notifiers {
+		for c := range emailSubscribers {
+			if c.user == user {
+				subscribers = append(subscribers, c)
+			}
+		}
+	}
+	wn.notifiersLock.Unlock()
+
+	for _, c := range subscribers {
+		if !wn.server.authenticator.IsTokenValid(c.user, c.token) {
+			c.close()
+		}
 	}
 }
 
-func (wn *webNotifier) NotifyNewMail(email string, m common.MailMetadata) {
-	if channel, ok := wn.getNotifier(email); ok {
-		channel.channel <- &m
+// notify sends notification to all subscribers of the email. Subscribers
+// that don't read notifications are disconnected, so slow client never
+// blocks others. Notification gets local id if id of the event is empty.
+func (wn *webNotifier) notify(email, id string, notification *webNotification) {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		log.Printf("Unable to marshal notification data %v\n", err)
+		return
+	}
+
+	wn.notifiersLock.Lock()
+	defer wn.notifiersLock.Unlock()
+	if id == "" {
+		wn.lastEventId++
+		id = wn.localPrefix + strconv.FormatUint(wn.lastEventId, 10)
+	}
+
+	event := &webEvent{
+		id:      id,
+		payload: payload,
+	}
+
+	history := append(wn.history[email], event)
+	if len(history) > eventHistorySize {
+		history = history[len(history)-eventHistorySize:]
+	}
+	wn.history[email] = history
+
+	for c := range wn.notifiers[email] {
+		select {
+		case c.channel <- event:
+		default:
+			log.Printf("Subscriber of %s is too slow, disconnecting\n", email)
+			c.close()
+		}
 	}
-	//TODO: this functionality needs JS support to create new mails from templates
 }
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin allows websocket connections from configured host names only,
+// or from the host of the request if host names are not configured
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	originUrl, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(originUrl.Host)
+	hostnames := config.ConfigInstance().WebHostnames
+	if len(hostnames) == 0 {
+		return host == strings.ToLower(r.Host)
+	}
+
+	for _, hostname := range hostnames {
+		if host == hostname {
+			return true
+		}
+	}
+
+	log.Printf("Web socket connection from origin %s is refused\n", origin)
+	return false
 }
 
-func (wn *webNotifier) handleNotifierRequest(w http.ResponseWriter, r *http.Request, email string) {
-	fmt.Printf("New web socket session start %s\n", email)
+func (wn *webNotifier) handleNotifierRequest(w http.ResponseWriter, r *http.Request, user, email string) {
+	log.Printf("New web socket session start %s\n", email)
+	_, token := wn.server.extractAuth(w, r)
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Could not upgrade websocket %s\n", err)
-		http.Error(w, "Could not open websocket connection", http.StatusBadRequest)
 		return
 	}
 
-	c := &websocketChannel{
-		connection: conn,
-		channel:    make(chan interface{}, 10),
-	}
-	wn.addNotifier(email, c)
+	c, _, _ := wn.addNotifier(email, user, token, "")
+	go wn.handleNotifications(email, c, conn)
+	go wn.readMessages(c, conn)
+}
 
-	conn.SetCloseHandler(func(code int, text string) error {
-		fmt.Printf("Web socket session end %s\n", email)
-		wn.removeNotifier(email)
-		conn.Close()
+// readMessages reads control messages of the client, reading stops once
+// connection is closed by client or no pong is received in time
+func (wn *webNotifier) readMessages(c *subscriber, conn *websocket.Conn) {
+	defer c.close()
+	conn.SetReadLimit(websocketMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(websocketPongWait))
 		return nil
 	})
 
-	go wn.handleNotifications(c)
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
 }
 
-func (wn *webNotifier) handleNotifications(c *websocketChannel) {
+// handleNotifications writes notifications and pings to the client. Only
+// this goroutine writes to connection and it closes connection on exit.
+func (wn *webNotifier) handleNotifications(email string, c *subscriber, conn *websocket.Conn) {
+	ticker := time.NewTicker(websocketPingPeriod)
+	defer func() {
+		ticker.Stop()
+		wn.removeNotifier(email, c)
+		conn.Close()
+		log.Printf("Web socket session end %s\n", email)
+	}()
+
 	for {
 		select {
-		case data := <-c.channel:
-			var err error = nil
-			var out []byte
-			if newMail, ok := data.(*common.MailMetadata); ok {
-				out, err = json.Marshal(&webNotification{
-					Type: "mail",
-					Data: &struct {
-						Folder string `json:"folder"`
-						HTML   string `json:"html"`
-					}{
-						Folder: newMail.Folder,
-						HTML:   wn.server.templater.ExecuteMailList([]*common.MailMetadata{newMail}),
-					},
-				})
-
-			} else if stats, ok := data.([]common.FolderStat); ok {
-				out, err = json.Marshal(&webNotification{
-					Type: "stats",
-					Data: stats,
-				})
+		case <-c.done:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(websocketWriteWait))
+			return
+		case <-ticker.C:
+			//Session may be revoked while connection is open
+			if !wn.server.authenticator.IsTokenValid(c.user, c.token) {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session expired"), time.Now().Add(websocketWriteWait))
+				return
 			}
 
-			if err != nil {
-				log.Printf("Unable to marshal notification data %v\n", err)
-			} else {
-				err = c.connection.WriteMessage(websocket.TextMessage, out)
-				if err != nil {
-					log.Println(err.Error())
-					return
-				}
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteWait)); err != nil {
+				return
+			}
+		case event := <-c.channel:
+			conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+			if err := conn.WriteMessage(websocket.TextMessage, event.payload); err != nil {
+				log.Println(err.Error())
+				return
 			}
 		}
 	}
 }
 
-func (wn *webNotifier) getNotifier(email string) (channel *websocketChannel, ok bool) {
+// handleEventsRequest streams notifications as server-sent events, it's
+// used by clients that are unable to open websocket connection. Events that
+// were missed since Last-Event-ID are sent first, client is asked to reload
+// if Last-Event-ID is not found in history.
+func (wn *webNotifier) handleEventsRequest(w http.ResponseWriter, r *http.Request, user, email string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		wn.server.error(http.StatusNotImplemented, "Event streams are not supported", w)
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.FormValue("lastEventId")
+	}
+
+	_, token := wn.server.extractAuth(w, r)
+	c, missed, resumed := wn.addNotifier(email, user, token, lastEventId)
+	defer wn.removeNotifier(email, c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	log.Printf("New event stream session start %s\n", email)
+	defer log.Printf("Event stream session end %s\n", email)
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventStreamRetry)
+	if !resumed {
+		writeEvent(w, &webEvent{id: wn.lastHistoryId(email), payload: []byte(`{"type":"reload"}`)})
+	}
+
+	for _, event := range missed {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventStreamPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if !wn.server.authenticator.IsTokenValid(c.user, c.token) {
+				return
+			}
+
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case event := <-c.channel:
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event *webEvent) error {
+	_, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", event.id, event.payload)
+	return err
+}
+
+// addNotifier registers new subscriber of the email and returns events
+// that were sent after lastId, if lastId is not empty. resumed is false if
+// lastId is not found in history, e.g. it's received from other instance or
+// is too old. Registration and history read are atomic, so no event is lost
+// or duplicated.
+func (wn *webNotifier) addNotifier(email, user, token, lastId string) (c *subscriber, missed []*webEvent, resumed bool) {
+	c = &subscriber{
+		channel: make(chan *webEvent, subscriberChannelSize),
+		done:    make(chan struct{}),
+		user:    user,
+		token:   token,
+	}
+
 	wn.notifiersLock.Lock()
 	defer wn.notifiersLock.Unlock()
-	channel, ok = wn.notifiers[email]
-	return
+	if _, ok := wn.notifiers[email]; !ok {
+		wn.notifiers[email] = make(map[*subscriber]bool)
+	}
+	wn.notifiers[email][c] = true
+
+	missed = []*webEvent{}
+	if lastId == "" {
+		return c, missed, true
+	}
+
+	history := wn.history[email]
+	for i, event := range history {
+		if event.id == lastId {
+			return c, append(missed, history[i+1:]...), true
+		}
+	}
+	return c, missed, false
 }
 
-func (wn *webNotifier) addNotifier(email string, channel *websocketChannel) {
+// lastHistoryId returns id of the latest event of the email in history
+func (wn *webNotifier) lastHistoryId(email string) string {
 	wn.notifiersLock.Lock()
 	defer wn.notifiersLock.Unlock()
-	wn.notifiers[email] = channel
+	history := wn.history[email]
+	if len(history) == 0 {
+		return ""
+	}
+	return history[len(history)-1].id
 }
 
-func (wn *webNotifier) removeNotifier(email string) {
+func (wn *webNotifier) removeNotifier(email string, c *subscriber) {
 	wn.notifiersLock.Lock()
 	defer wn.notifiersLock.Unlock()
-	delete(wn.notifiers, email)
+	delete(wn.notifiers[email], c)
+	if len(wn.notifiers[email]) == 0 {
+		delete(wn.notifiers, email)
+	}
 }
@@ -0,0 +1,294 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	db "git.semlanik.org/semlanik/gostfix/db"
+	utils "git.semlanik.org/semlanik/gostfix/utils"
+	uuid "github.com/google/uuid"
+)
+
+const (
+	eventQueueSize  = 1024
+	deliveryTimeout = 10 * time.Second
+	maxResponseSize = 64 * 1024
+)
+
+// Delays between delivery attempts, event is dropped after the last one
+var retryDelays = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+}
+
+type webhookEvent struct {
+	email string
+	event string
+	data  interface{}
+}
+
+// webhookPayload is JSON document that is sent to webhook URL
+type webhookPayload struct {
+	Id    string      `json:"id"`
+	Event string      `json:"event"`
+	Time  int64       `json:"time"`
+	Email string      `json:"email"`
+	Data  interface{} `json:"data"`
+}
+
+type mailData struct {
+	Id      string `json:"id"`
+	Folder  string `json:"folder"`
+	Read    bool   `json:"read"`
+	Trash   bool   `json:"trash"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Date    int64  `json:"date"`
+}
+
+// deliveryStorage keeps webhooks and their delivery log
+type deliveryStorage interface {
+	GetWebhook(id string) (*common.Webhook, error)
+	AddWebhookDelivery(delivery *common.WebhookDelivery) error
+}
+
+// WebhookNotifier receives mailbox events and POSTs them to webhooks
+// subscribed to the event. Payloads are signed with HMAC-SHA256 of the
+// webhook secret and passed in X-Gostfix-Signature header.
+type WebhookNotifier struct {
+	storage       *db.Storage
+	deliveries    deliveryStorage
+	events        chan *webhookEvent
+	client        *http.Client
+	privateClient *http.Client
+	schedule      func(delay time.Duration, attempt func())
+}
+
+func NewWebhookNotifier() (*WebhookNotifier, error) {
+	storage, err := db.NewStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &WebhookNotifier{
+		storage:       storage,
+		deliveries:    storage,
+		events:        make(chan *webhookEvent, eventQueueSize),
+		client:        utils.NewHttpClient(deliveryTimeout, false),
+		privateClient: utils.NewHttpClient(deliveryTimeout, true),
+		schedule: func(delay time.Duration, attempt func()) {
+			time.AfterFunc(delay, attempt)
+		},
+	}
+	storage.RegisterNotifier(n, &common.NotifierOptions{
+		Name:     "webhook",
+		Overflow: common.OverflowBlock,
+		Types: []string{
+			common.EventMailCreated,
+			common.EventMailUpdated,
+			common.EventMailMoved,
+			common.EventMailDeleted,
+			common.EventFolderStats,
+		},
+	})
+	return n, nil
+}
+
+func (n *WebhookNotifier) Run() {
+	go func() {
+		for event := range n.events {
+			n.dispatch(event)
+		}
+	}()
+}
+
+// Notify converts storage events to webhook events. Every event is delivered
+// by single instance of gostfix.
+func (n *WebhookNotifier) Notify(event *common.Event) {
+	if !n.storage.ClaimEvent(event, "webhook") {
+		return
+	}
+
+	switch event.Type {
+	case common.EventFolderStats:
+		n.enqueue(event.Email, common.WebhookEventFolderStats, &struct {
+			Folders []common.FolderStat `json:"folders"`
+		}{
+			Folders: event.Stats,
+		})
+	case common.EventMailCreated:
+		//Copies of outgoing mail are not new mail
+		if event.Mail.Folder != common.Sent {
+			n.enqueue(event.Email, common.WebhookEventNewMail, newMailData(event.Mail))
+		}
+	case common.EventMailDeleted:
+		n.enqueue(event.Email, common.WebhookEventDeleted, newMailData(event.Mail))
+	case common.EventMailUpdated, common.EventMailMoved:
+		if event.Mail.Read && !event.Previous.Read {
+			n.enqueue(event.Email, common.WebhookEventRead, newMailData(event.Mail))
+		}
+		if event.Mail.Trash && !event.Previous.Trash {
+			n.enqueue(event.Email, common.WebhookEventTrashed, newMailData(event.Mail))
+		}
+	}
+}
+
+// enqueue never blocks, so event bus queue is drained while webhooks are
+// delivered
+func (n *WebhookNotifier) enqueue(email, event string, data interface{}) {
+	select {
+	case n.events <- &webhookEvent{email: email, event: event, data: data}:
+	default:
+		log.Printf("Webhook queue is full, dropping %s event for %s\n", event, email)
+	}
+}
+
+func newMailData(m *common.MailMetadata) *mailData {
+	data := &mailData{
+		Id:     m.Id,
+		Folder: m.Folder,
+		Read:   m.Read,
+		Trash:  m.Trash,
+	}
+
+	if m.Mail != nil && m.Mail.Header != nil {
+		data.From = m.Mail.Header.From
+		data.To = m.Mail.Header.To
+		data.Subject = m.Mail.Header.Subject
+		data.Date = m.Mail.Header.Date
+	}
+	return data
+}
+
+func (n *WebhookNotifier) dispatch(event *webhookEvent) {
+	webhooks, err := n.storage.GetWebhooks(event.email, event.event)
+	if err != nil {
+		log.Printf("Unable to get webhooks for %s: %s\n", event.email, err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		deliveryId := uuid.New().String()
+		payload, err := json.Marshal(&webhookPayload{
+			Id:    deliveryId,
+			Event: event.event,
+			Time:  time.Now().Unix(),
+			Email: event.email,
+			Data:  event.data,
+		})
+		if err != nil {
+			log.Printf("Unable to create webhook payload: %s\n", err)
+			return
+		}
+
+		go n.deliver(webhook.Id, event.event, deliveryId, payload, 1)
+	}
+}
+
+// deliver makes single delivery attempt and schedules next one on failure.
+// Webhook is re-read before every attempt, so removed webhooks are not
+// retried.
+func (n *WebhookNotifier) deliver(webhookId, event, deliveryId string, payload []byte, attempt int) {
+	webhook, err := n.deliveries.GetWebhook(webhookId)
+	if err != nil {
+		return
+	}
+
+	delivery := &common.WebhookDelivery{
+		Id:        deliveryId,
+		WebhookId: webhook.Id,
+		Event:     event,
+		Time:      time.Now().Unix(),
+		Attempt:   attempt,
+	}
+
+	delivery.StatusCode, err = n.post(webhook, event, deliveryId, payload)
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	if err := n.deliveries.AddWebhookDelivery(delivery); err != nil {
+		log.Printf("Unable to save webhook delivery: %s\n", err)
+	}
+
+	if err == nil || attempt > len(retryDelays) {
+		return
+	}
+
+	n.schedule(retryDelays[attempt-1], func() {
+		n.deliver(webhookId, event, deliveryId, payload, attempt+1)
+	})
+}
+
+func (n *WebhookNotifier) post(webhook *common.Webhook, event, deliveryId string, payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", webhook.Url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gostfix-webhook")
+	req.Header.Set("X-Gostfix-Event", event)
+	req.Header.Set("X-Gostfix-Delivery", deliveryId)
+	req.Header.Set("X-Gostfix-Signature", "sha256="+Sign(webhook.Secret, payload))
+
+	client := n.client
+	if webhook.AllowPrivate {
+		client = n.privateClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("Unexpected response status " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns hex encoded HMAC-SHA256 signature of the payload
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,155 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+)
+
+const testWebhookId = "webhook1"
+
+type testStorage struct {
+	webhooks   map[string]*common.Webhook
+	deliveries []*common.WebhookDelivery
+}
+
+func (s *testStorage) GetWebhook(id string) (*common.Webhook, error) {
+	webhook, ok := s.webhooks[id]
+	if !ok {
+		return nil, errors.New("Webhook not found")
+	}
+	return webhook, nil
+}
+
+func (s *testStorage) AddWebhookDelivery(delivery *common.WebhookDelivery) error {
+	s.deliveries = append(s.deliveries, delivery)
+	return nil
+}
+
+type scheduledAttempt struct {
+	delay   time.Duration
+	attempt func()
+}
+
+// newTestNotifier creates notifier that delivers webhooks to server responding
+// with status and collects scheduled retries instead of running them
+func newTestNotifier(t *testing.T, status *int, requests *int) (*WebhookNotifier, *testStorage, *[]scheduledAttempt, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if r.Header.Get("X-Gostfix-Signature") == "" {
+			t.Errorf("Webhook request is not signed")
+		}
+		w.WriteHeader(*status)
+	}))
+
+	storage := &testStorage{
+		webhooks: map[string]*common.Webhook{
+			testWebhookId: {Id: testWebhookId, Url: server.URL, Secret: "secret"},
+		},
+	}
+
+	scheduled := &[]scheduledAttempt{}
+	n := &WebhookNotifier{
+		deliveries: storage,
+		client:     server.Client(),
+		schedule: func(delay time.Duration, attempt func()) {
+			*scheduled = append(*scheduled, scheduledAttempt{delay, attempt})
+		},
+	}
+	return n, storage, scheduled, server.Close
+}
+
+func TestSign(t *testing.T) {
+	//HMAC-SHA256 test vector of "key" and "The quick brown fox jumps over the lazy dog"
+	signature := Sign("key", []byte("The quick brown fox jumps over the lazy dog"))
+	if signature != "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8" {
+		t.Errorf("Unexpected signature %s", signature)
+	}
+}
+
+func TestDeliverSuccess(t *testing.T) {
+	status, requests := http.StatusNoContent, 0
+	n, storage, scheduled, stop := newTestNotifier(t, &status, &requests)
+	defer stop()
+
+	n.deliver(testWebhookId, common.WebhookEventNewMail, "delivery1", []byte("{}"), 1)
+	if requests != 1 || len(storage.deliveries) != 1 {
+		t.Fatalf("Expected 1 request and delivery, got %d and %d", requests, len(storage.deliveries))
+	}
+
+	delivery := storage.deliveries[0]
+	if delivery.StatusCode != http.StatusNoContent || delivery.Error != "" || delivery.Attempt != 1 {
+		t.Errorf("Unexpected delivery %+v", delivery)
+	}
+	if len(*scheduled) != 0 {
+		t.Errorf("Successful delivery is retried")
+	}
+}
+
+func TestDeliverRetry(t *testing.T) {
+	status, requests := http.StatusInternalServerError, 0
+	n, storage, scheduled, stop := newTestNotifier(t, &status, &requests)
+	defer stop()
+
+	n.deliver(testWebhookId, common.WebhookEventNewMail, "delivery1", []byte("{}"), 1)
+	if len(storage.deliveries) != 1 || storage.deliveries[0].StatusCode != http.StatusInternalServerError || storage.deliveries[0].Error == "" {
+		t.Fatalf("Unexpected deliveries %+v", storage.deliveries)
+	}
+	if len(*scheduled) != 1 || (*scheduled)[0].delay != retryDelays[0] {
+		t.Fatalf("Failed delivery is not retried")
+	}
+
+	status = http.StatusOK
+	(*scheduled)[0].attempt()
+	if requests != 2 || len(storage.deliveries) != 2 || storage.deliveries[1].Attempt != 2 || storage.deliveries[1].Error != "" {
+		t.Errorf("Unexpected retry %+v", storage.deliveries[1])
+	}
+	if len(*scheduled) != 1 {
+		t.Errorf("Successful retry is retried")
+	}
+}
+
+func TestDeliverRemoved(t *testing.T) {
+	status, requests := http.StatusBadGateway, 0
+	n, storage, scheduled, stop := newTestNotifier(t, &status, &requests)
+	defer stop()
+
+	n.deliver(testWebhookId, common.WebhookEventNewMail, "delivery1", []byte("{}"), 1)
+	if len(*scheduled) != 1 {
+		t.Fatalf("Failed delivery is not retried")
+	}
+
+	delete(storage.webhooks, testWebhookId)
+	(*scheduled)[0].attempt()
+	if requests != 1 || len(storage.deliveries) != 1 || len(*scheduled) != 1 {
+		t.Errorf("Removed webhook is retried")
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	recordSize = 4096
+	saltLength = 16
+	//Record delimiter, payload always fits single record
+	lastRecordDelimiter = 0x02
+)
+
+// encrypt encrypts payload for the browser using aes128gcm content encoding
+// as described in RFC 8291. p256dh is browser public key, authSecret is
+// browser authentication secret.
+func encrypt(payload, p256dh, authSecret []byte) ([]byte, error) {
+	localKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return encryptWithKey(payload, p256dh, authSecret, salt, localKey)
+}
+
+func encryptWithKey(payload, p256dh, authSecret, salt []byte, localKey *ecdsa.PrivateKey) ([]byte, error) {
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, p256dh)
+	if uaX == nil {
+		return nil, errors.New("Invalid browser public key")
+	}
+
+	if len(payload)+1+16 > recordSize-saltLength-4-1-65 {
+		return nil, errors.New("Push payload is too large")
+	}
+
+	sharedX, _ := curve.ScalarMult(uaX, uaY, localKey.D.Bytes())
+	ecdhSecret := make([]byte, 32)
+	sharedBytes := sharedX.Bytes()
+	copy(ecdhSecret[32-len(sharedBytes):], sharedBytes)
+
+	localPublic := elliptic.Marshal(curve, localKey.X, localKey.Y)
+
+	keyInfo := append([]byte("WebPush: info\x00"), p256dh...)
+	keyInfo = append(keyInfo, localPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, saltLength+4+1)
+	copy(header, salt)
+	binary.BigEndian.PutUint32(header[saltLength:], recordSize)
+	header[saltLength+4] = byte(len(localPublic))
+	header = append(header, localPublic...)
+
+	record := append(append([]byte{}, payload...), lastRecordDelimiter)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
@@ -0,0 +1,143 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package webpush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	vapidKeyPemType = "EC PRIVATE KEY"
+	//Push services reject tokens that expire later than in 24 hours
+	vapidTokenLifetime = 12 * time.Hour
+)
+
+// LoadVapidKey reads VAPID private key from PEM file at path, new P-256 key
+// is generated if file doesn't exist
+func LoadVapidKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != vapidKeyPemType {
+			return nil, errors.New("Invalid VAPID key file " + path)
+		}
+
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil || key.Curve != elliptic.P256() {
+			return nil, errors.New("Invalid VAPID key file " + path)
+		}
+		return key, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Printf("VAPID key not found, generating new key in %s\n", path)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	//Key is written to temporary file and linked to the path, so web server
+	//and notifier always read the same key
+	tmpPath := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	err = ioutil.WriteFile(tmpPath, pem.EncodeToMemory(&pem.Block{Type: vapidKeyPemType, Bytes: der}), 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpPath)
+
+	err = os.Link(tmpPath, path)
+	if os.IsExist(err) {
+		return LoadVapidKey(path)
+	}
+	return key, err
+}
+
+// PublicKey returns base64url encoded uncompressed public key, that is used
+// by browsers as applicationServerKey
+func PublicKey(key *ecdsa.PrivateKey) string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y))
+}
+
+// vapidAuthorization creates Authorization header value for the push
+// service endpoint as described in RFC 8292
+func vapidAuthorization(key *ecdsa.PrivateKey, endpoint, subject string) (string, error) {
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(&struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}{
+		Aud: endpointUrl.Scheme + "://" + endpointUrl.Host,
+		Exp: time.Now().Add(vapidTokenLifetime).Unix(),
+		Sub: subject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	//ES256 signature is fixed size concatenation of r and s
+	signature := make([]byte, 64)
+	rBytes := r.Bytes()
+	sBytes := s.Bytes()
+	copy(signature[32-len(rBytes):32], rBytes)
+	copy(signature[64-len(sBytes):], sBytes)
+
+	token := signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return "vapid t=" + token + ", k=" + PublicKey(key), nil
+}
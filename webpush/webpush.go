@@ -0,0 +1,227 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package webpush
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	common "git.semlanik.org/semlanik/gostfix/common"
+	config "git.semlanik.org/semlanik/gostfix/config"
+	db "git.semlanik.org/semlanik/gostfix/db"
+	utils "git.semlanik.org/semlanik/gostfix/utils"
+)
+
+const (
+	eventQueueSize  = 1024
+	deliveryTimeout = 10 * time.Second
+	maxResponseSize = 64 * 1024
+	//Time in seconds that push service keeps notification for offline browser
+	notificationTtl  = "86400"
+	maxSubjectLength = 256
+	maxSenderLength  = 256
+)
+
+// pushNotification is payload that is decrypted and shown by service worker
+type pushNotification struct {
+	Type    string `json:"type"`
+	Email   string `json:"email"`
+	Id      string `json:"id"`
+	Folder  string `json:"folder"`
+	From    string `json:"from"`
+	Subject string `json:"subject"`
+}
+
+type pushEvent struct {
+	user         string
+	notification *pushNotification
+}
+
+// PushNotifier sends Web Push notifications about new mail to the browsers
+// subscribed by users
+type PushNotifier struct {
+	storage *db.Storage
+	key     *ecdsa.PrivateKey
+	subject string
+	events  chan *pushEvent
+	client  *http.Client
+}
+
+func NewPushNotifier() (*PushNotifier, error) {
+	key, err := LoadVapidKey(config.ConfigInstance().WebVapidKey)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := db.NewStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &PushNotifier{
+		storage: storage,
+		key:     key,
+		subject: config.ConfigInstance().WebVapidSubject,
+		events:  make(chan *pushEvent, eventQueueSize),
+		client:  utils.NewHttpClient(deliveryTimeout, false),
+	}
+	storage.RegisterNotifier(n, &common.NotifierOptions{
+		Name:     "push",
+		Overflow: common.OverflowDrop,
+		Types:    []string{common.EventMailCreated},
+	})
+	return n, nil
+}
+
+func (n *PushNotifier) Run() {
+	go func() {
+		for event := range n.events {
+			n.dispatch(event)
+		}
+	}()
+}
+
+func (n *PushNotifier) Notify(event *common.Event) {
+	//Copies of outgoing mail are not new mail
+	if event.Type != common.EventMailCreated || event.Mail.Folder == common.Sent || !n.storage.ClaimEvent(event, "push") {
+		return
+	}
+
+	m := event.Mail
+	notification := &pushNotification{
+		Type:   "newMail",
+		Email:  event.Email,
+		Id:     m.Id,
+		Folder: m.Folder,
+	}
+
+	if m.Mail != nil && m.Mail.Header != nil {
+		notification.From = truncate(m.Mail.Header.From, maxSenderLength)
+		notification.Subject = truncate(m.Mail.Header.Subject, maxSubjectLength)
+	}
+
+	select {
+	case n.events <- &pushEvent{user: m.User, notification: notification}:
+	default:
+		log.Printf("Push queue is full, dropping notification for %s\n", event.Email)
+	}
+}
+
+func (n *PushNotifier) dispatch(event *pushEvent) {
+	subscriptions, err := n.storage.GetPushSubscriptions(event.user)
+	if err != nil {
+		log.Printf("Unable to get push subscriptions of %s: %s\n", event.user, err)
+		return
+	}
+
+	if len(subscriptions) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(event.notification)
+	if err != nil {
+		log.Printf("Unable to create push notification: %s\n", err)
+		return
+	}
+
+	for _, subscription := range subscriptions {
+		go func(subscription *common.PushSubscription) {
+			err := n.Send(subscription, payload)
+			if err == errSubscriptionGone {
+				log.Printf("Push subscription of %s is expired, removing\n", subscription.User)
+				n.storage.RemovePushSubscription(subscription.User, subscription.Endpoint)
+			} else if err != nil {
+				log.Printf("Unable to send push notification to %s: %s\n", subscription.User, err)
+			}
+		}(subscription)
+	}
+}
+
+var errSubscriptionGone = errors.New("Push subscription is expired")
+
+// Send encrypts payload for the subscription and posts it to push service
+func (n *PushNotifier) Send(subscription *common.PushSubscription, payload []byte) error {
+	p256dh, err := base64.RawURLEncoding.DecodeString(subscription.P256dh)
+	if err != nil {
+		return err
+	}
+
+	authSecret, err := base64.RawURLEncoding.DecodeString(subscription.Auth)
+	if err != nil {
+		return err
+	}
+
+	body, err := encrypt(payload, p256dh, authSecret)
+	if err != nil {
+		return err
+	}
+
+	authorization, err := vapidAuthorization(n.key, subscription.Endpoint, n.subject)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", notificationTtl)
+	req.Header.Set("Urgency", "normal")
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errSubscriptionGone
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return errors.New("Unexpected push service response " + resp.Status)
+	}
+	return nil
+}
+
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) > length {
+		return string(runes[:length]) + "…"
+	}
+	return s
+}
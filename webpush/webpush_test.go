@@ -0,0 +1,220 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2020 Alexey Edelev <semlanik@gmail.com>
+ *
+ * This file is part of gostfix project https://git.semlanik.org/semlanik/gostfix
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this
+ * software and associated documentation files (the "Software"), to deal in the Software
+ * without restriction, including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the Software, and
+ * to permit persons to whom the Software is furnished to do so, subject to the following
+ * conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies
+ * or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+ * PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE
+ * FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+ * OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE.
+ */
+package webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.semlanik.org/semlanik/gostfix/common"
+	"git.semlanik.org/semlanik/gostfix/utils"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Test vector from RFC 8291 Appendix A
+const (
+	testPlaintext       = "When I grow up, I want to be a watermelon"
+	testAsPrivate       = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	testUaPrivate       = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	testUaPublic        = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	testAuthSecret      = "BTBZMqHH6r4Tts7J_aSIgg"
+	testSalt            = "DGv6ra1nlYgDCS1FRnbzlw"
+	testEncryptedRecord = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func decode(t *testing.T, s string) []byte {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Invalid test data %s: %s", s, err)
+	}
+	return data
+}
+
+func privateKey(d []byte) *ecdsa.PrivateKey {
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.Curve = elliptic.P256()
+	key.X, key.Y = key.Curve.ScalarBaseMult(d)
+	return key
+}
+
+// decrypt is browser side of RFC 8291
+func decrypt(t *testing.T, body []byte, uaKey *ecdsa.PrivateKey, authSecret []byte) []byte {
+	if len(body) < saltLength+4+1+65 {
+		t.Fatalf("Encrypted body is too short")
+	}
+
+	salt := body[:saltLength]
+	if rs := binary.BigEndian.Uint32(body[saltLength:]); rs != recordSize {
+		t.Fatalf("Unexpected record size %d", rs)
+	}
+
+	idLength := int(body[saltLength+4])
+	asPublic := body[saltLength+5 : saltLength+5+idLength]
+	ciphertext := body[saltLength+5+idLength:]
+
+	curve := elliptic.P256()
+	asX, asY := elliptic.Unmarshal(curve, asPublic)
+	if asX == nil {
+		t.Fatalf("Invalid application server key")
+	}
+	sharedX, _ := curve.ScalarMult(asX, asY, uaKey.D.Bytes())
+	ecdhSecret := make([]byte, 32)
+	sharedBytes := sharedX.Bytes()
+	copy(ecdhSecret[32-len(sharedBytes):], sharedBytes)
+
+	keyInfo := append([]byte("WebPush: info\x00"), elliptic.Marshal(curve, uaKey.X, uaKey.Y)...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm)
+	cek := make([]byte, 16)
+	io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek)
+	nonce := make([]byte, 12)
+	io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce)
+
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	record, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Unable to decrypt push message: %s", err)
+	}
+
+	if record[len(record)-1] != lastRecordDelimiter {
+		t.Fatalf("Invalid record delimiter")
+	}
+	return record[:len(record)-1]
+}
+
+func TestEncrypt(t *testing.T) {
+	body, err := encryptWithKey([]byte(testPlaintext), decode(t, testUaPublic), decode(t, testAuthSecret),
+		decode(t, testSalt), privateKey(decode(t, testAsPrivate)))
+	if err != nil {
+		t.Fatalf("Unable to encrypt: %s", err)
+	}
+
+	if encoded := base64.RawURLEncoding.EncodeToString(body); encoded != testEncryptedRecord {
+		t.Errorf("Unexpected encrypted record %s", encoded)
+	}
+
+	plaintext := decrypt(t, body, privateKey(decode(t, testUaPrivate)), decode(t, testAuthSecret))
+	if string(plaintext) != testPlaintext {
+		t.Errorf("Unexpected plaintext %s", plaintext)
+	}
+}
+
+func TestSend(t *testing.T) {
+	vapidKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	uaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+
+	payload := []byte(`{"type":"newMail","subject":"Hello"}`)
+	gone := false
+
+	//Push service stub verifies VAPID token and decrypts the message
+	pushService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gone {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") == "" {
+			t.Errorf("Invalid push headers %v", r.Header)
+		}
+
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "vapid t=") {
+			t.Fatalf("Invalid authorization %s", authorization)
+		}
+		parts := strings.Split(strings.TrimPrefix(authorization, "vapid t="), ", k=")
+		if len(parts) != 2 || parts[1] != PublicKey(vapidKey) {
+			t.Fatalf("Invalid authorization %s", authorization)
+		}
+
+		token := strings.Split(parts[0], ".")
+		if len(token) != 3 {
+			t.Fatalf("Invalid VAPID token %s", parts[0])
+		}
+		hash := sha256.Sum256([]byte(token[0] + "." + token[1]))
+		signature := decode(t, token[2])
+		if len(signature) != 64 || !ecdsa.Verify(&vapidKey.PublicKey, hash[:],
+			new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			t.Errorf("Invalid VAPID signature")
+		}
+		if claims := string(decode(t, token[1])); !strings.Contains(claims, `"aud":"`+"http://"+r.Host+`"`) ||
+			!strings.Contains(claims, `"sub":"mailto:postmaster@example.com"`) {
+			t.Errorf("Invalid VAPID claims %s", claims)
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if plaintext := decrypt(t, body, uaKey, authSecret); !bytes.Equal(plaintext, payload) {
+			t.Errorf("Unexpected payload %s", plaintext)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer pushService.Close()
+
+	n := &PushNotifier{
+		key:     vapidKey,
+		subject: "mailto:postmaster@example.com",
+		client:  utils.NewHttpClient(time.Second, true),
+	}
+
+	subscription := &common.PushSubscription{
+		User:     "user@example.com",
+		Endpoint: pushService.URL + "/push/1",
+		P256dh:   base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), uaKey.X, uaKey.Y)),
+		Auth:     base64.RawURLEncoding.EncodeToString(authSecret),
+	}
+
+	if err := n.Send(subscription, payload); err != nil {
+		t.Errorf("Unable to send push message: %s", err)
+	}
+
+	gone = true
+	if err := n.Send(subscription, payload); err != errSubscriptionGone {
+		t.Errorf("Expired subscription is not detected: %v", err)
+	}
+
+	//Loopback endpoints are refused by default
+	n.client = utils.NewHttpClient(time.Second, false)
+	if err := n.Send(subscription, payload); err == nil {
+		t.Errorf("Push message is sent to loopback address")
+	}
+}